@@ -0,0 +1,340 @@
+package maildoor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// approvalCookie identifies the login waiting for approval in the
+	// browser that requested the code.
+	approvalCookie = "maildoor_login"
+
+	// approvalTTL is the time a login can wait for its approval.
+	approvalTTL = 10 * time.Minute
+)
+
+// Approval describes a login waiting to be approved from another
+// device, it is shown in the approval page.
+type Approval struct {
+	Email string
+
+	// Device, IP and Location describe where the login was requested.
+	Device   string
+	IP       string
+	Location string
+
+	RequestedAt time.Time
+
+	// Token identifies the login in the approval form.
+	Token string
+
+	// Approved is true once the login was approved and Expired when
+	// the link is invalid, expired or was already used.
+	Approved bool
+	Expired  bool
+
+	// Handoff is true when the login is approved from a signed in
+	// device that scanned the QR code of the code page.
+	Handoff bool
+
+	// CSRF is the token of the handoff form, it binds the form to the
+	// signed in device that rendered it.
+	CSRF string
+}
+
+// ErrApprovalNotFound is returned by the ApprovalStore when there is no
+// waiting login for the id or alias.
+var ErrApprovalNotFound = errors.New("maildoor: approval not found")
+
+// PendingLogin is a login waiting for approval in the browser that
+// requested it.
+type PendingLogin struct {
+	Approval
+
+	// HandoffID identifies the login in the QR code of its code page.
+	HandoffID string
+
+	ExpiresAt time.Time
+}
+
+// ApprovalStore keeps the logins waiting for approval, see
+// CrossDeviceApproval. Services with several instances should share it,
+// e.g. with Redis.
+type ApprovalStore interface {
+	// Save keeps the login with the id until it expires, Lookup returns
+	// the id for each of the aliases.
+	Save(ctx context.Context, id string, p PendingLogin, aliases ...string) error
+
+	// Lookup returns the id of the login saved with the alias or
+	// ErrApprovalNotFound.
+	Lookup(ctx context.Context, alias string) (string, error)
+
+	// Find returns the login with the id or ErrApprovalNotFound.
+	Find(ctx context.Context, id string) (PendingLogin, error)
+
+	// Approve marks the login with the id as approved and returns it,
+	// or ErrApprovalNotFound when it was approved already. It needs to
+	// be atomic so a login can't be approved twice.
+	Approve(ctx context.Context, id string) (PendingLogin, error)
+
+	// Take returns and removes the login with the id once it was
+	// approved, or ErrApprovalNotFound. It needs to be atomic so a
+	// login can't be completed twice.
+	Take(ctx context.Context, id string) (PendingLogin, error)
+}
+
+// InMemoryApprovalStore keeps the logins waiting for approval in memory
+// until they expire.
+type InMemoryApprovalStore struct {
+	mu      sync.Mutex
+	logins  map[string]PendingLogin
+	aliases map[string]string
+}
+
+// NewInMemoryApprovalStore creates an empty in-memory approval store.
+func NewInMemoryApprovalStore() *InMemoryApprovalStore {
+	return &InMemoryApprovalStore{
+		logins:  map[string]PendingLogin{},
+		aliases: map[string]string{},
+	}
+}
+
+// Save implements ApprovalStore.Save
+func (s *InMemoryApprovalStore) Save(ctx context.Context, id string, p PendingLogin, aliases ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, l := range s.logins {
+		if now.After(l.ExpiresAt) {
+			delete(s.logins, k)
+		}
+	}
+
+	for a, k := range s.aliases {
+		if _, ok := s.logins[k]; !ok {
+			delete(s.aliases, a)
+		}
+	}
+
+	s.logins[id] = p
+	for _, a := range aliases {
+		s.aliases[a] = id
+	}
+
+	return nil
+}
+
+// Lookup implements ApprovalStore.Lookup
+func (s *InMemoryApprovalStore) Lookup(ctx context.Context, alias string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.aliases[alias]
+	if !ok {
+		return "", ErrApprovalNotFound
+	}
+
+	return id, nil
+}
+
+// Find implements ApprovalStore.Find
+func (s *InMemoryApprovalStore) Find(ctx context.Context, id string) (PendingLogin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.logins[id]
+	if !ok || time.Now().After(p.ExpiresAt) {
+		return PendingLogin{}, ErrApprovalNotFound
+	}
+
+	return p, nil
+}
+
+// Approve implements ApprovalStore.Approve
+func (s *InMemoryApprovalStore) Approve(ctx context.Context, id string) (PendingLogin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.logins[id]
+	if !ok || p.Approved || time.Now().After(p.ExpiresAt) {
+		return PendingLogin{}, ErrApprovalNotFound
+	}
+
+	p.Approved = true
+	s.logins[id] = p
+
+	return p, nil
+}
+
+// Take implements ApprovalStore.Take
+func (s *InMemoryApprovalStore) Take(ctx context.Context, id string) (PendingLogin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.logins[id]
+	if !ok || !p.Approved || time.Now().After(p.ExpiresAt) {
+		return PendingLogin{}, ErrApprovalNotFound
+	}
+
+	delete(s.logins, id)
+	return p, nil
+}
+
+// startApproval creates a login waiting for approval for the email and
+// binds it to the browser with a cookie. It returns the approval token
+// for the emailed link, or an empty string when cross device approval
+// is disabled.
+func (m *maildoor) startApproval(w http.ResponseWriter, r *http.Request, email string) (string, error) {
+	if !m.crossDevice {
+		return "", nil
+	}
+
+	ip := clientIP(r)
+	p := PendingLogin{
+		Approval: Approval{
+			Email:       email,
+			Device:      describeUserAgent(r.UserAgent()),
+			IP:          ip,
+			RequestedAt: time.Now(),
+			Token:       randomToken(),
+		},
+		HandoffID: randomToken(),
+		ExpiresAt: time.Now().Add(approvalTTL),
+	}
+
+	if m.ipLocator != nil && ip != "" {
+		p.Location = m.ipLocator(ip)
+	}
+
+	id := randomToken()
+	err := m.approvals.Save(r.Context(), m.storageKey(r, id), p, m.tokenAlias(r, p.Token), m.handoffAlias(r, p.HandoffID))
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     approvalCookie,
+		Value:    id,
+		Path:     m.tenant(r).prefix,
+		MaxAge:   int(approvalTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   m.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return p.Token, nil
+}
+
+// tokenAlias and handoffAlias return the keys the approval token and
+// the handoff id of a login are saved with in the ApprovalStore.
+func (m *maildoor) tokenAlias(r *http.Request, token string) string {
+	return m.storageKey(r, "token:"+token)
+}
+
+func (m *maildoor) handoffAlias(r *http.Request, handoff string) string {
+	return m.storageKey(r, "handoff:"+handoff)
+}
+
+// waitingLogin returns the login saved with the alias while it waits
+// for the approval, approving it when approve is true.
+func (m *maildoor) waitingLogin(r *http.Request, alias string, approve bool) (Approval, bool) {
+	id, err := m.approvals.Lookup(r.Context(), alias)
+	if err != nil {
+		return Approval{}, false
+	}
+
+	p, err := m.approvals.Find(r.Context(), id)
+	if err != nil || p.Approved {
+		return Approval{}, false
+	}
+
+	if approve {
+		p, err = m.approvals.Approve(r.Context(), id)
+		if err != nil {
+			return Approval{}, false
+		}
+	}
+
+	return p.Approval, true
+}
+
+// handoffID returns the handoff id of the login waiting in the browser.
+func (m *maildoor) handoffID(r *http.Request) (string, bool) {
+	p, err := m.approvals.Find(r.Context(), m.approvalID(r))
+	if err != nil || p.Approved {
+		return "", false
+	}
+
+	return p.HandoffID, true
+}
+
+// approvalStatus returns pending, approved or expired for the login
+// waiting in the browser.
+func (m *maildoor) approvalStatus(r *http.Request) string {
+	p, err := m.approvals.Find(r.Context(), m.approvalID(r))
+	switch {
+	case err != nil:
+		return "expired"
+	case p.Approved:
+		return "approved"
+	default:
+		return "pending"
+	}
+}
+
+// awaitingApproval returns true when the browser has a login
+// waiting for approval.
+func (m *maildoor) awaitingApproval(r *http.Request) bool {
+	return m.crossDevice && m.approvalStatus(r) == "pending"
+}
+
+// approvalID returns the key of the login waiting in the browser in
+// the tenant of the request.
+func (m *maildoor) approvalID(r *http.Request) string {
+	c, err := r.Cookie(approvalCookie)
+	if err != nil {
+		return ""
+	}
+
+	return m.storageKey(r, c.Value)
+}
+
+// describeUserAgent returns a short description of the browser and
+// operating system in the user agent, e.g. Chrome on macOS.
+func describeUserAgent(ua string) string {
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Android", "Android"},
+		{"CrOS", "ChromeOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			return browser + " on " + o.name
+		}
+	}
+
+	return browser
+}
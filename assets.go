@@ -0,0 +1,93 @@
+package maildoor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	// assetHashes maps the embedded asset names to their content hash.
+	assetHashes = hashAssets()
+
+	// hashedAssets maps the hashed asset names (e.g. maildoor.1a2b3c4d5e.css)
+	// back to the embedded asset names.
+	hashedAssets = map[string]string{}
+)
+
+func init() {
+	for name := range assetHashes {
+		hashedAssets[hashedName(name)] = name
+	}
+}
+
+// hashAssets computes the content hash of each of the embedded assets.
+func hashAssets() map[string]string {
+	hashes := map[string]string{}
+	entries, err := fs.ReadDir(assets, "assets")
+	if err != nil {
+		panic(err)
+	}
+
+	for _, e := range entries {
+		b, err := fs.ReadFile(assets, path.Join("assets", e.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		sum := sha256.Sum256(b)
+		hashes[e.Name()] = hex.EncodeToString(sum[:5])
+	}
+
+	return hashes
+}
+
+// hashedName returns the asset name with its content hash
+// before the extension.
+func hashedName(name string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + assetHashes[name] + ext
+}
+
+// assetURL returns the URL for the named asset under the prefix,
+// including its content hash so it can be cached indefinitely.
+func assetURL(prefix, name string) string {
+	if _, ok := assetHashes[name]; ok {
+		name = hashedName(name)
+	}
+
+	return path.Join(prefix, "assets", name)
+}
+
+// handleAsset serves the embedded assets. Hashed names are cached
+// for a year since their content never changes, plain names need to
+// be revalidated with the ETag.
+func (m *maildoor) handleAsset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+	cache := "no-cache"
+	if original, ok := hashedAssets[name]; ok {
+		name = original
+		cache = "public, max-age=31536000, immutable"
+	}
+
+	hash, ok := assetHashes[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	b, err := fs.ReadFile(assets, path.Join("assets", name))
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", cache)
+	w.Header().Set("ETag", `"`+hash+`"`)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b))
+}
@@ -0,0 +1,76 @@
+// Passkey ceremonies of the login and passkey pages. Forms with the
+// data-passkey attribute (login or register) fetch the options from
+// data-options, ask the authenticator and post its response.
+(function () {
+    if (!window.PublicKeyCredential) {
+        return;
+    }
+
+    var decode = function (s) {
+        var bin = atob(s.replace(/-/g, "+").replace(/_/g, "/"));
+        var bytes = new Uint8Array(bin.length);
+        for (var i = 0; i < bin.length; i++) {
+            bytes[i] = bin.charCodeAt(i);
+        }
+
+        return bytes.buffer;
+    };
+
+    var encode = function (buf) {
+        var bin = "";
+        new Uint8Array(buf).forEach(function (b) { bin += String.fromCharCode(b); });
+        return btoa(bin).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    };
+
+    document.querySelectorAll("[data-passkey-only]").forEach(function (el) {
+        el.hidden = false;
+    });
+
+    document.querySelectorAll("form[data-passkey]").forEach(function (form) {
+        var fail = function () {
+            var error = form.querySelector("[data-passkey-error]");
+            if (error) {
+                error.hidden = false;
+            }
+        };
+
+        var set = function (name, buf) {
+            form.elements[name].value = buf ? encode(buf) : "";
+        };
+
+        form.addEventListener("submit", function (e) {
+            e.preventDefault();
+
+            fetch(form.dataset.options, { method: "POST", credentials: "same-origin" })
+                .then(function (res) {
+                    if (!res.ok) {
+                        throw new Error("passkey options: " + res.status);
+                    }
+
+                    return res.json();
+                })
+                .then(function (options) {
+                    options.challenge = decode(options.challenge);
+                    if (form.dataset.passkey === "register") {
+                        options.user.id = decode(options.user.id);
+                        return navigator.credentials.create({ publicKey: options });
+                    }
+
+                    return navigator.credentials.get({ publicKey: options });
+                })
+                .then(function (cred) {
+                    set("id", cred.rawId);
+                    set("clientDataJSON", cred.response.clientDataJSON);
+                    if (form.dataset.passkey === "register") {
+                        set("attestationObject", cred.response.attestationObject);
+                    } else {
+                        set("authenticatorData", cred.response.authenticatorData);
+                        set("signature", cred.response.signature);
+                    }
+
+                    form.submit();
+                })
+                .catch(fail);
+        });
+    });
+})();
@@ -0,0 +1,109 @@
+package maildoor_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestAssets(t *testing.T) {
+	cssURL := regexp.MustCompile(`/auth/assets/maildoor\.[0-9a-f]{10}\.css`)
+
+	t.Run("pages link the embedded assets", func(t *testing.T) {
+		auth := maildoor.New(maildoor.Prefix("/auth"))
+
+		body := loginPage(t, auth)
+		testhelpers.NotContains(t, body, "cdn.tailwindcss.com")
+		testhelpers.NotContains(t, body, "githubusercontent.com")
+		testhelpers.True(t, cssURL.MatchString(body))
+		testhelpers.True(t, regexp.MustCompile(`/auth/assets/logo\.[0-9a-f]{10}\.png`).MatchString(body))
+		testhelpers.True(t, regexp.MustCompile(`/auth/assets/icon\.[0-9a-f]{10}\.png`).MatchString(body))
+	})
+
+	t.Run("serves hashed assets with long cache", func(t *testing.T) {
+		auth := maildoor.New(maildoor.Prefix("/auth"))
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", cssURL.FindString(loginPage(t, auth)), nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Header().Get("Content-Type"), "text/css")
+		testhelpers.Equals(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+		testhelpers.NotEquals(t, "", w.Header().Get("ETag"))
+	})
+
+	t.Run("serves the logo at its old path", func(t *testing.T) {
+		auth := maildoor.New(maildoor.Prefix("/auth"))
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/auth/logo.png", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Equals(t, "image/png", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("serves plain names with revalidation", func(t *testing.T) {
+		auth := maildoor.New()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/assets/logo.png", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Equals(t, "image/png", w.Header().Get("Content-Type"))
+		testhelpers.Equals(t, "no-cache", w.Header().Get("Cache-Control"))
+
+		etag := w.Header().Get("ETag")
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/assets/logo.png", nil)
+		req.Header.Set("If-None-Match", etag)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusNotModified, w.Code)
+	})
+
+	t.Run("unknown assets", func(t *testing.T) {
+		auth := maildoor.New()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/assets/missing.js", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("emails use absolute logo URL", func(t *testing.T) {
+		var html string
+		auth := maildoor.New(
+			maildoor.BaseURL("https://example.com"),
+			maildoor.EmailSender(func(to, h, txt string) error {
+				html = h
+				return nil
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "https://example.com/email", nil)
+		req.Form = url.Values{"email": {"test@example.com"}}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.True(t, regexp.MustCompile(`https://example.com/assets/logo\.[0-9a-f]{10}\.png`).MatchString(html))
+	})
+}
+
+func loginPage(t *testing.T, auth http.Handler) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/auth/login", nil)
+	auth.ServeHTTP(w, req)
+
+	return w.Body.String()
+}
@@ -0,0 +1,351 @@
+package maildoor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a record of the audit log. Entries are chained by
+// including the hash of the previous entry in their own hash, so
+// changing or removing an entry breaks the chain.
+type AuditEntry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Event     EventType `json:"event"`
+	Outcome   Outcome   `json:"outcome"`
+	Email     string    `json:"email,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Error     string    `json:"error,omitempty"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// computeHash returns the hash of the entry, which covers all
+// of its fields but the hash itself.
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog persists the authentication activity. Implementations
+// are responsible for assigning the Seq, PrevHash and Hash of the
+// entries they receive.
+type AuditLog interface {
+	Append(ctx context.Context, e AuditEntry) error
+}
+
+// auditHandler is the event handler that writes the events
+// to the audit log.
+type auditHandler struct {
+	log AuditLog
+}
+
+func (a auditHandler) HandleEvent(ctx context.Context, e Event) {
+	entry := AuditEntry{
+		Time:      e.Time,
+		Event:     e.Type,
+		Outcome:   e.Outcome,
+		Email:     e.Email,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+	}
+
+	if e.Err != nil {
+		entry.Error = e.Err.Error()
+	}
+
+	if err := a.log.Append(ctx, entry); err != nil {
+		loggerFrom(ctx).Error("writing audit log", "error", err.Error())
+	}
+}
+
+// FileAuditLogOptions configure the rotation and retention of
+// a FileAuditLog.
+type FileAuditLogOptions struct {
+	// MaxBytes is the size after which the file gets rotated,
+	// 0 means the file is never rotated.
+	MaxBytes int64
+
+	// Retention is how long rotated files are kept, 0 means
+	// rotated files are kept forever.
+	Retention time.Duration
+}
+
+// FileAuditLog is an AuditLog that writes JSON lines to a file.
+// Rotated files are renamed with a timestamp suffix (e.g. audit.log.20240102T150405.000000000Z)
+// and the chain continues in the new file.
+type FileAuditLog struct {
+	mu   sync.Mutex
+	path string
+	opts FileAuditLogOptions
+
+	file *os.File
+	size int64
+	seq  int64
+	last string
+}
+
+// NewFileAuditLog opens or creates the audit log at path, continuing
+// the chain from the last entry when the file already exists.
+func NewFileAuditLog(path string, opts FileAuditLogOptions) (*FileAuditLog, error) {
+	l := &FileAuditLog{path: path, opts: opts}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// open opens the log file and continues the chain from its last
+// entry, or from the last rotated file when the file is empty.
+func (l *FileAuditLog) open() error {
+	last, err := lastAuditEntry(l.path)
+	if err != nil {
+		return err
+	}
+
+	if last.Hash == "" {
+		rotated, err := l.Rotated()
+		if err != nil {
+			return err
+		}
+
+		if len(rotated) > 0 {
+			last, err = lastAuditEntry(rotated[len(rotated)-1])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+	l.seq = last.Seq
+	l.last = last.Hash
+
+	return nil
+}
+
+// lastAuditEntry reads the last entry of the audit log file at path,
+// it returns an empty entry when the file does not exist.
+func lastAuditEntry(path string) (AuditEntry, error) {
+	var last AuditEntry
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return last, nil
+	}
+
+	if err != nil {
+		return last, err
+	}
+
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+
+		if err := json.Unmarshal(s.Bytes(), &last); err != nil {
+			return last, fmt.Errorf("reading audit log %s: %w", path, err)
+		}
+	}
+
+	return last, s.Err()
+}
+
+// Append implements AuditLog.Append.
+func (l *FileAuditLog) Append(ctx context.Context, e AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	e.Time = e.Time.UTC()
+	e.PrevHash = l.last
+
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+
+	e.Hash = hash
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	b = append(b, '\n')
+	if l.opts.MaxBytes > 0 && l.size > 0 && l.size+int64(len(b)) > l.opts.MaxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	l.seq = e.Seq
+	l.last = e.Hash
+
+	return nil
+}
+
+// rotate renames the current file and opens a new one, then removes
+// the rotated files older than the retention.
+func (l *FileAuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := l.path + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	l.file = f
+	l.size = 0
+
+	return l.cleanup()
+}
+
+// cleanup removes the rotated files older than the retention.
+func (l *FileAuditLog) cleanup() error {
+	if l.opts.Retention <= 0 {
+		return nil
+	}
+
+	files, err := l.Rotated()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+
+		if time.Since(info.ModTime()) > l.opts.Retention {
+			if err := os.Remove(f); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Rotated returns the paths of the rotated files, oldest first.
+func (l *FileAuditLog) Rotated() ([]string, error) {
+	files, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	// Timestamps sort lexically, Glob returns them sorted.
+	var rotated []string
+	for _, f := range files {
+		if strings.HasSuffix(f, "Z") {
+			rotated = append(rotated, f)
+		}
+	}
+
+	return rotated, nil
+}
+
+// Close closes the underlying file.
+func (l *FileAuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
+
+// ErrAuditTampered is returned by VerifyAuditLog when the chain
+// of entries is broken.
+var ErrAuditTampered = errors.New("audit log tampered")
+
+// VerifyAuditLog checks the chain of the entries read from r and
+// returns the hash of the last entry. The prev hash of the first
+// entry is trusted, so rotated files can be verified on their own or
+// together, in order, with io.MultiReader.
+func VerifyAuditLog(r io.Reader) (string, error) {
+	var last string
+	var seq int64
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+
+		var e AuditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return "", fmt.Errorf("%w: line %d: %v", ErrAuditTampered, line, err)
+		}
+
+		hash, err := e.computeHash()
+		if err != nil {
+			return "", err
+		}
+
+		if hash != e.Hash {
+			return "", fmt.Errorf("%w: line %d: hash mismatch", ErrAuditTampered, line)
+		}
+
+		if seq > 0 && (e.PrevHash != last || e.Seq != seq+1) {
+			return "", fmt.Errorf("%w: line %d: broken chain", ErrAuditTampered, line)
+		}
+
+		last = e.Hash
+		seq = e.Seq
+	}
+
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+
+	return last, nil
+}
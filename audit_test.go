@@ -0,0 +1,142 @@
+package maildoor_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	appendN := func(t *testing.T, l *maildoor.FileAuditLog, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			err := l.Append(context.Background(), maildoor.AuditEntry{
+				Time:    time.Now(),
+				Event:   maildoor.EventCodeRequested,
+				Outcome: maildoor.OutcomeSuccess,
+				Email:   "a@b.com",
+			})
+
+			testhelpers.NoError(t, err)
+		}
+	}
+
+	t.Run("records maildoor events", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		l, err := maildoor.NewFileAuditLog(path, maildoor.FileAuditLogOptions{})
+		testhelpers.NoError(t, err)
+		defer l.Close()
+
+		auth := maildoor.New(
+			maildoor.WithAuditLog(l),
+			maildoor.EmailSender(func(to, html, txt string) error {
+				return errors.New("smtp down")
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {"a@b.com"}}
+		auth.ServeHTTP(w, req)
+
+		b, err := os.ReadFile(path)
+		testhelpers.NoError(t, err)
+
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		testhelpers.Equals(t, 2, len(lines))
+		testhelpers.Contains(t, lines[0], `"seq":1`)
+		testhelpers.Contains(t, lines[0], `"event":"code_requested"`)
+		testhelpers.Contains(t, lines[1], `"event":"send_failed"`)
+		testhelpers.Contains(t, lines[1], `"error":"smtp down"`)
+
+		_, err = maildoor.VerifyAuditLog(strings.NewReader(string(b)))
+		testhelpers.NoError(t, err)
+	})
+
+	t.Run("detects tampering", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		l, err := maildoor.NewFileAuditLog(path, maildoor.FileAuditLogOptions{})
+		testhelpers.NoError(t, err)
+		appendN(t, l, 3)
+		l.Close()
+
+		b, err := os.ReadFile(path)
+		testhelpers.NoError(t, err)
+
+		changed := strings.Replace(string(b), "a@b.com", "c@d.com", 1)
+		_, err = maildoor.VerifyAuditLog(strings.NewReader(changed))
+		testhelpers.True(t, errors.Is(err, maildoor.ErrAuditTampered))
+
+		lines := strings.SplitAfter(string(b), "\n")
+		removed := lines[0] + lines[2]
+		_, err = maildoor.VerifyAuditLog(strings.NewReader(removed))
+		testhelpers.True(t, errors.Is(err, maildoor.ErrAuditTampered))
+	})
+
+	t.Run("continues the chain when reopened", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		l, err := maildoor.NewFileAuditLog(path, maildoor.FileAuditLogOptions{})
+		testhelpers.NoError(t, err)
+		appendN(t, l, 2)
+		l.Close()
+
+		l, err = maildoor.NewFileAuditLog(path, maildoor.FileAuditLogOptions{})
+		testhelpers.NoError(t, err)
+		appendN(t, l, 2)
+		l.Close()
+
+		f, err := os.Open(path)
+		testhelpers.NoError(t, err)
+		defer f.Close()
+
+		_, err = maildoor.VerifyAuditLog(f)
+		testhelpers.NoError(t, err)
+	})
+
+	t.Run("rotation and retention", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		l, err := maildoor.NewFileAuditLog(path, maildoor.FileAuditLogOptions{
+			MaxBytes:  300,
+			Retention: time.Hour,
+		})
+		testhelpers.NoError(t, err)
+		defer l.Close()
+
+		appendN(t, l, 6)
+
+		rotated, err := l.Rotated()
+		testhelpers.NoError(t, err)
+		testhelpers.True(t, len(rotated) >= 2)
+
+		// The chain spans across the rotated files.
+		var readers []io.Reader
+		for _, p := range append(rotated, path) {
+			f, err := os.Open(p)
+			testhelpers.NoError(t, err)
+			defer f.Close()
+
+			readers = append(readers, f)
+		}
+
+		_, err = maildoor.VerifyAuditLog(io.MultiReader(readers...))
+		testhelpers.NoError(t, err)
+
+		// Files older than the retention are removed on the next rotation.
+		old := time.Now().Add(-2 * time.Hour)
+		testhelpers.NoError(t, os.Chtimes(rotated[0], old, old))
+		appendN(t, l, 3)
+
+		_, err = os.Stat(rotated[0])
+		testhelpers.True(t, errors.Is(err, os.ErrNotExist))
+	})
+}
@@ -1,16 +1,146 @@
 package maildoor
 
 import (
+	"errors"
+	"math"
 	"math/rand"
+	"net/http"
+	"sync"
+	"time"
 )
 
+const (
+	// defaultResendCooldown is the time an email needs to wait before
+	// another code can be sent to it.
+	defaultResendCooldown = 30 * time.Second
+
+	// attemptsTTL is the time the wrong attempts of a stored code are
+	// remembered after the last one.
+	attemptsTTL = time.Hour
+
+	// cooldownSweep is how often the in-memory cooldowns drop the
+	// ones that ended.
+	cooldownSweep = time.Minute
+)
+
+// AttemptCounter counts the wrong codes entered so codes can be locked
+// out after MaxCodeAttempts. Services with several instances should
+// share it, e.g. with Redis.
+type AttemptCounter interface {
+	// Add records a wrong attempt for the key until expires and
+	// returns the number of attempts recorded for it.
+	Add(key string, expires time.Time) int
+
+	// Reset forgets the attempts of the key.
+	Reset(key string)
+}
+
+// InMemoryAttemptCounter is an AttemptCounter that keeps the attempts
+// in memory until they expire.
+type InMemoryAttemptCounter struct {
+	mu       sync.Mutex
+	attempts map[string]counted
+}
+
+// counted is the number of attempts of a key and when they expire.
+type counted struct {
+	n       int
+	expires time.Time
+}
+
+// NewInMemoryAttemptCounter creates an empty in-memory attempt counter.
+func NewInMemoryAttemptCounter() *InMemoryAttemptCounter {
+	return &InMemoryAttemptCounter{attempts: map[string]counted{}}
+}
+
+// Add implements AttemptCounter.Add
+func (c *InMemoryAttemptCounter) Add(key string, expires time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, a := range c.attempts {
+		if now.After(a.expires) {
+			delete(c.attempts, k)
+		}
+	}
+
+	a := c.attempts[key]
+	a.n++
+	a.expires = expires
+	c.attempts[key] = a
+
+	return a.n
+}
+
+// Reset implements AttemptCounter.Reset
+func (c *InMemoryAttemptCounter) Reset(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.attempts, key)
+}
+
+// CooldownStore remembers until when each email has to wait before
+// another code is sent to it, see ResendCooldown. Services with several
+// instances should share it, e.g. with Redis.
+type CooldownStore interface {
+	// Start records that the key can't get another code until the
+	// passed time.
+	Start(key string, until time.Time)
+
+	// Until returns the time the cooldown of the key ends, the zero
+	// time when it has none.
+	Until(key string) time.Time
+}
+
+// InMemoryCooldownStore is a CooldownStore that keeps the cooldowns in
+// memory, the ones that ended are dropped every minute.
+type InMemoryCooldownStore struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+	swept time.Time
+}
+
+// NewInMemoryCooldownStore creates an empty in-memory cooldown store.
+func NewInMemoryCooldownStore() *InMemoryCooldownStore {
+	return &InMemoryCooldownStore{until: map[string]time.Time{}, swept: time.Now()}
+}
+
+// Start implements CooldownStore.Start
+func (s *InMemoryCooldownStore) Start(key string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.swept) >= cooldownSweep {
+		for k, t := range s.until {
+			if now.After(t) {
+				delete(s.until, k)
+			}
+		}
+
+		s.swept = now
+	}
+
+	s.until[key] = until
+}
+
+// Until implements CooldownStore.Until
+func (s *InMemoryCooldownStore) Until(key string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.until[key]
+}
+
 var (
 	letters = []rune("1234567890")
 )
 
-// newCodeFor generates a new code for the email and stores it using the TokenStorage.
-// tokens are always 6 characters long.
-func (m *maildoor) newCodeFor(email string) string {
+// newCodeFor generates a new code for the email and stores it using the TokenStorage
+// under the tenant of the request. tokens are always 6 characters long.
+func (m *maildoor) newCodeFor(r *http.Request, email string) string {
 	// Generating a new token
 	b := make([]rune, 6)
 	for i := range b {
@@ -18,7 +148,169 @@ func (m *maildoor) newCodeFor(email string) string {
 	}
 
 	token := string(b)
-	m.tokenStorage.Store(email, token)
+	m.tokenStorage.Store(m.storageKey(r, email), token)
 
 	return token
 }
+
+// failedAttempt records a wrong code for the attempts key and returns
+// true when it has reached the maximum number of attempts.
+func (m *maildoor) failedAttempt(key string, expires time.Time) bool {
+	if m.maxAttempts <= 0 {
+		return false
+	}
+
+	if m.attempts.Add(key, expires) < m.maxAttempts {
+		return false
+	}
+
+	m.attempts.Reset(key)
+	return true
+}
+
+// resetAttempts clears the failed attempts for the attempts key.
+func (m *maildoor) resetAttempts(key string) {
+	m.attempts.Reset(key)
+}
+
+// codeAttempts returns the key the wrong attempts for the code of the
+// email are counted by and when they expire. Stateless challenges are
+// counted on their own since earlier ones stay valid, stored codes by
+// the email so requesting another code doesn't reset them.
+func (m *maildoor) codeAttempts(r *http.Request, email string) (string, time.Time) {
+	if m.stateless != nil {
+		c, err := m.stateless.open(m.requestChallenge(r), m.storageKey(r, email))
+		if err == nil {
+			return "attempts:" + m.storageKey(r, c.Nonce), time.Unix(c.Expires, 0)
+		}
+	}
+
+	return m.storedAttempts(r, email)
+}
+
+// storedAttempts returns the attempts key of the code stored for key.
+func (m *maildoor) storedAttempts(r *http.Request, key string) (string, time.Time) {
+	return "attempts:" + m.storageKey(r, key), time.Now().Add(attemptsTTL)
+}
+
+// expiryChecker is implemented by token storages that can tell
+// whether the token for an email expired, as opposed to not
+// existing at all.
+type expiryChecker interface {
+	Expired(email string) bool
+}
+
+// codeExpired returns true when the token storage knows the
+// code for the email expired.
+func (m *maildoor) codeExpired(r *http.Request, email string) bool {
+	ec, ok := m.tokenStorage.(expiryChecker)
+	return ok && ec.Expired(m.storageKey(r, email))
+}
+
+// markSent records that a code was just sent to the email in the
+// tenant of the request, it starts the resend cooldown.
+func (m *maildoor) markSent(r *http.Request, email string) {
+	if m.resendCooldown <= 0 {
+		return
+	}
+
+	m.cooldowns.Start(m.storageKey(r, email), time.Now().Add(m.resendCooldown))
+}
+
+// resendIn returns the number of seconds before another code can be
+// sent to the email in the tenant of the request, 0 when it can be
+// sent right away.
+func (m *maildoor) resendIn(r *http.Request, email string) int {
+	if m.resendCooldown <= 0 {
+		return 0
+	}
+
+	left := time.Until(m.cooldowns.Until(m.storageKey(r, email)))
+	if left <= 0 {
+		return 0
+	}
+
+	return int(math.Ceil(left.Seconds()))
+}
+
+// codeState tells whether the email has a code to enter.
+type codeState int
+
+const (
+	codeMissing codeState = iota
+	codeActive
+	codeStale
+)
+
+// issueCode generates a new code for the email. With stateless codes
+// nothing is stored and the returned challenge carries the code.
+func (m *maildoor) issueCode(r *http.Request, email string) (string, string, error) {
+	if m.stateless != nil {
+		return m.stateless.issue(m.storageKey(r, email))
+	}
+
+	_, span := m.startSpan(r, "maildoor.storage.store", email)
+	code := m.newCodeFor(r, email)
+	span.End()
+
+	return code, "", nil
+}
+
+// currentCode returns the code the email has to enter and its state.
+func (m *maildoor) currentCode(r *http.Request, email string) (string, codeState) {
+	return m.challengeCode(r, email, m.requestChallenge(r))
+}
+
+// challengeCode returns the code of the email and its state, the
+// challenge is only used with stateless codes.
+func (m *maildoor) challengeCode(r *http.Request, email, challenge string) (string, codeState) {
+	if m.stateless != nil {
+		c, err := m.stateless.open(challenge, m.storageKey(r, email))
+		if errors.Is(err, errChallengeExpired) {
+			return "", codeStale
+		}
+
+		if err != nil {
+			return "", codeMissing
+		}
+
+		return m.stateless.code(c), codeActive
+	}
+
+	if m.codeExpired(r, email) {
+		return "", codeStale
+	}
+
+	_, span := m.startSpan(r, "maildoor.storage.get", email)
+	code, exists := m.tokenStorage.Get(m.storageKey(r, email))
+	span.SetAttributes(Attr("maildoor.found", exists))
+	span.End()
+
+	if !exists {
+		return "", codeMissing
+	}
+
+	return code, codeActive
+}
+
+// discardCode invalidates the code of the email, it returns false
+// when there was no code to invalidate, e.g. it was just used.
+func (m *maildoor) discardCode(r *http.Request, email string) bool {
+	return m.discardChallenge(r, email, m.requestChallenge(r))
+}
+
+// discardChallenge invalidates the code of the email, the challenge is
+// only used with stateless codes.
+func (m *maildoor) discardChallenge(r *http.Request, email, challenge string) bool {
+	if m.stateless != nil {
+		c, err := m.stateless.open(challenge, m.storageKey(r, email))
+		return err == nil && m.stateless.use(c)
+	}
+
+	_, span := m.startSpan(r, "maildoor.storage.delete", email)
+	deleted := m.tokenStorage.Delete(m.storageKey(r, email))
+	span.SetAttributes(Attr("maildoor.found", deleted))
+	span.End()
+
+	return deleted
+}
@@ -4,8 +4,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/wawandco/maildoor"
 	"github.com/wawandco/maildoor/internal/testhelpers"
@@ -86,6 +88,7 @@ func TestCodeGeneration(t *testing.T) {
 	t.Run("code overwrite for same email", func(t *testing.T) {
 		var codes []string
 		auth := maildoor.New(
+			maildoor.ResendCooldown(0),
 			maildoor.EmailValidator(func(email string) error {
 				return nil
 			}),
@@ -164,4 +167,67 @@ func TestCodeGeneration(t *testing.T) {
 			}
 		}
 	})
-}
\ No newline at end of file
+}
+func TestCodeAttempts(t *testing.T) {
+	post := func(auth http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	t.Run("requesting another code doesn't reset them", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.MaxCodeAttempts(3),
+			maildoor.ResendCooldown(0),
+			maildoor.MessageSender(func(msg maildoor.Message) error { return nil }),
+		)
+
+		wrong := url.Values{"email": {"a@b.com"}, "code": {"wrong"}}
+		post(auth, "/email", url.Values{"email": {"a@b.com"}})
+		post(auth, "/code", wrong)
+		post(auth, "/code", wrong)
+
+		post(auth, "/email", url.Values{"email": {"a@b.com"}})
+		w := post(auth, "/code", wrong)
+		testhelpers.Contains(t, w.Body.String(), "Too many attempts")
+	})
+
+	t.Run("stateless challenges are counted on their own", func(t *testing.T) {
+		challengePattern := regexp.MustCompile(`name="challenge" value="([^"]+)"`)
+		auth := maildoor.New(
+			maildoor.MaxCodeAttempts(3),
+			maildoor.ResendCooldown(0),
+			maildoor.StatelessCodes([]byte(strings.Repeat("s", 32)), time.Minute),
+			maildoor.MessageSender(func(msg maildoor.Message) error { return nil }),
+		)
+
+		challenge := func() string {
+			w := post(auth, "/email", url.Values{"email": {"a@b.com"}})
+			return challengePattern.FindStringSubmatch(w.Body.String())[1]
+		}
+
+		first := challenge()
+		wrong := url.Values{"email": {"a@b.com"}, "code": {"wrong"}, "challenge": {first}}
+		post(auth, "/code", wrong)
+		post(auth, "/code", wrong)
+
+		// A new challenge doesn't give the first one more attempts.
+		challenge()
+		w := post(auth, "/code", wrong)
+		testhelpers.Contains(t, w.Body.String(), "Too many attempts")
+	})
+
+	t.Run("in-memory counter expires the attempts", func(t *testing.T) {
+		c := maildoor.NewInMemoryAttemptCounter()
+		testhelpers.Equals(t, 1, c.Add("a", time.Now().Add(-time.Second)))
+		testhelpers.Equals(t, 1, c.Add("b", time.Now().Add(time.Minute)))
+		testhelpers.Equals(t, 1, c.Add("a", time.Now().Add(time.Minute)))
+		testhelpers.Equals(t, 2, c.Add("b", time.Now().Add(time.Minute)))
+
+		c.Reset("b")
+		testhelpers.Equals(t, 1, c.Add("b", time.Now().Add(time.Minute)))
+	})
+}
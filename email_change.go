@@ -0,0 +1,121 @@
+package maildoor
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// emailChange holds the hooks of the email change flow.
+type emailChange struct {
+	signedIn func(r *http.Request) string
+	onChange func(w http.ResponseWriter, r *http.Request, oldEmail, newEmail string)
+}
+
+// changeKey is the key of the code sent to one side (old or new) of
+// the change. Normalized emails can't contain control characters, so
+// it never collides with the login codes, which are keyed by email.
+func changeKey(side, oldEmail, newEmail string) string {
+	return "change-email\n" + side + "\n" + oldEmail + "\n" + newEmail
+}
+
+// changeOwner returns the normalized email of the signed in user, or
+// an empty string when there is none.
+func (m *maildoor) changeOwner(r *http.Request) string {
+	email, err := m.normalizeEmail(m.emailChange.signedIn(r))
+	if err != nil {
+		return ""
+	}
+
+	return email
+}
+
+// sendChangeCodes sends a code to the old email to confirm the change
+// and another one to the new email to verify it. It returns the
+// challenges of both codes joined by a dot when using stateless codes.
+func (m *maildoor) sendChangeCodes(r *http.Request, oldEmail, newEmail string) (string, error) {
+	var challenges []string
+	for _, to := range []string{oldEmail, newEmail} {
+		side := "old"
+		if to == newEmail {
+			side = "new"
+		}
+
+		code, challenge, err := m.issueCode(r, changeKey(side, oldEmail, newEmail))
+		if err != nil {
+			return "", err
+		}
+
+		challenges = append(challenges, challenge)
+
+		data := m.emailData(r, to, code, "")
+		data.NewEmail = newEmail
+		data.MagicLink = ""
+
+		_, span := m.startSpan(r, "maildoor.render_email", to)
+		subject, html, txt, err := m.mailBodies(r, data)
+		endSpan(span, err)
+		if err != nil {
+			return "", err
+		}
+
+		err = m.sendCode(r, Message{To: to, Subject: subject, HTML: html, Text: txt})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if m.stateless == nil {
+		return "", nil
+	}
+
+	return strings.Join(challenges, "."), nil
+}
+
+// changeChallenges returns the challenges of the old and new codes in
+// the form, they are only used with stateless codes.
+func changeChallenges(r *http.Request) (string, string) {
+	oldChallenge, newChallenge, _ := strings.Cut(r.FormValue(challengeField), ".")
+	return oldChallenge, newChallenge
+}
+
+// checkChangeCodes compares the entered codes with the ones sent for
+// the change, both need to match. The codes are discarded when they
+// match or the attempts are exceeded.
+func (m *maildoor) checkChangeCodes(r *http.Request, oldEmail, newEmail string) (codeState, bool) {
+	oldKey, newKey := changeKey("old", oldEmail, newEmail), changeKey("new", oldEmail, newEmail)
+	oldChallenge, newChallenge := changeChallenges(r)
+
+	oldCode, oldState := m.challengeCode(r, oldKey, oldChallenge)
+	newCode, newState := m.challengeCode(r, newKey, newChallenge)
+	switch {
+	case oldState == codeStale || newState == codeStale:
+		return codeStale, false
+	case oldState == codeMissing || newState == codeMissing:
+		return codeMissing, false
+	}
+
+	match := subtle.ConstantTimeCompare([]byte(r.FormValue("old_code")), []byte(oldCode)) &
+		subtle.ConstantTimeCompare([]byte(r.FormValue("new_code")), []byte(newCode))
+
+	if match == 1 {
+		key, _ := m.storedAttempts(r, newKey)
+		m.resetAttempts(key)
+
+		// Both codes are discarded even when a concurrent request
+		// used one of them already.
+		oldDeleted := m.discardChallenge(r, oldKey, oldChallenge)
+		newDeleted := m.discardChallenge(r, newKey, newChallenge)
+
+		return codeActive, oldDeleted && newDeleted
+	}
+
+	return codeActive, false
+}
+
+// discardChangeCodes invalidates the codes of the change.
+func (m *maildoor) discardChangeCodes(r *http.Request, oldEmail, newEmail string) {
+	oldChallenge, newChallenge := changeChallenges(r)
+	m.discardChallenge(r, changeKey("old", oldEmail, newEmail), oldChallenge)
+	m.discardChallenge(r, changeKey("new", oldEmail, newEmail), newChallenge)
+}
@@ -0,0 +1,275 @@
+package maildoor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Message is the email that maildoor sends to the user, it carries
+// the subject and both the html and plain text bodies.
+type Message struct {
+	To      string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// EmailData is the data passed to the email templates (subject, html
+// and text). Fields that are not known (e.g. ExpiresIn when the token
+// storage does not expire tokens) are left with their zero value.
+type EmailData struct {
+	Code    string
+	Logo    string
+	Product string
+	Year    string
+
+	// Recipient is the email address the message is sent to.
+	Recipient string
+
+	// NewEmail is set in the codes of an email change, both the
+	// current email and the new one (the Recipient) get a code.
+	NewEmail string
+
+	// Invitation is set in the invitation emails, which don't have a
+	// code and link to accept the invitation instead.
+	Invitation *Invitation
+
+	// ExpiresIn and ExpiresAt describe when the code stops being valid.
+	ExpiresIn time.Duration
+	ExpiresAt time.Time
+
+	// MagicLink points to the code page with the code prefilled.
+	MagicLink string
+
+	// IP and Location identify where the code was requested from.
+	IP       string
+	Location string
+
+	SupportURL string
+
+	// Locale is the language negotiated for the request.
+	Locale string
+
+	translate func(key string, args ...any) string
+}
+
+// T translates the message id to the email locale, args are
+// formatted into the message with fmt.Sprintf.
+func (d EmailData) T(key string, args ...any) string {
+	if d.translate == nil {
+		return key
+	}
+
+	return d.translate(key, args...)
+}
+
+// expirer is implemented by token storages that expire their
+// tokens after a fixed amount of time.
+type expirer interface {
+	TTL() time.Duration
+}
+
+// parseEmailTemplates parses the subject, html and text templates
+// for the emails. Templates set explicitly take precedence over the
+// ones in the emails FS, which take precedence over the embedded ones.
+func (m *maildoor) parseEmailTemplates() error {
+	var err error
+	if m.emailSubject == nil {
+		m.emailSubject, err = parseEmailText(m.emailFS, "subject.txt")
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.emailText == nil {
+		m.emailText, err = parseEmailText(m.emailFS, "message.txt")
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.emailHTML == nil {
+		src, err := readEmailTemplate(m.emailFS, "message.html")
+		if err != nil {
+			return err
+		}
+
+		m.emailHTML, err = template.New("message.html").Parse(src)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseEmailText(fsys fs.FS, name string) (*texttemplate.Template, error) {
+	src, err := readEmailTemplate(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return texttemplate.New(name).Parse(src)
+}
+
+// readEmailTemplate reads the named template from fsys, falling
+// back to the embedded templates when fsys is nil or does not
+// contain the file.
+func readEmailTemplate(fsys fs.FS, name string) (string, error) {
+	if fsys != nil {
+		b, err := fs.ReadFile(fsys, name)
+		if err == nil {
+			return string(b), nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("reading %s: %w", name, err)
+		}
+	}
+
+	b, err := fs.ReadFile(templates, name)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// emailData builds the data passed to the email templates for
+// the passed request, recipient and code. The challenge of
+// stateless codes is added to the magic link.
+func (m *maildoor) emailData(r *http.Request, email, code, challenge string) EmailData {
+	now := time.Now()
+	t := m.tenant(r)
+	data := EmailData{
+		Code:       code,
+		Logo:       t.Logo,
+		Product:    t.ProductName,
+		Year:       now.Format("2006"),
+		Recipient:  email,
+		IP:         clientIP(r),
+		SupportURL: m.supportURL,
+		Locale:     m.requestLocale(r),
+	}
+
+	data.translate = m.catalog.translator(data.Locale, m.defaultLocale)
+
+	if e, ok := m.tokenStorage.(expirer); ok && e.TTL() > 0 {
+		data.ExpiresIn = e.TTL()
+		data.ExpiresAt = now.Add(e.TTL())
+	}
+
+	if m.stateless != nil {
+		data.ExpiresIn = m.stateless.ttl
+		data.ExpiresAt = now.Add(m.stateless.ttl)
+	}
+
+	if m.ipLocator != nil && data.IP != "" {
+		data.Location = m.ipLocator(data.IP)
+	}
+
+	// Emails need absolute URLs for the images, e.g. the default
+	// logo served from the embedded assets, the logo is left out
+	// when BaseURL is not set.
+	if strings.HasPrefix(data.Logo, "/") {
+		data.Logo = m.origin(r) + data.Logo
+		if m.origin(r) == "" {
+			data.Logo = ""
+		}
+	}
+
+	q := url.Values{"email": {email}, "code": {code}}
+	if challenge != "" {
+		q.Set(challengeField, challenge)
+	}
+
+	data.MagicLink = m.link(r, "/code", q)
+
+	return data
+}
+
+// mailBodies renders the subject, html and text of the email
+// with the passed data and the templates of the request tenant.
+func (m *maildoor) mailBodies(r *http.Request, data EmailData) (string, string, string, error) {
+	t := m.tenant(r)
+	return executeMail(t.emailSubject, t.emailHTML, t.emailText, data)
+}
+
+// executeMail renders the subject, html and text templates with
+// the passed data.
+func executeMail(subjectT *texttemplate.Template, htmlT *template.Template, textT *texttemplate.Template, data EmailData) (string, string, string, error) {
+	sw := bytes.NewBuffer([]byte{})
+	err := subjectT.Execute(sw, data)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	subject := sw.String()
+
+	sw = bytes.NewBuffer([]byte{})
+	err = htmlT.Execute(sw, data)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	html := sw.String()
+
+	sw = bytes.NewBuffer([]byte{})
+	err = textT.Execute(sw, data)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	txt := sw.String()
+
+	return subject, html, txt, nil
+}
+
+// link returns the absolute URL for the maildoor path with the query,
+// it is empty when BaseURL is not set so emails go without links.
+func (m *maildoor) link(r *http.Request, p string, q url.Values) string {
+	u := m.absoluteURL(r, p)
+	if u == "" {
+		return ""
+	}
+
+	return u + "?" + q.Encode()
+}
+
+// absoluteURL returns the absolute URL for the passed maildoor path,
+// it is empty when BaseURL is not set.
+func (m *maildoor) absoluteURL(r *http.Request, p string) string {
+	origin := m.origin(r)
+	if origin == "" {
+		return ""
+	}
+
+	return origin + path.Join(m.tenant(r).prefix, p)
+}
+
+// origin returns the configured base URL. The request host is never
+// used since anyone can set it, e.g. to get the links in the emails
+// pointing to their own site.
+func (m *maildoor) origin(r *http.Request) string {
+	return m.baseURL
+}
+
+// clientIP returns the IP address of the client that made the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,184 @@
+package maildoor_test
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestEmailTemplates(t *testing.T) {
+	send := func(auth http.Handler) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{
+			"email": []string{"test@example.com"},
+		}
+
+		auth.ServeHTTP(w, req)
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+	}
+
+	t.Run("default subject", func(t *testing.T) {
+		var msg maildoor.Message
+		auth := maildoor.New(
+			maildoor.ProductName("Acme"),
+			maildoor.MessageSender(func(m maildoor.Message) error {
+				msg = m
+				return nil
+			}),
+		)
+
+		send(auth)
+		testhelpers.Equals(t, "test@example.com", msg.To)
+		testhelpers.Equals(t, "Your Acme login code", msg.Subject)
+		testhelpers.Contains(t, msg.Text, "Code:")
+		testhelpers.Contains(t, msg.HTML, "Acme")
+	})
+
+	t.Run("templates from FS", func(t *testing.T) {
+		var msg maildoor.Message
+		auth := maildoor.New(
+			maildoor.EmailTemplates(fstest.MapFS{
+				"subject.txt": {Data: []byte("Code for {{.Recipient}}")},
+				"message.txt": {Data: []byte("custom {{.Code}} {{.SupportURL}}")},
+			}),
+			maildoor.SupportURL("https://example.com/help"),
+			maildoor.MessageSender(func(m maildoor.Message) error {
+				msg = m
+				return nil
+			}),
+		)
+
+		send(auth)
+		testhelpers.Equals(t, "Code for test@example.com", msg.Subject)
+		testhelpers.Contains(t, msg.Text, "custom ")
+		testhelpers.Contains(t, msg.Text, "https://example.com/help")
+
+		// message.html is not in the FS so the default is used.
+		testhelpers.Contains(t, msg.HTML, "your Login Code")
+	})
+
+	t.Run("explicit templates", func(t *testing.T) {
+		var msg maildoor.Message
+		auth := maildoor.New(
+			maildoor.EmailHTMLTemplate(template.Must(template.New("html").Parse("<p>{{.Code}}</p>"))),
+			maildoor.EmailTextTemplate(texttemplate.Must(texttemplate.New("txt").Parse("ip={{.IP}} loc={{.Location}}"))),
+			maildoor.EmailSubjectTemplate(texttemplate.Must(texttemplate.New("subject").Parse("Hello"))),
+			maildoor.IPLocator(func(ip string) string {
+				return "Bogotá"
+			}),
+			maildoor.MessageSender(func(m maildoor.Message) error {
+				msg = m
+				return nil
+			}),
+		)
+
+		send(auth)
+		testhelpers.Equals(t, "Hello", msg.Subject)
+		testhelpers.Contains(t, msg.HTML, "<p>")
+		testhelpers.Equals(t, "ip=192.0.2.1 loc=Bogotá", msg.Text)
+	})
+
+	t.Run("expiry and magic link", func(t *testing.T) {
+		var msg maildoor.Message
+		auth := maildoor.New(
+			maildoor.Prefix("/auth"),
+			maildoor.BaseURL("https://example.com/"),
+			maildoor.WithTokenStorage(maildoor.NewInMemoryTokenStorage(10*time.Minute)),
+			maildoor.EmailTextTemplate(texttemplate.Must(texttemplate.New("txt").Parse("{{.ExpiresIn}} {{.MagicLink}}"))),
+			maildoor.MessageSender(func(m maildoor.Message) error {
+				msg = m
+				return nil
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/auth/email", nil)
+		req.Form = url.Values{
+			"email": []string{"test@example.com"},
+		}
+
+		auth.ServeHTTP(w, req)
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, msg.Text, "10m0s https://example.com/auth/code?code=")
+		testhelpers.Contains(t, msg.Text, "email=test%40example.com")
+	})
+
+	t.Run("no links from the request host", func(t *testing.T) {
+		var msg maildoor.Message
+		auth := maildoor.New(
+			maildoor.MessageSender(func(m maildoor.Message) error {
+				msg = m
+				return nil
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Host = "evil.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Form = url.Values{
+			"email": []string{"test@example.com"},
+		}
+
+		auth.ServeHTTP(w, req)
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.NotContains(t, msg.HTML, "evil.com")
+		testhelpers.NotContains(t, msg.Text, "evil.com")
+		testhelpers.NotContains(t, msg.HTML, "<img")
+		testhelpers.NotContains(t, msg.Text, "/code?")
+
+		// The email still works with the code alone.
+		testhelpers.True(t, regexp.MustCompile(`Code: \d{6}`).MatchString(msg.Text))
+		testhelpers.NotContains(t, msg.Text, "open this link")
+		testhelpers.NotContains(t, msg.HTML, "href=\"\"")
+	})
+
+	t.Run("features with links require BaseURL", func(t *testing.T) {
+		defer func() {
+			testhelpers.NotNil(t, recover())
+		}()
+
+		maildoor.New(maildoor.CrossDeviceApproval())
+
+		t.Fatal("expected New to panic")
+	})
+
+	t.Run("parse errors panic on New", func(t *testing.T) {
+		defer func() {
+			testhelpers.NotNil(t, recover())
+		}()
+
+		maildoor.New(maildoor.EmailTemplates(fstest.MapFS{
+			"message.html": {Data: []byte("{{.Code")},
+		}))
+
+		t.Fatal("expected New to panic")
+	})
+}
+
+func TestHandleCodeLink(t *testing.T) {
+	auth := maildoor.New()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/code?email=test%40example.com&code=123456", nil)
+
+	auth.ServeHTTP(w, req)
+	testhelpers.Equals(t, http.StatusOK, w.Code)
+	testhelpers.Contains(t, w.Body.String(), `value="123456"`)
+	testhelpers.Contains(t, w.Body.String(), "test@example.com")
+}
+
+// textTemplate parses the passed text template or panics.
+func textTemplate(src string) *texttemplate.Template {
+	return texttemplate.Must(texttemplate.New("").Parse(src))
+}
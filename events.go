@@ -0,0 +1,167 @@
+package maildoor
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// EventType identifies what happened in the authentication flow.
+type EventType string
+
+const (
+	// EventCodeRequested fires when a valid email asks for a code.
+	EventCodeRequested EventType = "code_requested"
+
+	// EventCodeSent fires after the code was sent to the user.
+	EventCodeSent EventType = "code_sent"
+
+	// EventSendFailed fires when the email sender returns an error.
+	EventSendFailed EventType = "send_failed"
+
+	// EventEmailRejected fires when the email validator rejects the email.
+	EventEmailRejected EventType = "email_rejected"
+
+	// EventInvalidCode fires when the entered code does not match.
+	EventInvalidCode EventType = "invalid_code"
+
+	// EventCodeExpired fires when the entered code has expired.
+	EventCodeExpired EventType = "code_expired"
+
+	// EventRateLimited fires when a code is requested for an email
+	// before its resend cooldown elapsed, see ResendCooldown.
+	EventRateLimited EventType = "rate_limited"
+
+	// EventLockout fires when the email exceeds the code attempts and
+	// the code gets invalidated, see MaxCodeAttempts.
+	EventLockout EventType = "lockout"
+
+	// EventLogin fires when the user entered the right code, right
+	// before calling the AfterLogin hook.
+	EventLogin EventType = "login"
+
+	// EventLoginApproved fires when the login waiting in another
+	// device is approved from the emailed link.
+	EventLoginApproved EventType = "login_approved"
+
+	// EventPasskeyRegistered fires when a passkey is registered after
+	// logging in with the email code, see Passkeys.
+	EventPasskeyRegistered EventType = "passkey_registered"
+
+	// EventPasskeyFailed fires when a passkey can't be registered or
+	// a passkey login is rejected.
+	EventPasskeyFailed EventType = "passkey_failed"
+
+	// EventStepUp fires when a signed in user verifies the email
+	// again, see RequireRecentLogin.
+	EventStepUp EventType = "step_up"
+
+	// EventEmailChanged fires when the codes of an email change are
+	// entered, before calling the EmailChange hook. Email is the new
+	// email.
+	EventEmailChanged EventType = "email_changed"
+
+	// EventInviteSent fires when SendInvite emails an invitation.
+	EventInviteSent EventType = "invite_sent"
+
+	// EventInviteAccepted fires when the invited user verifies the
+	// email, before calling the OnInviteAccepted hook.
+	EventInviteAccepted EventType = "invite_accepted"
+
+	// EventTokenRefreshed fires when a refresh token is exchanged for
+	// new tokens, see JWT.
+	EventTokenRefreshed EventType = "token_refreshed"
+
+	// EventRefreshReused fires when a refresh token that was already
+	// exchanged is used again, its family of tokens gets revoked.
+	EventRefreshReused EventType = "refresh_token_reused"
+
+	// EventSignup fires when the signup flow creates a user, right
+	// before EventLogin.
+	EventSignup EventType = "signup"
+
+	// EventLogout fires before calling the Logout hook.
+	EventLogout EventType = "logout"
+)
+
+// Outcome tells whether the event is the result of a successful
+// step of the flow or a failed one.
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+)
+
+// outcomes for each of the event types.
+var outcomes = map[EventType]Outcome{
+	EventCodeRequested:     OutcomeSuccess,
+	EventCodeSent:          OutcomeSuccess,
+	EventSendFailed:        OutcomeFailure,
+	EventEmailRejected:     OutcomeFailure,
+	EventInvalidCode:       OutcomeFailure,
+	EventCodeExpired:       OutcomeFailure,
+	EventRateLimited:       OutcomeFailure,
+	EventLockout:           OutcomeFailure,
+	EventLoginApproved:     OutcomeSuccess,
+	EventPasskeyRegistered: OutcomeSuccess,
+	EventPasskeyFailed:     OutcomeFailure,
+	EventStepUp:            OutcomeSuccess,
+	EventEmailChanged:      OutcomeSuccess,
+	EventInviteSent:        OutcomeSuccess,
+	EventInviteAccepted:    OutcomeSuccess,
+	EventTokenRefreshed:    OutcomeSuccess,
+	EventRefreshReused:     OutcomeFailure,
+	EventSignup:            OutcomeSuccess,
+	EventLogin:             OutcomeSuccess,
+	EventLogout:            OutcomeSuccess,
+}
+
+// Event describes something that happened in the authentication flow.
+type Event struct {
+	Type      EventType
+	Outcome   Outcome
+	Email     string
+	IP        string
+	UserAgent string
+	Time      time.Time
+
+	// Err is the error that caused the event, e.g. the one returned
+	// by the email validator or sender.
+	Err error
+}
+
+// EventHandler receives the events of the authentication flow.
+// Handlers are called synchronously so they should not block.
+type EventHandler interface {
+	HandleEvent(ctx context.Context, e Event)
+}
+
+// EventHandlerFunc allows to use a function as EventHandler.
+type EventHandlerFunc func(ctx context.Context, e Event)
+
+// HandleEvent calls fn(ctx, e).
+func (fn EventHandlerFunc) HandleEvent(ctx context.Context, e Event) {
+	fn(ctx, e)
+}
+
+// emit sends the event to the registered handlers.
+func (m *maildoor) emit(r *http.Request, t EventType, email string, err error) {
+	if len(m.eventHandlers) == 0 {
+		return
+	}
+
+	e := Event{
+		Type:      t,
+		Outcome:   outcomes[t],
+		Email:     email,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Time:      time.Now(),
+		Err:       err,
+	}
+
+	for _, h := range m.eventHandlers {
+		h.HandleEvent(r.Context(), e)
+	}
+}
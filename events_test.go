@@ -0,0 +1,162 @@
+package maildoor_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+// recorder collects the events it receives.
+type recorder struct {
+	events []maildoor.Event
+}
+
+func (r *recorder) HandleEvent(ctx context.Context, e maildoor.Event) {
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) types() []maildoor.EventType {
+	var tt []maildoor.EventType
+	for _, e := range r.events {
+		tt = append(tt, e.Type)
+	}
+
+	return tt
+}
+
+func TestEvents(t *testing.T) {
+	post := func(auth http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("User-Agent", "test-agent")
+		req.Form = form
+
+		auth.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("successful login", func(t *testing.T) {
+		rec := &recorder{}
+		var code string
+		auth := maildoor.New(
+			maildoor.OnEvent(rec),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				code = msg.Text
+				return nil
+			}),
+			maildoor.EmailTextTemplate(textTemplate("{{.Code}}")),
+		)
+
+		post(auth, "/email", url.Values{"email": {"a@b.com"}})
+		post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {code}})
+
+		testhelpers.Equals(t, []maildoor.EventType{
+			maildoor.EventCodeRequested,
+			maildoor.EventCodeSent,
+			maildoor.EventLogin,
+		}, rec.types())
+
+		e := rec.events[2]
+		testhelpers.Equals(t, maildoor.OutcomeSuccess, e.Outcome)
+		testhelpers.Equals(t, "a@b.com", e.Email)
+		testhelpers.Equals(t, "192.0.2.1", e.IP)
+		testhelpers.Equals(t, "test-agent", e.UserAgent)
+		testhelpers.False(t, e.Time.IsZero())
+	})
+
+	t.Run("rejected email and send failure", func(t *testing.T) {
+		rec := &recorder{}
+		auth := maildoor.New(
+			maildoor.OnEvent(rec),
+			maildoor.EmailValidator(func(email string) error {
+				if email == "bad@b.com" {
+					return errors.New("not allowed")
+				}
+
+				return nil
+			}),
+			maildoor.EmailSender(func(to, html, txt string) error {
+				return errors.New("smtp down")
+			}),
+		)
+
+		post(auth, "/email", url.Values{"email": {"bad@b.com"}})
+		post(auth, "/email", url.Values{"email": {"a@b.com"}})
+
+		testhelpers.Equals(t, []maildoor.EventType{
+			maildoor.EventEmailRejected,
+			maildoor.EventCodeRequested,
+			maildoor.EventSendFailed,
+		}, rec.types())
+
+		testhelpers.Equals(t, "not allowed", rec.events[0].Err.Error())
+		testhelpers.Equals(t, maildoor.OutcomeFailure, rec.events[2].Outcome)
+		testhelpers.Equals(t, "smtp down", rec.events[2].Err.Error())
+	})
+
+	t.Run("invalid code and lockout", func(t *testing.T) {
+		rec := &recorder{}
+		storage := maildoor.NewInMemoryTokenStorage(0)
+		storage.Store("a@b.com", "123456")
+
+		auth := maildoor.New(
+			maildoor.OnEvent(rec),
+			maildoor.WithTokenStorage(storage),
+			maildoor.MaxCodeAttempts(2),
+		)
+
+		w := post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {"000000"}})
+		testhelpers.Contains(t, w.Body.String(), "Invalid token")
+
+		w = post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {"000000"}})
+		testhelpers.Contains(t, w.Body.String(), "Too many attempts")
+
+		// The code is no longer valid after the lockout.
+		w = post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {"123456"}})
+		testhelpers.Contains(t, w.Body.String(), "Invalid token")
+
+		testhelpers.Equals(t, []maildoor.EventType{
+			maildoor.EventInvalidCode,
+			maildoor.EventLockout,
+			maildoor.EventInvalidCode,
+		}, rec.types())
+	})
+
+	t.Run("expired code", func(t *testing.T) {
+		rec := &recorder{}
+		storage := maildoor.NewInMemoryTokenStorage(10 * time.Millisecond)
+		storage.Store("a@b.com", "123456")
+		time.Sleep(20 * time.Millisecond)
+
+		auth := maildoor.New(
+			maildoor.OnEvent(rec),
+			maildoor.WithTokenStorage(storage),
+		)
+
+		w := post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {"123456"}})
+		testhelpers.Contains(t, w.Body.String(), "The code has expired")
+		testhelpers.Equals(t, []maildoor.EventType{maildoor.EventCodeExpired}, rec.types())
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		var got maildoor.Event
+		auth := maildoor.New(
+			maildoor.OnEvent(maildoor.EventHandlerFunc(func(ctx context.Context, e maildoor.Event) {
+				got = e
+			})),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("DELETE", "/logout", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, maildoor.EventLogout, got.Type)
+	})
+}
@@ -0,0 +1,127 @@
+package maildoor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleStatus tells the browser waiting for the approval whether its
+// login was approved. It responds with JSON ({"status": "pending"}) or
+// streams the status with server-sent events when the request accepts
+// text/event-stream.
+func (m *maildoor) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": m.approvalStatus(r)})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	last := ""
+	for {
+		status := m.approvalStatus(r)
+		if status != last {
+			fmt.Fprintf(w, "event: status\ndata: {\"status\":%q}\n\n", status)
+			flusher.Flush()
+			last = status
+		}
+
+		if status != "pending" {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleApprovePage is the target of the emailed link, it shows the
+// device waiting for the approval. Nothing is approved until the form
+// is submitted so link scanners can't approve logins.
+func (m *maildoor) handleApprovePage(w http.ResponseWriter, r *http.Request) {
+	approval, ok := m.waitingLogin(r, m.tokenAlias(r, r.FormValue("token")), false)
+	if !ok {
+		approval.Expired = true
+	}
+
+	m.writeApprovalPage(w, r, m.attempt(r), approval)
+}
+
+// handleApprove approves the login of the token, the browser waiting
+// for it completes the login.
+func (m *maildoor) handleApprove(w http.ResponseWriter, r *http.Request) {
+	approval, ok := m.waitingLogin(r, m.tokenAlias(r, r.FormValue("token")), true)
+	if !ok {
+		approval.Expired = true
+		m.writeApprovalPage(w, r, m.attempt(r), approval)
+		return
+	}
+
+	m.emit(r, EventLoginApproved, approval.Email, nil)
+	m.writeApprovalPage(w, r, m.attempt(r), approval)
+}
+
+// handleComplete logs in the browser waiting for the approval once it
+// was approved from the emailed link.
+func (m *maildoor) handleComplete(w http.ResponseWriter, r *http.Request) {
+	p, err := m.approvals.Take(r.Context(), m.approvalID(r))
+	if err != nil {
+		p, _ = m.approvals.Find(r.Context(), m.approvalID(r))
+
+		data := m.attempt(r)
+		data.Email = p.Email
+		data.Error = data.T("error.not_approved")
+		data.AwaitingApproval = m.awaitingApproval(r)
+		m.writeCodePage(w, r, http.StatusConflict, data)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     approvalCookie,
+		Path:     m.tenant(r).prefix,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   m.secureCookies(),
+	})
+
+	// The code can't be used once the login was approved.
+	m.discardCode(r, p.Email)
+	m.completeLogin(w, r, p.Email)
+}
+
+// writeApprovalPage renders the approval page for the approval.
+func (m *maildoor) writeApprovalPage(w http.ResponseWriter, r *http.Request, data Attempt, approval Approval) {
+	data.Approval = &approval
+
+	_, span := m.startSpan(r, "maildoor.render", approval.Email)
+	span.SetAttributes(Attr("maildoor.page", "approve"))
+
+	var buf bytes.Buffer
+	err := m.render(&buf, data, "layout.html", "handle_approve.html")
+	endSpan(span, err)
+
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(buf.Bytes())
+}
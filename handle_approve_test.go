@@ -0,0 +1,150 @@
+package maildoor_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestCrossDeviceApproval(t *testing.T) {
+	const desktop = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36"
+
+	var link string
+	var logins []string
+	auth := maildoor.New(
+		maildoor.BaseURL("http://example.com"),
+		maildoor.CrossDeviceApproval(),
+		maildoor.IPLocator(func(ip string) string { return "Bogotá, Colombia" }),
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			link = regexp.MustCompile(`https?://\S+`).FindString(msg.Text)
+			return nil
+		}),
+		maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+			logins = append(logins, maildoor.EmailFrom(r))
+		}),
+	)
+
+	serve := func(req *http.Request, cookie *http.Cookie) *httptest.ResponseRecorder {
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	status := func(cookie *http.Cookie) string {
+		return serve(httptest.NewRequest("GET", "/status", nil), cookie).Body.String()
+	}
+
+	req := httptest.NewRequest("POST", "/email", nil)
+	req.Header.Set("User-Agent", desktop)
+	req.Form = url.Values{"email": {"a@b.com"}}
+	w := serve(req, nil)
+
+	testhelpers.Contains(t, w.Body.String(), `action="/complete"`)
+	testhelpers.Contains(t, link, "/approve?token=")
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "maildoor_login" {
+			cookie = c
+		}
+	}
+
+	testhelpers.NotNil(t, cookie)
+	testhelpers.Equals(t, `{"status":"pending"}`+"\n", status(cookie))
+
+	// Completing before the approval keeps waiting.
+	w = serve(httptest.NewRequest("POST", "/complete", nil), cookie)
+	testhelpers.Equals(t, http.StatusConflict, w.Code)
+	testhelpers.Equals(t, 0, len(logins))
+
+	// The link shows the device waiting without approving it.
+	u, _ := url.Parse(link)
+	w = serve(httptest.NewRequest("GET", u.RequestURI(), nil), nil)
+	testhelpers.Contains(t, w.Body.String(), "Chrome on macOS")
+	testhelpers.Contains(t, w.Body.String(), "Bogotá, Colombia")
+	testhelpers.Equals(t, `{"status":"pending"}`+"\n", status(cookie))
+
+	approve := httptest.NewRequest("POST", "/approve", nil)
+	approve.Form = url.Values{"token": {u.Query().Get("token")}}
+	w = serve(approve, nil)
+	testhelpers.Contains(t, w.Body.String(), "You can continue on the device that requested the sign in.")
+	testhelpers.Equals(t, `{"status":"approved"}`+"\n", status(cookie))
+
+	// The link can only be used once.
+	w = serve(approve, nil)
+	testhelpers.Contains(t, w.Body.String(), "This link expired or was already used")
+
+	serve(httptest.NewRequest("POST", "/complete", nil), cookie)
+	testhelpers.Equals(t, []string{"a@b.com"}, logins)
+
+	// The login completes once.
+	w = serve(httptest.NewRequest("POST", "/complete", nil), cookie)
+	testhelpers.Equals(t, http.StatusConflict, w.Code)
+	testhelpers.Equals(t, 1, len(logins))
+
+	t.Run("server sent events", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/status", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		w := serve(req, nil)
+
+		testhelpers.Equals(t, "text/event-stream", w.Header().Get("Content-Type"))
+		testhelpers.True(t, strings.HasPrefix(w.Body.String(), "event: status\ndata: {\"status\":\"expired\"}\n\n"))
+	})
+
+	t.Run("shares the waiting logins through the store", func(t *testing.T) {
+		var link string
+		store := maildoor.NewInMemoryApprovalStore()
+		handler := func() http.Handler {
+			return maildoor.New(
+				maildoor.BaseURL("https://example.com"),
+				maildoor.CrossDeviceApproval(),
+				maildoor.Approvals(store),
+				maildoor.MessageSender(func(msg maildoor.Message) error {
+					link = regexp.MustCompile(`https?://\S+`).FindString(msg.Text)
+					return nil
+				}),
+			)
+		}
+
+		first, second := handler(), handler()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {"a@b.com"}}
+		first.ServeHTTP(w, req)
+
+		cookie := w.Result().Cookies()[0]
+		testhelpers.Equals(t, "maildoor_login", cookie.Name)
+		testhelpers.True(t, cookie.Secure)
+
+		u, _ := url.Parse(link)
+		w = httptest.NewRecorder()
+		approve := httptest.NewRequest("POST", "/approve", nil)
+		approve.Form = url.Values{"token": {u.Query().Get("token")}}
+		second.ServeHTTP(w, approve)
+		testhelpers.Contains(t, w.Body.String(), "You can continue on the device that requested the sign in.")
+
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/status", nil)
+		req.AddCookie(cookie)
+		first.ServeHTTP(w, req)
+		testhelpers.Equals(t, `{"status":"approved"}`+"\n", w.Body.String())
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		maildoor.New().ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+		testhelpers.Equals(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,141 @@
+package maildoor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"path"
+)
+
+// handleChangeEmailPage renders the form to enter the new email, users
+// need to be signed in.
+func (m *maildoor) handleChangeEmailPage(w http.ResponseWriter, r *http.Request) {
+	data := m.attempt(r)
+	data.Email = m.changeOwner(r)
+	if data.Email == "" {
+		http.Redirect(w, r, path.Join(m.tenant(r).prefix, "login"), http.StatusSeeOther)
+		return
+	}
+
+	m.writeChangeEmailPage(w, r, http.StatusOK, data)
+}
+
+// handleChangeEmail validates the new email and sends the codes to the
+// current and the new email.
+func (m *maildoor) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	data := m.attempt(r)
+	data.Email = m.changeOwner(r)
+	if data.Email == "" {
+		http.Redirect(w, r, path.Join(m.tenant(r).prefix, "login"), http.StatusSeeOther)
+		return
+	}
+
+	newEmail, err := m.validateEmail(r)
+	switch {
+	case err != nil:
+		data.Error = err.Error()
+	case newEmail == data.Email:
+		data.Error = data.T("error.same_email")
+	case m.userStore != nil:
+		_, err := m.userStore.Find(r.Context(), newEmail)
+		if err == nil {
+			data.Error = data.T("error.email_taken")
+			break
+		}
+
+		if !errors.Is(err, ErrUserNotFound) {
+			m.httpError(w, r, err)
+			return
+		}
+	}
+
+	if data.Error != "" {
+		m.writeChangeEmailPage(w, r, http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	if wait := m.resendIn(r, newEmail); wait > 0 {
+		m.emit(r, EventRateLimited, newEmail, nil)
+		data.Error = data.T("error.resend_cooldown", wait)
+		m.writeChangeEmailPage(w, r, http.StatusTooManyRequests, data)
+		return
+	}
+
+	m.emit(r, EventCodeRequested, newEmail, nil)
+	challenge, err := m.sendChangeCodes(r, data.Email, newEmail)
+	if err != nil {
+		data.Error = err.Error()
+		m.writeChangeEmailPage(w, r, http.StatusInternalServerError, data)
+		return
+	}
+
+	data.NewEmail = newEmail
+	data.Challenge = challenge
+	m.writeChangeEmailPage(w, r, http.StatusOK, data)
+}
+
+// handleChangeEmailVerify checks the codes sent to both emails and
+// calls the email change hook when both are right.
+func (m *maildoor) handleChangeEmailVerify(w http.ResponseWriter, r *http.Request) {
+	data := m.attempt(r)
+	data.Email = m.changeOwner(r)
+	if data.Email == "" {
+		http.Redirect(w, r, path.Join(m.tenant(r).prefix, "login"), http.StatusSeeOther)
+		return
+	}
+
+	data.NewEmail, _ = m.formEmail(r)
+	state, ok := m.checkChangeCodes(r, data.Email, data.NewEmail)
+	switch {
+	case ok:
+		m.emit(r, EventEmailChanged, data.NewEmail, nil)
+		m.markVerified(w, r, data.NewEmail)
+
+		ctx := context.WithValue(r.Context(), "email", data.NewEmail)
+		_, span := m.startSpan(r, "maildoor.email_changed", data.NewEmail)
+		m.emailChange.onChange(w, r.WithContext(ctx), data.Email, data.NewEmail)
+		span.End()
+
+		return
+	case state == codeStale:
+		m.discardChangeCodes(r, data.Email, data.NewEmail)
+		m.emit(r, EventCodeExpired, data.NewEmail, nil)
+		data.Error = data.T("error.expired_code")
+		data.NewEmail = ""
+	case state == codeMissing:
+		m.emit(r, EventInvalidCode, data.NewEmail, nil)
+		data.Error = data.T("error.expired_code")
+		data.NewEmail = ""
+	case m.failedAttempt(m.storedAttempts(r, changeKey("new", data.Email, data.NewEmail))):
+		m.discardChangeCodes(r, data.Email, data.NewEmail)
+		m.emit(r, EventLockout, data.NewEmail, nil)
+		data.Error = data.T("error.locked_out")
+		data.NewEmail = ""
+	default:
+		m.emit(r, EventInvalidCode, data.NewEmail, nil)
+		data.Error = data.T("error.invalid_code")
+	}
+
+	m.writeChangeEmailPage(w, r, http.StatusUnprocessableEntity, data)
+}
+
+// writeChangeEmailPage renders the email change page, with the code
+// inputs once data.NewEmail is set.
+func (m *maildoor) writeChangeEmailPage(w http.ResponseWriter, r *http.Request, status int, data Attempt) {
+	_, span := m.startSpan(r, "maildoor.render", data.Email)
+	span.SetAttributes(Attr("maildoor.page", "change_email"))
+
+	var buf bytes.Buffer
+	err := m.render(&buf, data, "layout.html", "handle_change_email.html")
+	endSpan(span, err)
+
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,261 @@
+package maildoor_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestEmailChange(t *testing.T) {
+	codes := map[string]string{}
+	var texts []string
+	var changes [][2]string
+
+	signedIn := "a@b.com"
+	auth := maildoor.New(
+		maildoor.ResendCooldown(0),
+		maildoor.MaxCodeAttempts(2),
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			codes[msg.To] = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+			texts = append(texts, msg.Text)
+			return nil
+		}),
+		maildoor.EmailChange(
+			func(r *http.Request) string { return signedIn },
+			func(w http.ResponseWriter, r *http.Request, oldEmail, newEmail string) {
+				changes = append(changes, [2]string{oldEmail, newEmail})
+				http.Redirect(w, r, "/account", http.StatusSeeOther)
+			},
+		),
+	)
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	auth.ServeHTTP(w, httptest.NewRequest("GET", "/change-email", nil))
+	testhelpers.Equals(t, http.StatusOK, w.Code)
+	testhelpers.Contains(t, w.Body.String(), "Change your email")
+	testhelpers.Contains(t, w.Body.String(), "a@b.com")
+
+	w = post("/change-email", url.Values{"email": {"c@d.com"}})
+	testhelpers.Equals(t, http.StatusOK, w.Code)
+	testhelpers.Contains(t, w.Body.String(), `name="old_code"`)
+	testhelpers.Contains(t, w.Body.String(), `name="new_code"`)
+
+	testhelpers.Equals(t, 2, len(texts))
+	testhelpers.Contains(t, texts[0], "change the email of your Maildoor account to c@d.com")
+	testhelpers.Contains(t, texts[1], "verify this email")
+	testhelpers.NotContains(t, texts[1], "http")
+	testhelpers.NotEquals(t, codes["a@b.com"], codes["c@d.com"])
+
+	t.Run("requires both codes", func(t *testing.T) {
+		w := post("/change-email/verify", url.Values{
+			"email":    {"c@d.com"},
+			"old_code": {codes["c@d.com"]},
+			"new_code": {codes["c@d.com"]},
+		})
+
+		testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "Invalid token")
+		testhelpers.Equals(t, 0, len(changes))
+	})
+
+	w = post("/change-email/verify", url.Values{
+		"email":    {"c@d.com"},
+		"old_code": {codes["a@b.com"]},
+		"new_code": {codes["c@d.com"]},
+	})
+
+	testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+	testhelpers.Equals(t, [][2]string{{"a@b.com", "c@d.com"}}, changes)
+
+	t.Run("codes can only be used once", func(t *testing.T) {
+		w := post("/change-email/verify", url.Values{
+			"email":    {"c@d.com"},
+			"old_code": {codes["a@b.com"]},
+			"new_code": {codes["c@d.com"]},
+		})
+
+		testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+		testhelpers.Equals(t, 1, len(changes))
+	})
+
+	t.Run("locks out after too many attempts", func(t *testing.T) {
+		post("/change-email", url.Values{"email": {"e@f.com"}})
+
+		form := url.Values{"email": {"e@f.com"}, "old_code": {"000000"}, "new_code": {"000000"}}
+		post("/change-email/verify", form)
+		w := post("/change-email/verify", form)
+		testhelpers.Contains(t, w.Body.String(), "Too many attempts")
+
+		form = url.Values{"email": {"e@f.com"}, "old_code": {codes["a@b.com"]}, "new_code": {codes["e@f.com"]}}
+		post("/change-email/verify", form)
+		testhelpers.Equals(t, 1, len(changes))
+	})
+
+	t.Run("rejects the current email", func(t *testing.T) {
+		w := post("/change-email", url.Values{"email": {"a@b.com"}})
+		testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "The new email is the current one")
+	})
+
+	t.Run("requires a signed in user", func(t *testing.T) {
+		signedIn = ""
+		defer func() { signedIn = "a@b.com" }()
+
+		w := post("/change-email", url.Values{"email": {"g@h.com"}})
+		testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+		testhelpers.Equals(t, "/login", w.Header().Get("Location"))
+	})
+
+	t.Run("login codes keep working", func(t *testing.T) {
+		post("/change-email", url.Values{"email": {"g@h.com"}})
+		post("/email", url.Values{"email": {"a@b.com"}})
+
+		w := post("/code", url.Values{"email": {"a@b.com"}, "code": {codes["a@b.com"]}})
+		testhelpers.NotContains(t, w.Body.String(), "Invalid token")
+	})
+}
+
+// usedStorage reports the old code of email changes as already used
+// when it is deleted, like a concurrent request would.
+type usedStorage struct {
+	*maildoor.InMemoryTokenStorage
+	deleted []string
+}
+
+func (s *usedStorage) Delete(key string) bool {
+	deleted := s.InMemoryTokenStorage.Delete(key)
+	s.deleted = append(s.deleted, key)
+
+	return deleted && !strings.Contains(key, "change-email\nold\n")
+}
+
+func TestEmailChangeDiscardsBothCodes(t *testing.T) {
+	codes := map[string]string{}
+	var changes int
+
+	storage := &usedStorage{InMemoryTokenStorage: maildoor.NewInMemoryTokenStorage(time.Minute)}
+	auth := maildoor.New(
+		maildoor.WithTokenStorage(storage),
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			codes[msg.To] = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+			return nil
+		}),
+		maildoor.EmailChange(
+			func(r *http.Request) string { return "a@b.com" },
+			func(w http.ResponseWriter, r *http.Request, oldEmail, newEmail string) {
+				changes++
+			},
+		),
+	)
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	post("/change-email", url.Values{"email": {"c@d.com"}})
+	w := post("/change-email/verify", url.Values{
+		"email":    {"c@d.com"},
+		"old_code": {codes["a@b.com"]},
+		"new_code": {codes["c@d.com"]},
+	})
+
+	testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+	testhelpers.Equals(t, 0, changes)
+	testhelpers.Equals(t, 2, len(storage.deleted))
+
+	for _, key := range storage.deleted {
+		_, found := storage.Get(key)
+		testhelpers.False(t, found)
+	}
+}
+
+func TestEmailChangeStatelessCodes(t *testing.T) {
+	codes := map[string]string{}
+	var changes int
+
+	auth := maildoor.New(
+		maildoor.StatelessCodes([]byte(strings.Repeat("s", 32)), time.Minute),
+		maildoor.WithTokenStorage(failingStorage{t}),
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			codes[msg.To] = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+			return nil
+		}),
+		maildoor.EmailChange(
+			func(r *http.Request) string { return "a@b.com" },
+			func(w http.ResponseWriter, r *http.Request, oldEmail, newEmail string) {
+				changes++
+			},
+		),
+	)
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := post("/change-email", url.Values{"email": {"c@d.com"}})
+	challenge := regexp.MustCompile(`name="challenge" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	testhelpers.NotNil(t, challenge)
+
+	form := url.Values{
+		"email":     {"c@d.com"},
+		"old_code":  {codes["a@b.com"]},
+		"new_code":  {codes["c@d.com"]},
+		"challenge": {challenge[1]},
+	}
+
+	post("/change-email/verify", form)
+	testhelpers.Equals(t, 1, changes)
+
+	// The challenges can't be replayed.
+	w = post("/change-email/verify", form)
+	testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+	testhelpers.Equals(t, 1, changes)
+}
+
+func TestEmailChangeKeys(t *testing.T) {
+	var sent []string
+	auth := maildoor.New(
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			sent = append(sent, msg.To)
+			return nil
+		}),
+	)
+
+	// Emails can't take the key of a pending change code.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/email", nil)
+	req.Form = url.Values{"email": {"change-email\nnew\na@b.com\nc@d.com"}}
+	auth.ServeHTTP(w, req)
+
+	testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+	testhelpers.Equals(t, 0, len(sent))
+}
@@ -2,46 +2,183 @@ package maildoor
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"net/http"
 )
 
 // handleCode validates the input handleCode with the passed email.
 func (m *maildoor) handleCode(w http.ResponseWriter, r *http.Request) {
-	email := r.FormValue("email")
+	email, _ := m.formEmail(r)
 	code := r.FormValue("code")
 
 	// Find a combination of token and email in the server
 	// call the afterlogin hook with the email
 	// remove the token from the server
-	storedCode, exists := m.tokenStorage.Get(email)
-	if exists && code == storedCode {
-		m.tokenStorage.Delete(email)
+	storedCode, state := m.currentCode(r, email)
+	if state == codeStale {
+		m.discardCode(r, email)
+		m.emit(r, EventCodeExpired, email, nil)
+		m.renderCodeError(w, r, email, "error.expired_code")
+		return
+	}
+
+	exists := state == codeActive
+	if exists && subtle.ConstantTimeCompare([]byte(code), []byte(storedCode)) == 1 && m.discardCode(r, email) {
+		m.completeLogin(w, r, email)
+		return
+	}
+
+	// Too many wrong codes invalidate the code so the user
+	// needs to request a new one.
+	if exists && m.failedAttempt(m.codeAttempts(r, email)) {
+		m.discardCode(r, email)
+		m.emit(r, EventLockout, email, nil)
+		m.renderCodeError(w, r, email, "error.locked_out")
+		return
+	}
+
+	m.emit(r, EventInvalidCode, email, nil)
+	m.renderCodeError(w, r, email, "error.invalid_code")
+}
+
+// completeLogin logs the verified email in, with the signup flow the
+// user is found or created first. It calls the AfterLogin hook with
+// the email in the context, or offers a passkey before when enabled.
+// Step-up verifications return to their request and invitations call
+// the OnInviteAccepted hook instead, after issuing the tokens.
+func (m *maildoor) completeLogin(w http.ResponseWriter, r *http.Request, email string) {
+	key, _ := m.codeAttempts(r, email)
+	m.resetAttempts(key)
+	if ret := m.stepUpReturn(r, email); ret != "" {
+		m.completeStepUp(w, r, email, ret)
+		return
+	}
+
+	ctx := r.Context()
+	inv, invited := m.formInvite(r)
+	invited = invited && inv.Email == email
+	if invited {
+		if !m.acceptInvite(w, r, inv) {
+			return
+		}
+
+		ctx = context.WithValue(ctx, invitationKey, inv)
+	}
+
+	// Invited users get their account from OnInviteAccepted.
+	if !invited && m.offerPasskey(w, r, email) {
+		return
+	}
+
+	if m.userStore != nil && !invited {
+		user, created, err := m.verifiedUser(w, r, email)
+		if errors.Is(err, ErrUserNotFound) {
+			data := m.attempt(r)
+			data.Email = email
+			data.Error = data.T("error.no_account")
+			data.Fields, _, _ = m.formFields(r, data)
+			m.writeSignupPage(w, r, http.StatusOK, data)
+			return
+		}
+
+		if err != nil {
+			m.httpError(w, r, err)
+			return
+		}
+
+		ctx = context.WithValue(ctx, userKey, user)
+		ctx = context.WithValue(ctx, newSignupKey, created)
+	}
+
+	if !invited {
+		m.emit(r, EventLogin, email, nil)
+	}
+
+	m.markVerified(w, r, email)
+
+	// Invitations continue in OnInviteAccepted, a client waiting for
+	// the login is not sent a code for them.
+	if invited {
+		m.takePendingAuthorization(w, r)
+	} else if m.redirectAuthorization(w, r, email) {
+		return
+	}
+
+	if m.tokens != nil {
+		pair, err := m.issueTokens(r, email, "", "")
+		if err != nil {
+			m.httpError(w, r, err)
+			return
+		}
+
+		if acceptsJSON(r) {
+			writeTokens(w, pair)
+			return
+		}
+
+		ctx = context.WithValue(ctx, tokensKey, pair)
+	}
 
-		// Adding email to the context
-		r = r.WithContext(context.WithValue(r.Context(), "email", email))
-		m.afterLogin(w, r)
+	// Adding email to the context
+	r = r.WithContext(context.WithValue(ctx, "email", email))
+	if invited && m.onInviteAccepted != nil {
+		_, span := m.startSpan(r, "maildoor.invite_accepted", email)
+		m.onInviteAccepted(w, r, inv)
+		span.End()
 		return
 	}
 
-	// Render the error page in case it does not match.
-	data := Attempt{
-		Email:       email,
-		Error:       "Invalid token",
-		Logo:        m.logoURL,
-		Icon:        m.iconURL,
-		ProductName: m.productName,
+	_, span := m.startSpan(r, "maildoor.after_login", email)
+	m.afterLogin(w, r)
+	span.End()
+}
+
+// renderCodeError renders the code page for the email with the
+// translated error message.
+func (m *maildoor) renderCodeError(w http.ResponseWriter, r *http.Request, email, key string) {
+	data := m.attempt(r)
+	data.Email = email
+	data.Error = data.T(key)
+	data.ResendIn = m.resendIn(r, email)
+	data.AwaitingApproval = m.awaitingApproval(r)
+	if m.stateless != nil {
+		data.Challenge = m.requestChallenge(r)
 	}
 
-	html, err := m.codeRenderer(data)
+	html, err := m.renderCode(r, data)
 	if err != nil {
-		m.httpError(w, err)
+		m.httpError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/html")
 	_, err = w.Write([]byte(html))
 	if err != nil {
-		m.httpError(w, err)
+		m.httpError(w, r, err)
 		return
 	}
 }
+
+// handleCodeLink renders the code page with the email and code
+// prefilled from the query, it is the target of the magic link
+// sent in the email. The user still needs to submit the form so
+// link scanners don't consume the code.
+func (m *maildoor) handleCodeLink(w http.ResponseWriter, r *http.Request) {
+	data := m.attempt(r)
+	data.Email, _ = m.formEmail(r)
+	data.Code = r.FormValue("code")
+	data.ResendIn = m.resendIn(r, data.Email)
+	if m.stateless != nil {
+		data.Challenge = m.requestChallenge(r)
+	}
+
+	html, err := m.renderCode(r, data)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(html))
+}
@@ -2,60 +2,93 @@ package maildoor
 
 import (
 	"net/http"
+	"net/url"
+	"time"
 )
 
 // handleEmail endpoint validates the handleEmail and sends a token to the
 // user by calling the handleEmail sender function.
 func (m *maildoor) handleEmail(w http.ResponseWriter, r *http.Request) {
-	data := Attempt{
-		Logo:        m.logoURL,
-		ProductName: m.productName,
-		Icon:        m.iconURL,
-	}
+	data := m.attempt(r)
 
-	email := r.FormValue("email")
-	if err := m.emailValidator(email); err != nil {
+	email, err := m.validateEmail(r)
+	if err != nil {
 		data.Error = err.Error()
 		w.WriteHeader(http.StatusUnprocessableEntity)
 
-		html, err := m.loginRenderer(data)
+		html, err := m.renderLogin(r, data)
 		if err != nil {
-			m.httpError(w, err)
+			m.httpError(w, r, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "text/html")
 		_, err = w.Write([]byte(html))
 		if err != nil {
-			m.httpError(w, err)
+			m.httpError(w, r, err)
 			return
 		}
 
 		return
 	}
 
-	token := m.newCodeFor(email)
-	html, txt, err := m.mailBodies(token)
+	// Submitting the login form again doesn't skip the resend cooldown,
+	// the code that was sent keeps working.
+	if wait := m.resendIn(r, email); wait > 0 {
+		m.emit(r, EventRateLimited, email, nil)
+		data.Email = email
+		data.ResendIn = wait
+		data.Error = data.T("error.resend_cooldown", wait)
+		data.AwaitingApproval = m.awaitingApproval(r)
+		if m.stateless != nil {
+			data.Challenge = m.requestChallenge(r)
+		}
+
+		m.writeCodePage(w, r, http.StatusTooManyRequests, data)
+		return
+	}
+
+	// Codes requested with the login form don't complete a signup
+	// started in the browser.
+	if m.userStore != nil {
+		m.takePendingSignup(w, r, email)
+	}
+
+	token, challenge, err := m.issueCode(r, email)
 	if err != nil {
-		m.httpError(w, err)
+		m.httpError(w, r, err)
 		return
 	}
 
-	err = m.emailSender(email, html, txt)
+	m.emit(r, EventCodeRequested, email, nil)
+
+	approval, err := m.startApproval(w, r, email)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	msg, err := m.codeMessage(r, email, token, challenge, approval)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	err = m.sendCode(r, msg)
 	if err != nil {
 		data.Error = err.Error()
 		w.WriteHeader(http.StatusInternalServerError)
 
-		html, err := m.loginRenderer(data)
+		html, err := m.renderLogin(r, data)
 		if err != nil {
-			m.httpError(w, err)
+			m.httpError(w, r, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "text/html")
 		_, err = w.Write([]byte(html))
 		if err != nil {
-			m.httpError(w, err)
+			m.httpError(w, r, err)
 			return
 		}
 
@@ -63,17 +96,86 @@ func (m *maildoor) handleEmail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data.Email = email
+	data.ResendIn = m.resendIn(r, email)
+	data.AwaitingApproval = approval != ""
+	m.setChallenge(w, r, &data, challenge)
 
-	htmlContent, err := m.codeRenderer(data)
+	htmlContent, err := m.renderCode(r, data)
 	if err != nil {
-		m.httpError(w, err)
+		m.httpError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/html")
 	_, err = w.Write([]byte(htmlContent))
 	if err != nil {
-		m.httpError(w, err)
+		m.httpError(w, r, err)
 		return
 	}
 }
+
+// validateEmail normalizes the email in the form and runs the email
+// validator with it, rejected emails emit EventEmailRejected.
+func (m *maildoor) validateEmail(r *http.Request) (string, error) {
+	email, err := m.formEmail(r)
+	if err != nil {
+		m.emit(r, EventEmailRejected, email, err)
+		return email, err
+	}
+
+	// Invited emails were chosen by the inviter.
+	if m.invited(r, email) {
+		return email, nil
+	}
+
+	_, span := m.startSpan(r, "maildoor.validate_email", email)
+	err = m.tenant(r).EmailValidator(email)
+	endSpan(span, err)
+
+	if err != nil {
+		m.emit(r, EventEmailRejected, email, err)
+	}
+
+	return email, err
+}
+
+// codeMessage renders the email with the code for the email. With an
+// approval token the magic link approves the waiting login instead.
+func (m *maildoor) codeMessage(r *http.Request, email, code, challenge, approval string) (Message, error) {
+	data := m.emailData(r, email, code, challenge)
+	if approval != "" {
+		data.MagicLink = m.link(r, "/approve", url.Values{"token": {approval}})
+	}
+
+	_, span := m.startSpan(r, "maildoor.render_email", email)
+	subject, html, txt, err := m.mailBodies(r, data)
+	endSpan(span, err)
+
+	return Message{
+		To:      email,
+		Subject: subject,
+		HTML:    html,
+		Text:    txt,
+	}, err
+}
+
+// sendCode sends the message with the message sender and starts the
+// resend cooldown for the recipient when it succeeds.
+func (m *maildoor) sendCode(r *http.Request, msg Message) error {
+	_, span := m.startSpan(r, "maildoor.send_email", msg.To)
+	sent := time.Now()
+	err := m.tenant(r).MessageSender(msg)
+
+	m.observe("maildoor_email_send_duration_seconds", nil, time.Since(sent).Seconds())
+	endSpan(span, err)
+
+	if err != nil {
+		m.emit(r, EventSendFailed, msg.To, err)
+		return err
+	}
+
+	m.markSent(r, msg.To)
+	m.emit(r, EventCodeSent, msg.To, nil)
+
+	return nil
+}
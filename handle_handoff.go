@@ -0,0 +1,78 @@
+package maildoor
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wawandco/maildoor/internal/qr"
+)
+
+// handleQR renders the QR code of the login waiting in the browser, as
+// SVG or PNG depending on the extension of the path. The code encodes
+// a short lived link to approve the login from a signed in device.
+func (m *maildoor) handleQR(w http.ResponseWriter, r *http.Request) {
+	id, ok := m.handoffID(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := m.handoff.token(id, time.Now().Add(handoffTTL))
+	code, err := qr.Encode(m.absoluteURL(r, "/handoff") + "?" + url.Values{"token": {token}}.Encode())
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.HasSuffix(r.URL.Path, ".png") {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(code.PNG(6))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write(code.SVG(6))
+}
+
+// handleHandoffPage is the target of the QR code, it shows the login
+// waiting for the approval to the device that scanned it.
+func (m *maildoor) handleHandoffPage(w http.ResponseWriter, r *http.Request) {
+	approval, err := m.handoffLogin(r, false)
+	m.writeHandoffPage(w, r, approval, err)
+}
+
+// handleHandoff approves the login of the QR code, the browser waiting
+// for it completes the login.
+func (m *maildoor) handleHandoff(w http.ResponseWriter, r *http.Request) {
+	approval, err := m.handoffLogin(r, true)
+	if err == nil {
+		m.emit(r, EventLoginApproved, approval.Email, nil)
+	}
+
+	m.writeHandoffPage(w, r, approval, err)
+}
+
+// writeHandoffPage renders the approval page for the login of the QR
+// code, or the reason it can't be approved.
+func (m *maildoor) writeHandoffPage(w http.ResponseWriter, r *http.Request, approval Approval, err error) {
+	data := m.attempt(r)
+	approval.Token = r.FormValue("token")
+	approval.Handoff = true
+
+	switch {
+	case errors.Is(err, errSignedOut):
+		approval.Expired = true
+		data.Error = data.T("approve.signed_out", data.ProductName)
+	case err != nil:
+		approval.Expired = true
+		data.Error = data.T("approve.handoff_expired")
+	case !approval.Approved:
+		approval.CSRF = m.handoff.csrf(approval.Token, approval.Email)
+	}
+
+	m.writeApprovalPage(w, r, data, approval)
+}
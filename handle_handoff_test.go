@@ -0,0 +1,194 @@
+package maildoor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQRHandoff(t *testing.T) {
+	secret := []byte(strings.Repeat("s", 32))
+
+	var logins int
+	m := New(
+		BaseURL("http://example.com"),
+		CrossDeviceApproval(),
+		QRHandoff(secret, func(r *http.Request) string {
+			return r.Header.Get("X-Session")
+		}),
+		MessageSender(func(msg Message) error { return nil }),
+		AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+			logins++
+		}),
+	).(*maildoor)
+
+	serve := func(req *http.Request, cookie *http.Cookie, session string) *httptest.ResponseRecorder {
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		if session != "" {
+			req.Header.Set("X-Session", session)
+		}
+
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+
+		return w
+	}
+
+	req := httptest.NewRequest("POST", "/email", nil)
+	req.Form = url.Values{"email": {"a@b.com"}}
+	w := serve(req, nil, "")
+	if !strings.Contains(w.Body.String(), `src="/qr.svg"`) {
+		t.Fatalf("Expected the QR code in the code page, got %s", w.Body.String())
+	}
+
+	cookie := w.Result().Cookies()[0]
+
+	w = serve(httptest.NewRequest("GET", "/qr.svg", nil), cookie, "")
+	if w.Header().Get("Content-Type") != "image/svg+xml" || !strings.HasPrefix(w.Body.String(), "<svg") {
+		t.Fatalf("Expected an SVG image, got %s", w.Body.String())
+	}
+
+	w = serve(httptest.NewRequest("GET", "/qr.png", nil), cookie, "")
+	if w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected a PNG image, got %s", w.Header().Get("Content-Type"))
+	}
+
+	w = serve(httptest.NewRequest("GET", "/qr.svg", nil), nil, "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without a waiting login, got %d", w.Code)
+	}
+
+	pending, err := m.approvals.Find(context.Background(), cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := pending.HandoffID
+	token := m.handoff.token(id, time.Now().Add(handoffTTL))
+	link := "/handoff?token=" + token
+
+	t.Run("requires a signed in device", func(t *testing.T) {
+		w := serve(httptest.NewRequest("GET", link, nil), nil, "")
+		if !strings.Contains(w.Body.String(), "Sign in to Maildoor on this device") {
+			t.Fatalf("Expected the signed out message, got %s", w.Body.String())
+		}
+
+		w = serve(httptest.NewRequest("POST", link, nil), nil, "c@d.com")
+		if !strings.Contains(w.Body.String(), "This QR code expired or was already used") {
+			t.Fatalf("Expected the expired message, got %s", w.Body.String())
+		}
+
+		if p, err := m.approvals.Find(context.Background(), cookie.Value); err != nil || p.Approved {
+			t.Fatal("Expected the login to be pending")
+		}
+	})
+
+	t.Run("rejects expired and tampered tokens", func(t *testing.T) {
+		tampered := "A" + token[1:]
+		if tampered == token {
+			tampered = "B" + token[1:]
+		}
+
+		for _, token := range []string{
+			m.handoff.token(id, time.Now().Add(-time.Second)),
+			tampered,
+			pending.Token,
+		} {
+			w := serve(httptest.NewRequest("POST", "/handoff?token="+token, nil), nil, "a@b.com")
+			if !strings.Contains(w.Body.String(), "This QR code expired or was already used") {
+				t.Fatalf("Expected the expired message, got %s", w.Body.String())
+			}
+		}
+	})
+
+	w = serve(httptest.NewRequest("GET", link, nil), nil, "a@b.com")
+	if !strings.Contains(w.Body.String(), `action="/handoff"`) {
+		t.Fatalf("Expected the approval form, got %s", w.Body.String())
+	}
+
+	csrf := m.handoff.csrf(token, "a@b.com")
+	if !strings.Contains(w.Body.String(), `name="csrf" value="`+csrf+`"`) {
+		t.Fatalf("Expected the CSRF token in the approval form, got %s", w.Body.String())
+	}
+
+	t.Run("requires the CSRF token of the page", func(t *testing.T) {
+		for _, value := range []string{"", "A" + csrf[1:], m.handoff.csrf(token, "c@d.com")} {
+			req := httptest.NewRequest("POST", link, nil)
+			req.Form = url.Values{"token": {token}, "csrf": {value}}
+
+			w := serve(req, nil, "a@b.com")
+			if !strings.Contains(w.Body.String(), "This QR code expired or was already used") {
+				t.Fatalf("Expected the expired message, got %s", w.Body.String())
+			}
+		}
+
+		if p, err := m.approvals.Find(context.Background(), cookie.Value); err != nil || p.Approved {
+			t.Fatal("Expected the login to be pending")
+		}
+	})
+
+	approve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", link, nil)
+		req.Form = url.Values{"token": {token}, "csrf": {csrf}}
+
+		return serve(req, nil, "a@b.com")
+	}
+
+	w = approve()
+	if !strings.Contains(w.Body.String(), "Sign in approved") {
+		t.Fatalf("Expected the login to be approved, got %s", w.Body.String())
+	}
+
+	// The token can only be used once.
+	w = approve()
+	if !strings.Contains(w.Body.String(), "This QR code expired or was already used") {
+		t.Fatalf("Expected the expired message, got %s", w.Body.String())
+	}
+
+	serve(httptest.NewRequest("POST", "/complete", nil), cookie, "")
+	if logins != 1 {
+		t.Fatalf("Expected 1 login, got %d", logins)
+	}
+}
+
+func TestQRHandoffRequiresApproval(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected New to panic")
+		}
+	}()
+
+	New(QRHandoff([]byte(strings.Repeat("s", 32)), func(r *http.Request) string { return "" }))
+}
+
+func TestQRHandoffSecret(t *testing.T) {
+	secret := []byte(strings.Repeat("s", 32))
+	signedIn := func(r *http.Request) string { return "" }
+
+	a, err := newHandoff(secret, signedIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := newHandoff(secret, signedIn)
+	id := strings.Repeat("ab", 32)
+	if got, err := b.verify(a.token(id, time.Now().Add(time.Minute))); err != nil || got != id {
+		t.Fatalf("Expected the token to verify with the same secret, got %q, %v", got, err)
+	}
+
+	other, _ := newHandoff([]byte(strings.Repeat("o", 32)), signedIn)
+	if _, err := other.verify(a.token(id, time.Now().Add(time.Minute))); err == nil {
+		t.Fatal("Expected the token to fail with another secret")
+	}
+
+	if _, err := newHandoff([]byte("short"), signedIn); err == nil {
+		t.Fatal("Expected an error with a short secret")
+	}
+}
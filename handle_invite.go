@@ -0,0 +1,40 @@
+package maildoor
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// handleInvite renders the invitation page, the link of the invitation
+// email. Accepting it sends the code to the invited email so link
+// scanners can't accept invitations.
+func (m *maildoor) handleInvite(w http.ResponseWriter, r *http.Request) {
+	data := m.attempt(r)
+
+	status := http.StatusOK
+	inv, err := m.invites.open(r.FormValue("token"), m.tenant(r).ID)
+	if err != nil {
+		status = http.StatusGone
+		data.Error = data.T("error.invalid_invite")
+	} else {
+		data.Email = inv.Email
+		data.Invite = r.FormValue("token")
+		data.Invitation = &inv
+	}
+
+	_, span := m.startSpan(r, "maildoor.render", data.Email)
+	span.SetAttributes(Attr("maildoor.page", "invite"))
+
+	var buf bytes.Buffer
+	err = m.render(&buf, data, "layout.html", "handle_invite.html")
+	endSpan(span, err)
+
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -7,15 +7,11 @@ import (
 // handleLogin enpoint renders the handleLogin page to enter the user
 // identifier.
 func (m *maildoor) handleLogin(w http.ResponseWriter, r *http.Request) {
-	data := Attempt{
-		Logo:        m.logoURL,
-		Icon:        m.iconURL,
-		ProductName: m.productName,
-	}
+	data := m.attempt(r)
 
-	html, err := m.loginRenderer(data)
+	html, err := m.renderLogin(r, data)
 	if err != nil {
-		m.httpError(w, err)
+		m.httpError(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html")
@@ -7,5 +7,6 @@ import (
 // handleLogin enpoint renders the handleLogin page to enter the user
 // identifier.
 func (m *maildoor) handleLogout(w http.ResponseWriter, r *http.Request) {
+	m.emit(r, EventLogout, "", nil)
 	m.logout(w, r)
 }
@@ -0,0 +1,160 @@
+package maildoor
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// handleDiscovery serves the OpenID Connect discovery document.
+func (m *maildoor) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	issuer := m.issuer(r)
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, map[string]any{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{m.tokens.keys[0].Algorithm},
+		"scopes_supported":                      []string{"openid", "email"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+// handleAuthorize starts the authorization code flow, the browser
+// goes through the login pages and comes back to the client with the
+// code. PKCE with S256 is required for all the clients.
+func (m *maildoor) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	// Errors about the client or the redirect URI can't be sent back
+	// to the client.
+	client, err := m.findClient(r, q.Get("client_id"))
+	if err != nil || !client.validRedirect(q.Get("redirect_uri")) {
+		http.Error(w, "invalid client or redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	a := Authorization{
+		ClientID:      client.ID,
+		RedirectURI:   q.Get("redirect_uri"),
+		State:         q.Get("state"),
+		Nonce:         q.Get("nonce"),
+		CodeChallenge: q.Get("code_challenge"),
+		Tenant:        m.tenant(r).ID,
+		ExpiresAt:     time.Now().Add(authorizeTTL),
+	}
+
+	var code string
+	switch {
+	case q.Get("response_type") != "code":
+		code = "unsupported_response_type"
+	case !slices.Contains(strings.Fields(q.Get("scope")), "openid"):
+		code = "invalid_scope"
+	case a.CodeChallenge == "" || q.Get("code_challenge_method") != "S256":
+		code = "invalid_request"
+	}
+
+	if code != "" {
+		http.Redirect(w, r, authorizationRedirect(a.RedirectURI, "error", code, a.State), http.StatusSeeOther)
+		return
+	}
+
+	id, err := m.putAuthorization(r, "pending", a)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    id,
+		Path:     m.tenant(r).prefix,
+		MaxAge:   int(authorizeTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   m.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, path.Join(m.tenant(r).prefix, "login"), http.StatusSeeOther)
+}
+
+// handleToken exchanges authorization codes and refresh tokens for
+// tokens, errors follow the OAuth 2.0 token error response.
+func (m *maildoor) handleToken(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(status int, code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		writeJSON(w, map[string]string{"error": code})
+	}
+
+	client, ok := m.authenticateClient(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="maildoor"`)
+		tokenError(http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		a, ok := m.takeAuthorization(r, "code", r.FormValue("code"))
+		if !ok || a.ClientID != client.ID || a.RedirectURI != r.FormValue("redirect_uri") || !verifyPKCE(r.FormValue("code_verifier"), a.CodeChallenge) {
+			tokenError(http.StatusBadRequest, "invalid_grant")
+			return
+		}
+
+		pair, err := m.issueTokens(r, a.Email, "", client.ID)
+		if err != nil {
+			m.httpError(w, r, err)
+			return
+		}
+
+		idToken, err := m.idToken(r, a)
+		if err != nil {
+			m.httpError(w, r, err)
+			return
+		}
+
+		writeTokens(w, struct {
+			TokenPair
+			IDToken string `json:"id_token"`
+		}{pair, idToken})
+	case "refresh_token":
+		m.refreshGrant(w, r, client.ID)
+	default:
+		tokenError(http.StatusBadRequest, "unsupported_grant_type")
+	}
+}
+
+// handleUserinfo returns the claims of the user of the bearer token.
+func (m *maildoor) handleUserinfo(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="maildoor"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := m.verifyAccessToken(r, token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"sub":            claims["sub"],
+		"email":          claims["email"],
+		"email_verified": true,
+	})
+}
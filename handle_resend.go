@@ -0,0 +1,97 @@
+package maildoor
+
+import (
+	"net/http"
+)
+
+// handleResend sends the code to the email again. The current code
+// is re-sent while it is valid so earlier emails keep working, otherwise
+// a new one is generated. Emails need to wait for the resend cooldown
+// between sends.
+func (m *maildoor) handleResend(w http.ResponseWriter, r *http.Request) {
+	data := m.attempt(r)
+	email, _ := m.formEmail(r)
+	data.Email = email
+
+	if wait := m.resendIn(r, email); wait > 0 {
+		m.emit(r, EventRateLimited, email, nil)
+		data.ResendIn = wait
+		data.Error = data.T("error.resend_cooldown", wait)
+		data.AwaitingApproval = m.awaitingApproval(r)
+		if m.stateless != nil {
+			data.Challenge = m.requestChallenge(r)
+		}
+
+		m.writeCodePage(w, r, http.StatusTooManyRequests, data)
+		return
+	}
+
+	if _, err := m.validateEmail(r); err != nil {
+		data.Email = ""
+		data.Error = err.Error()
+
+		html, err := m.renderLogin(r, data)
+		if err != nil {
+			m.httpError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(html))
+		return
+	}
+
+	var challenge string
+	code, state := m.currentCode(r, email)
+	if state == codeActive && m.stateless != nil {
+		challenge = m.requestChallenge(r)
+	}
+
+	if state != codeActive {
+		var err error
+		code, challenge, err = m.issueCode(r, email)
+		if err != nil {
+			m.httpError(w, r, err)
+			return
+		}
+
+		m.emit(r, EventCodeRequested, email, nil)
+	}
+
+	approval, err := m.startApproval(w, r, email)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	msg, err := m.codeMessage(r, email, code, challenge, approval)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	m.setChallenge(w, r, &data, challenge)
+	if err := m.sendCode(r, msg); err != nil {
+		data.Error = err.Error()
+		m.writeCodePage(w, r, http.StatusInternalServerError, data)
+		return
+	}
+
+	data.ResendIn = m.resendIn(r, email)
+	data.AwaitingApproval = approval != ""
+	m.writeCodePage(w, r, http.StatusOK, data)
+}
+
+// writeCodePage renders the code page with the passed status.
+func (m *maildoor) writeCodePage(w http.ResponseWriter, r *http.Request, status int, data Attempt) {
+	html, err := m.renderCode(r, data)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	w.Write([]byte(html))
+}
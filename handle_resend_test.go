@@ -0,0 +1,148 @@
+package maildoor_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestHandleResend(t *testing.T) {
+	post := func(auth http.Handler, path, email string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = url.Values{"email": {email}}
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	t.Run("waits for the cooldown", func(t *testing.T) {
+		var sent []string
+		reg := maildoor.NewMetricsRegistry()
+		auth := maildoor.New(
+			maildoor.WithMetrics(reg),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				sent = append(sent, msg.Text)
+				return nil
+			}),
+		)
+
+		w := post(auth, "/email", "a@b.com")
+		testhelpers.Contains(t, w.Body.String(), `data-wait="30"`)
+		testhelpers.Contains(t, w.Body.String(), "Resend code in 30s")
+
+		w = post(auth, "/resend", "a@b.com")
+		testhelpers.Equals(t, http.StatusTooManyRequests, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "Please wait 30 seconds before requesting another code")
+		testhelpers.Contains(t, w.Body.String(), `not-allowed" disabled>`)
+		testhelpers.Equals(t, 1, len(sent))
+
+		var sb strings.Builder
+		reg.WriteTo(&sb)
+		testhelpers.Contains(t, sb.String(), "maildoor_rate_limited_total 1\n")
+	})
+
+	t.Run("the login form waits for the cooldown", func(t *testing.T) {
+		var sent []string
+		reg := maildoor.NewMetricsRegistry()
+		auth := maildoor.New(
+			maildoor.WithMetrics(reg),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				sent = append(sent, msg.Text)
+				return nil
+			}),
+		)
+
+		w := post(auth, "/email", "a@b.com")
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+
+		w = post(auth, "/email", "a@b.com")
+		testhelpers.Equals(t, http.StatusTooManyRequests, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "Please wait 30 seconds before requesting another code")
+		testhelpers.Equals(t, 1, len(sent))
+
+		var sb strings.Builder
+		reg.WriteTo(&sb)
+		testhelpers.Contains(t, sb.String(), "maildoor_rate_limited_total 1\n")
+	})
+
+	t.Run("shares the cooldown through the store", func(t *testing.T) {
+		var sent []string
+		sender := maildoor.MessageSender(func(msg maildoor.Message) error {
+			sent = append(sent, msg.Text)
+			return nil
+		})
+
+		store := maildoor.NewInMemoryCooldownStore()
+		first := maildoor.New(maildoor.Cooldowns(store), sender)
+		second := maildoor.New(maildoor.Cooldowns(store), sender)
+
+		w := post(first, "/email", "a@b.com")
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+
+		w = post(second, "/email", "a@b.com")
+		testhelpers.Equals(t, http.StatusTooManyRequests, w.Code)
+		testhelpers.Equals(t, 1, len(sent))
+		testhelpers.False(t, store.Until("a@b.com").IsZero())
+	})
+
+	t.Run("re-sends the current code", func(t *testing.T) {
+		var sent []maildoor.Message
+		auth := maildoor.New(
+			maildoor.ResendCooldown(0),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				sent = append(sent, msg)
+				return nil
+			}),
+		)
+
+		post(auth, "/email", "a@b.com")
+		w := post(auth, "/resend", "a@b.com")
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Equals(t, 2, len(sent))
+		testhelpers.Equals(t, sent[0].Text, sent[1].Text)
+		testhelpers.Contains(t, w.Body.String(), `data-wait="0"`)
+		testhelpers.NotContains(t, w.Body.String(), `not-allowed" disabled>`)
+	})
+
+	t.Run("generates a code when there is none", func(t *testing.T) {
+		var sent []maildoor.Message
+		auth := maildoor.New(
+			maildoor.WithTokenStorage(maildoor.NewInMemoryTokenStorage(time.Minute)),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				sent = append(sent, msg)
+				return nil
+			}),
+		)
+
+		w := post(auth, "/resend", "a@b.com")
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Equals(t, 1, len(sent))
+		testhelpers.Equals(t, "a@b.com", sent[0].To)
+	})
+
+	t.Run("validates the email", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.EmailValidator(func(email string) error {
+				return errors.New("not allowed")
+			}),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				t.Fatal("should not send")
+				return nil
+			}),
+		)
+
+		w := post(auth, "/resend", "a@b.com")
+		testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "not allowed")
+	})
+}
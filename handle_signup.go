@@ -0,0 +1,96 @@
+package maildoor
+
+import (
+	"net/http"
+)
+
+// handleSignupPage renders the signup form with the email and
+// fields in the query prefilled.
+func (m *maildoor) handleSignupPage(w http.ResponseWriter, r *http.Request) {
+	data := m.attempt(r)
+	data.Email, _ = m.formEmail(r)
+	data.Fields, _, _ = m.formFields(r, data)
+
+	m.writeSignupPage(w, r, http.StatusOK, data)
+}
+
+// handleSignup validates the signup form and sends the login code to
+// the email. The user is created by handleCode once the email is
+// verified. Existing users get a code as well so the form does not
+// reveal which emails have an account.
+func (m *maildoor) handleSignup(w http.ResponseWriter, r *http.Request) {
+	data := m.attempt(r)
+	email, _ := m.formEmail(r)
+	data.Email = email
+
+	fields, values, problem := m.formFields(r, data)
+	data.Fields = fields
+	if problem != "" {
+		data.Error = problem
+		m.writeSignupPage(w, r, http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	if _, err := m.validateEmail(r); err != nil {
+		data.Error = err.Error()
+		m.writeSignupPage(w, r, http.StatusUnprocessableEntity, data)
+		return
+	}
+
+	if wait := m.resendIn(r, email); wait > 0 {
+		m.emit(r, EventRateLimited, email, nil)
+		data.Error = data.T("error.resend_cooldown", wait)
+		m.writeSignupPage(w, r, http.StatusTooManyRequests, data)
+		return
+	}
+
+	if err := m.storePendingSignup(w, r, email, values); err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	code, challenge, err := m.issueCode(r, email)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	m.emit(r, EventCodeRequested, email, nil)
+
+	approval, err := m.startApproval(w, r, email)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	msg, err := m.codeMessage(r, email, code, challenge, approval)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	if err := m.sendCode(r, msg); err != nil {
+		data.Error = err.Error()
+		m.writeSignupPage(w, r, http.StatusInternalServerError, data)
+		return
+	}
+
+	data.Fields = nil
+	data.ResendIn = m.resendIn(r, email)
+	data.AwaitingApproval = approval != ""
+	m.setChallenge(w, r, &data, challenge)
+	m.writeCodePage(w, r, http.StatusOK, data)
+}
+
+// writeSignupPage renders the signup page with the passed status.
+func (m *maildoor) writeSignupPage(w http.ResponseWriter, r *http.Request, status int, data Attempt) {
+	html, err := m.renderSignup(r, data)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	w.Write([]byte(html))
+}
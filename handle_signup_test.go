@@ -0,0 +1,164 @@
+package maildoor_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestSignup(t *testing.T) {
+	codePattern := regexp.MustCompile(`\b\d{6}\b`)
+	setup := func(store maildoor.UserStore) (http.Handler, *string, *[]string) {
+		var code string
+		var logins []string
+		auth := maildoor.New(
+			maildoor.ResendCooldown(0),
+			maildoor.Signup(store, maildoor.SignupField{Name: "name", Label: "signup.name", Required: true}),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				code = codePattern.FindString(msg.Text)
+				return nil
+			}),
+			maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+				u, _ := maildoor.UserFrom(r)
+				if maildoor.IsNewSignup(r) {
+					logins = append(logins, "new:"+u.Fields["name"])
+					return
+				}
+
+				logins = append(logins, "existing:"+u.Fields["name"])
+			}),
+		)
+
+		return auth, &code, &logins
+	}
+
+	post := func(auth http.Handler, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	t.Run("creates the user after verifying the email", func(t *testing.T) {
+		store := maildoor.NewInMemoryUserStore()
+		auth, code, logins := setup(store)
+
+		w := post(auth, "/signup", url.Values{"email": {"a@b.com"}, "name": {" Ana "}})
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Body.String(), `action="/code"`)
+
+		_, err := store.Find(context.Background(), "a@b.com")
+		testhelpers.Equals(t, maildoor.ErrUserNotFound, err)
+
+		post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {*code}}, w.Result().Cookies()...)
+		testhelpers.Equals(t, []string{"new:Ana"}, *logins)
+
+		u, err := store.Find(context.Background(), "a@b.com")
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, "Ana", u.Fields["name"])
+
+		post(auth, "/email", url.Values{"email": {"a@b.com"}})
+		post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {*code}})
+		testhelpers.Equals(t, []string{"new:Ana", "existing:Ana"}, *logins)
+	})
+
+	t.Run("signups only apply to the browser that posted them", func(t *testing.T) {
+		store := maildoor.NewInMemoryUserStore()
+		auth, code, logins := setup(store)
+
+		// Someone else signs up with the email.
+		post(auth, "/signup", url.Values{"email": {"a@b.com"}, "name": {"Mallory"}})
+
+		post(auth, "/email", url.Values{"email": {"a@b.com"}})
+		w := post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {*code}})
+		testhelpers.Equals(t, 0, len(*logins))
+		testhelpers.Contains(t, w.Body.String(), "There is no account for this email, please sign up")
+
+		_, err := store.Find(context.Background(), "a@b.com")
+		testhelpers.Equals(t, maildoor.ErrUserNotFound, err)
+	})
+
+	t.Run("codes from the login form don't complete the signup", func(t *testing.T) {
+		store := maildoor.NewInMemoryUserStore()
+		auth, code, logins := setup(store)
+
+		w := post(auth, "/signup", url.Values{"email": {"a@b.com"}, "name": {"Ana"}})
+		cookies := w.Result().Cookies()
+
+		post(auth, "/email", url.Values{"email": {"a@b.com"}}, cookies...)
+		post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {*code}}, cookies...)
+		testhelpers.Equals(t, 0, len(*logins))
+	})
+
+	t.Run("the cookie is secure with an https BaseURL", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.BaseURL("https://example.com"),
+			maildoor.Signup(maildoor.NewInMemoryUserStore(), maildoor.SignupField{Name: "name", Label: "signup.name"}),
+			maildoor.MessageSender(func(msg maildoor.Message) error { return nil }),
+		)
+
+		w := post(auth, "/signup", url.Values{"email": {"a@b.com"}, "name": {"Ana"}})
+		cookies := w.Result().Cookies()
+		testhelpers.Equals(t, 1, len(cookies))
+		testhelpers.True(t, cookies[0].Secure)
+	})
+
+	t.Run("requires the fields", func(t *testing.T) {
+		auth, code, _ := setup(maildoor.NewInMemoryUserStore())
+
+		w := post(auth, "/signup", url.Values{"email": {"a@b.com"}})
+		testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "Name is required")
+		testhelpers.Contains(t, w.Body.String(), `value="a@b.com"`)
+		testhelpers.Equals(t, "", *code)
+	})
+
+	t.Run("unknown emails are sent to signup", func(t *testing.T) {
+		auth, code, logins := setup(maildoor.NewInMemoryUserStore())
+
+		post(auth, "/email", url.Values{"email": {"a@b.com"}})
+		w := post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {*code}})
+
+		testhelpers.Equals(t, 0, len(*logins))
+		testhelpers.Contains(t, w.Body.String(), "There is no account for this email, please sign up")
+		testhelpers.Contains(t, w.Body.String(), `action="/signup"`)
+	})
+
+	t.Run("login page links to signup", func(t *testing.T) {
+		auth, _, _ := setup(maildoor.NewInMemoryUserStore())
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+		testhelpers.Contains(t, w.Body.String(), `href="/signup"`)
+
+		w = httptest.NewRecorder()
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/signup?email=a@b.com", nil))
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Body.String(), `name="name"`)
+		testhelpers.Contains(t, w.Body.String(), `value="a@b.com"`)
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		auth := maildoor.New()
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/signup", nil))
+		testhelpers.Equals(t, http.StatusNotFound, w.Code)
+
+		w = httptest.NewRecorder()
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+		testhelpers.NotContains(t, w.Body.String(), "/signup")
+	})
+}
@@ -0,0 +1,37 @@
+package maildoor
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+)
+
+// handleStepUp renders the page to confirm the email of the signed in
+// user with a code, it is where RequireRecentLogin sends the users.
+func (m *maildoor) handleStepUp(w http.ResponseWriter, r *http.Request) {
+	data := m.attempt(r)
+	data.Email, _ = m.formEmail(r)
+	ret := r.FormValue("return")
+	if data.Email == "" || !localPath(ret) {
+		http.Redirect(w, r, path.Join(m.tenant(r).prefix, "login"), http.StatusSeeOther)
+		return
+	}
+
+	// Only the forms of this page return to the path.
+	data.Return = m.stepUp.returnToken(m.tenant(r).ID, data.Email, ret)
+
+	_, span := m.startSpan(r, "maildoor.render", data.Email)
+	span.SetAttributes(Attr("maildoor.page", "stepup"))
+
+	var buf bytes.Buffer
+	err := m.render(&buf, data, "layout.html", "handle_stepup.html")
+	endSpan(span, err)
+
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,40 @@
+package maildoor
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/wawandco/maildoor/internal/jwt"
+)
+
+// handleJWKS serves the public keys of the access tokens.
+func (m *maildoor) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, map[string]any{"keys": jwt.Set(m.tokens.keys)})
+}
+
+// handleRefresh exchanges the refresh_token of the form for new
+// tokens, errors follow the OAuth 2.0 token error response.
+func (m *maildoor) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	m.refreshGrant(w, r, "")
+}
+
+// refreshGrant exchanges the refresh_token of the form issued to the
+// client, empty for the tokens of the login.
+func (m *maildoor) refreshGrant(w http.ResponseWriter, r *http.Request, clientID string) {
+	pair, err := m.refresh(r, r.FormValue("refresh_token"), clientID)
+	if errors.Is(err, errInvalidGrant) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	writeTokens(w, pair)
+}
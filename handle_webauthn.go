@@ -0,0 +1,227 @@
+package maildoor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/wawandco/maildoor/internal/webauthn"
+)
+
+// errClonedAuthenticator is returned when the signature counter of a
+// credential goes back, the authenticator may have been cloned.
+var errClonedAuthenticator = errors.New("passkey signature counter went back")
+
+// handleRegisterOptions returns the options to create the passkey
+// offered after verifying the email.
+func (m *maildoor) handleRegisterOptions(w http.ResponseWriter, r *http.Request) {
+	challenge, email, ok := m.ceremonies.challenge(m.ceremonyID(r))
+	if !ok || email == "" {
+		http.Error(w, "passkey ceremony expired", http.StatusBadRequest)
+		return
+	}
+
+	// The user handle is random so it doesn't reveal the email.
+	userID := make([]byte, 16)
+	rand.Read(userID)
+
+	var params []map[string]any
+	for _, alg := range webauthn.Algorithms {
+		params = append(params, map[string]any{"type": "public-key", "alg": alg})
+	}
+
+	c := m.webauthnCeremony(r, challenge)
+	writeJSON(w, map[string]any{
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"rp":        map[string]string{"id": c.RPID, "name": m.tenant(r).ProductName},
+		"user": map[string]string{
+			"id":          base64.RawURLEncoding.EncodeToString(userID),
+			"name":        email,
+			"displayName": email,
+		},
+		"pubKeyCredParams": params,
+		"timeout":          webauthnTTL.Milliseconds(),
+		"attestation":      "none",
+		"authenticatorSelection": map[string]any{
+			"residentKey":        "required",
+			"requireResidentKey": true,
+			"userVerification":   "preferred",
+		},
+	})
+}
+
+// handleRegister saves the passkey created by the browser and
+// continues the login. The email was verified already so the login
+// continues when the passkey can't be verified.
+func (m *maildoor) handleRegister(w http.ResponseWriter, r *http.Request) {
+	c, ok := m.takeCeremony(w, r)
+	if !ok || c.email == "" {
+		http.Redirect(w, r, path.Join(m.tenant(r).prefix, "login"), http.StatusSeeOther)
+		return
+	}
+
+	reg, err := webauthn.VerifyRegistration(
+		m.webauthnCeremony(r, c.challenge),
+		decodeField(r, "clientDataJSON"),
+		decodeField(r, "attestationObject"),
+	)
+
+	// Credentials of other accounts are not replaced.
+	if err == nil {
+		_, span := m.startSpan(r, "maildoor.credentials.find", c.email)
+		_, err = m.credentials.Find(r.Context(), reg.CredentialID)
+		endSpan(span, nil)
+
+		switch {
+		case err == nil:
+			err = errCredentialRegistered
+		case errors.Is(err, ErrCredentialNotFound):
+			err = nil
+		}
+	}
+
+	if err == nil {
+		_, span := m.startSpan(r, "maildoor.credentials.add", c.email)
+		err = m.credentials.Add(r.Context(), Credential{
+			ID:        reg.CredentialID,
+			Email:     m.storageKey(r, c.email),
+			PublicKey: reg.PublicKey,
+			SignCount: reg.SignCount,
+			CreatedAt: time.Now(),
+		})
+
+		endSpan(span, err)
+	}
+
+	if err != nil {
+		m.emit(r, EventPasskeyFailed, c.email, err)
+	} else {
+		m.emit(r, EventPasskeyRegistered, c.email, nil)
+	}
+
+	m.continueLogin(w, r, c.email)
+}
+
+// handleSkipPasskey continues the login without registering the
+// offered passkey.
+func (m *maildoor) handleSkipPasskey(w http.ResponseWriter, r *http.Request) {
+	c, ok := m.takeCeremony(w, r)
+	if !ok || c.email == "" {
+		http.Redirect(w, r, path.Join(m.tenant(r).prefix, "login"), http.StatusSeeOther)
+		return
+	}
+
+	m.continueLogin(w, r, c.email)
+}
+
+// handleLoginOptions starts a passkey login and returns the options
+// to get the credential, the authenticator picks the passkey.
+func (m *maildoor) handleLoginOptions(w http.ResponseWriter, r *http.Request) {
+	challenge, _, _ := m.ceremonies.challenge(m.startCeremony(w, r, ""))
+	c := m.webauthnCeremony(r, challenge)
+
+	writeJSON(w, map[string]any{
+		"challenge":        base64.RawURLEncoding.EncodeToString(challenge),
+		"rpId":             c.RPID,
+		"timeout":          webauthnTTL.Milliseconds(),
+		"userVerification": "preferred",
+	})
+}
+
+// handlePasskeyLogin verifies the passkey and completes the login of
+// its email.
+func (m *maildoor) handlePasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	c, ok := m.takeCeremony(w, r)
+
+	var cred Credential
+	var err error
+	switch {
+	case !ok || c.email != "":
+		err = webauthn.ErrVerification
+	default:
+		_, span := m.startSpan(r, "maildoor.credentials.find", "")
+		cred, err = m.credentials.Find(r.Context(), decodeField(r, "id"))
+		endSpan(span, err)
+	}
+
+	// Passkeys of other tenants are not found.
+	email, found := m.credentialEmail(r, cred)
+	if err == nil && !found {
+		email, err = "", ErrCredentialNotFound
+	}
+
+	if err == nil {
+		err = m.verifyPasskey(r, c, cred)
+	}
+
+	if err != nil {
+		m.emit(r, EventPasskeyFailed, email, err)
+
+		data := m.attempt(r)
+		data.Error = data.T("error.passkey_failed")
+		w.WriteHeader(http.StatusUnauthorized)
+
+		html, err := m.renderLogin(r, data)
+		if err != nil {
+			m.httpError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(html))
+		return
+	}
+
+	m.continueLogin(w, r, email)
+}
+
+// verifyPasskey verifies the assertion in the request was signed by
+// the credential and saves its signature counter.
+func (m *maildoor) verifyPasskey(r *http.Request, c ceremony, cred Credential) error {
+	assertion, err := webauthn.VerifyAssertion(
+		m.webauthnCeremony(r, c.challenge),
+		cred.PublicKey,
+		decodeField(r, "clientDataJSON"),
+		decodeField(r, "authenticatorData"),
+		decodeField(r, "signature"),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	// Authenticators without a counter always send 0.
+	if (assertion.SignCount != 0 || cred.SignCount != 0) && assertion.SignCount <= cred.SignCount {
+		return errClonedAuthenticator
+	}
+
+	return m.credentials.UpdateSignCount(r.Context(), cred.ID, assertion.SignCount)
+}
+
+// writePasskeyPage renders the page offering to register a passkey.
+func (m *maildoor) writePasskeyPage(w http.ResponseWriter, r *http.Request, data Attempt) {
+	_, span := m.startSpan(r, "maildoor.render", data.Email)
+	span.SetAttributes(Attr("maildoor.page", "passkey"))
+
+	var buf bytes.Buffer
+	err := m.render(&buf, data, "layout.html", "handle_passkey.html")
+	endSpan(span, err)
+
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(buf.Bytes())
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,221 @@
+package maildoor_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+	"github.com/wawandco/maildoor/internal/webauthn/webauthntest"
+)
+
+func TestPasskeys(t *testing.T) {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	var code string
+	var logins []string
+	store := maildoor.NewInMemoryCredentialStore()
+	auth := maildoor.New(
+		maildoor.BaseURL("http://example.com"),
+		maildoor.Passkeys(store),
+		maildoor.ResendCooldown(0),
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			code = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+			return nil
+		}),
+		maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+			logins = append(logins, maildoor.EmailFrom(r))
+		}),
+	)
+
+	post := func(path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	// verify logs in with the email code.
+	verify := func(email string) *httptest.ResponseRecorder {
+		post("/email", url.Values{"email": {email}}, nil)
+		return post("/code", url.Values{"email": {email}, "code": {code}}, nil)
+	}
+
+	// options returns the challenge of the ceremony.
+	options := func(w *httptest.ResponseRecorder) []byte {
+		var opts struct{ Challenge string }
+		testhelpers.NoError(t, json.NewDecoder(w.Body).Decode(&opts))
+
+		challenge, err := base64.RawURLEncoding.DecodeString(opts.Challenge)
+		testhelpers.NoError(t, err)
+
+		return challenge
+	}
+
+	a := webauthntest.New("http://example.com", "example.com")
+
+	w := verify("a@b.com")
+	testhelpers.Contains(t, w.Body.String(), "Add a passkey")
+	testhelpers.Equals(t, 0, len(logins))
+
+	cookie := w.Result().Cookies()[0]
+	testhelpers.Equals(t, "maildoor_webauthn", cookie.Name)
+	testhelpers.False(t, cookie.Secure)
+
+	w = post("/webauthn/register/options", nil, cookie)
+	testhelpers.Contains(t, w.Body.String(), `"attestation":"none"`)
+	testhelpers.Contains(t, w.Body.String(), `"id":"example.com"`)
+
+	clientData, attestation := a.Create(options(w))
+	post("/webauthn/register", url.Values{
+		"id":                {b64(a.CredentialID)},
+		"clientDataJSON":    {b64(clientData)},
+		"attestationObject": {b64(attestation)},
+	}, cookie)
+
+	testhelpers.Equals(t, []string{"a@b.com"}, logins)
+
+	creds, _ := store.List(context.Background(), "a@b.com")
+	testhelpers.Equals(t, 1, len(creds))
+	testhelpers.Equals(t, a.CredentialID, creds[0].ID)
+
+	t.Run("logs in with the passkey", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+		testhelpers.Contains(t, w.Body.String(), "Sign in with a passkey")
+
+		w = post("/webauthn/login/options", nil, nil)
+		cookie := w.Result().Cookies()[0]
+
+		clientData, authData, sig := a.Get(options(w))
+		form := url.Values{
+			"id":                {b64(a.CredentialID)},
+			"clientDataJSON":    {b64(clientData)},
+			"authenticatorData": {b64(authData)},
+			"signature":         {b64(sig)},
+		}
+
+		post("/webauthn/login", form, cookie)
+		testhelpers.Equals(t, []string{"a@b.com", "a@b.com"}, logins)
+
+		// The challenge can only be used once.
+		w = post("/webauthn/login", form, cookie)
+		testhelpers.Equals(t, http.StatusUnauthorized, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "The passkey could not be verified")
+		testhelpers.Equals(t, 2, len(logins))
+	})
+
+	t.Run("rejects cloned authenticators", func(t *testing.T) {
+		w := post("/webauthn/login/options", nil, nil)
+		cookie := w.Result().Cookies()[0]
+
+		a.SignCount = 0
+		clientData, authData, sig := a.Get(options(w))
+		w = post("/webauthn/login", url.Values{
+			"id":                {b64(a.CredentialID)},
+			"clientDataJSON":    {b64(clientData)},
+			"authenticatorData": {b64(authData)},
+			"signature":         {b64(sig)},
+		}, cookie)
+
+		testhelpers.Equals(t, http.StatusUnauthorized, w.Code)
+		testhelpers.Equals(t, 2, len(logins))
+	})
+
+	t.Run("logs in users with a passkey without offering another", func(t *testing.T) {
+		verify("a@b.com")
+		testhelpers.Equals(t, 3, len(logins))
+	})
+
+	t.Run("skips the passkey", func(t *testing.T) {
+		w := verify("c@d.com")
+		cookie := w.Result().Cookies()[0]
+
+		post("/webauthn/skip", nil, cookie)
+		testhelpers.Equals(t, "c@d.com", logins[len(logins)-1])
+
+		w = post("/webauthn/skip", nil, cookie)
+		testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+	})
+
+	t.Run("rejects registered credentials", func(t *testing.T) {
+		w := verify("e@f.com")
+		cookie := w.Result().Cookies()[0]
+
+		w = post("/webauthn/register/options", nil, cookie)
+		clientData, attestation := a.Create(options(w))
+		post("/webauthn/register", url.Values{
+			"id":                {b64(a.CredentialID)},
+			"clientDataJSON":    {b64(clientData)},
+			"attestationObject": {b64(attestation)},
+		}, cookie)
+
+		// The login continues without the passkey.
+		testhelpers.Equals(t, "e@f.com", logins[len(logins)-1])
+
+		creds, _ := store.List(context.Background(), "e@f.com")
+		testhelpers.Equals(t, 0, len(creds))
+
+		cred, err := store.Find(context.Background(), a.CredentialID)
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, "a@b.com", cred.Email)
+	})
+}
+
+func TestRelyingPartyID(t *testing.T) {
+	t.Run("parent domain of BaseURL", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.BaseURL("https://auth.example.com:8443/auth"),
+			maildoor.RelyingPartyID("example.com"),
+			maildoor.Passkeys(maildoor.NewInMemoryCredentialStore()),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/webauthn/login/options", nil)
+		req.Host = "evil.com"
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Contains(t, w.Body.String(), `"rpId":"example.com"`)
+	})
+
+	t.Run("host of BaseURL by default", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.BaseURL("https://auth.example.com:8443/auth"),
+			maildoor.Passkeys(maildoor.NewInMemoryCredentialStore()),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/webauthn/login/options", nil)
+		req.Host = "evil.com"
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Contains(t, w.Body.String(), `"rpId":"auth.example.com"`)
+		testhelpers.True(t, w.Result().Cookies()[0].Secure)
+	})
+
+	t.Run("panics with other domains", func(t *testing.T) {
+		defer func() {
+			testhelpers.NotNil(t, recover())
+		}()
+
+		maildoor.New(
+			maildoor.BaseURL("https://auth.example.com"),
+			maildoor.RelyingPartyID("ample.com"),
+			maildoor.Passkeys(maildoor.NewInMemoryCredentialStore()),
+		)
+
+		t.Fatal("expected New to panic")
+	})
+}
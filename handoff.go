@@ -0,0 +1,128 @@
+package maildoor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// handoffTTL is the lifetime of the token in the QR code of the code
+// page, the page renews the QR code before it expires.
+const handoffTTL = 2 * time.Minute
+
+var (
+	errInvalidHandoff = errors.New("invalid or expired handoff token")
+	errSignedOut      = errors.New("the device is not signed in")
+)
+
+// handoff signs the tokens in the QR code of the code page with a key
+// derived from the QRHandoff secret, so every instance sharing the
+// secret accepts them.
+type handoff struct {
+	key      []byte
+	signedIn func(r *http.Request) string
+}
+
+func newHandoff(secret []byte, signedIn func(r *http.Request) string) (*handoff, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("the secret must be at least 32 bytes")
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("maildoor QR handoff"))
+
+	return &handoff{key: mac.Sum(nil), signedIn: signedIn}, nil
+}
+
+// token returns a token for the handoff id that expires at expires,
+// the id is the hex encoding of 32 random bytes.
+func (h *handoff) token(id string, expires time.Time) string {
+	raw, _ := hex.DecodeString(id)
+	payload := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	payload = append(payload, raw...)
+
+	return base64.RawURLEncoding.EncodeToString(append(payload, h.sign(payload)...))
+}
+
+// verify returns the handoff id of the token when its signature is
+// valid and it didn't expire.
+func (h *handoff) verify(token string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) != 8+32+16 {
+		return "", errInvalidHandoff
+	}
+
+	payload, sig := b[:40], b[40:]
+	if !hmac.Equal(sig, h.sign(payload)) {
+		return "", errInvalidHandoff
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[:8])), 0)
+	if time.Now().After(expires) {
+		return "", errInvalidHandoff
+	}
+
+	return hex.EncodeToString(payload[8:]), nil
+}
+
+// csrf returns the token of the approval form for the handoff token
+// and the signed in email. Cross-site forms can't know it since the
+// handoff token only travels in the QR code.
+func (h *handoff) csrf(token, email string) string {
+	return base64.RawURLEncoding.EncodeToString(h.sign([]byte("csrf|" + token + "|" + email)))
+}
+
+func (h *handoff) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(payload)
+
+	return mac.Sum(nil)[:16]
+}
+
+// handoffLogin returns the login of the handoff token in the request
+// when the device is signed in with its email, approving it when
+// approve is true.
+func (m *maildoor) handoffLogin(r *http.Request, approve bool) (Approval, error) {
+	id, err := m.handoff.verify(r.FormValue("token"))
+	if err != nil {
+		return Approval{}, err
+	}
+
+	approval, ok := m.waitingLogin(r, m.handoffAlias(r, id), false)
+	if !ok {
+		return Approval{}, errInvalidHandoff
+	}
+
+	email := m.handoff.signedIn(r)
+	if email == "" {
+		return Approval{}, errSignedOut
+	}
+
+	// Other accounts can't tell the login exists.
+	email, err = m.normalizeEmail(email)
+	if err != nil || email != approval.Email {
+		return Approval{}, errInvalidHandoff
+	}
+
+	if !approve {
+		return approval, nil
+	}
+
+	// The form must come from the approval page of the signed in device.
+	csrf := m.handoff.csrf(r.FormValue("token"), email)
+	if !hmac.Equal([]byte(r.FormValue("csrf")), []byte(csrf)) {
+		return Approval{}, errInvalidHandoff
+	}
+
+	approval, ok = m.waitingLogin(r, m.handoffAlias(r, id), true)
+	if !ok {
+		return Approval{}, errInvalidHandoff
+	}
+
+	return approval, nil
+}
@@ -0,0 +1,213 @@
+package maildoor
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	//go:embed locales/*.json
+	locales embed.FS
+)
+
+const (
+	// localeParam is the query parameter used to pick the locale.
+	localeParam = "lang"
+
+	// localeCookie is the cookie that remembers the picked locale.
+	localeCookie = "maildoor_lang"
+)
+
+type contextKey string
+
+const localeKey contextKey = "locale"
+
+// catalog holds the messages for each of the locales keyed
+// by the message id.
+type catalog map[string]map[string]string
+
+// bundledCatalog loads the locales that ship with maildoor.
+func bundledCatalog() catalog {
+	c := catalog{}
+	files, err := locales.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+
+	for _, f := range files {
+		b, err := locales.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		messages := map[string]string{}
+		if err := json.Unmarshal(b, &messages); err != nil {
+			panic(fmt.Errorf("maildoor: parsing %s: %w", f.Name(), err))
+		}
+
+		c[strings.TrimSuffix(f.Name(), ".json")] = messages
+	}
+
+	return c
+}
+
+// add merges the passed messages into the locale, overriding
+// existing messages with the same id.
+func (c catalog) add(locale string, messages map[string]string) {
+	locale = strings.ToLower(locale)
+	if c[locale] == nil {
+		c[locale] = map[string]string{}
+	}
+
+	for k, v := range messages {
+		c[locale][k] = v
+	}
+}
+
+// translator returns a function that translates message ids
+// to the locale, falling back to the fallback locale, then to
+// english and then to the id itself when the message is missing.
+func (c catalog) translator(locale, fallback string) func(string, ...any) string {
+	return func(key string, args ...any) string {
+		msg := key
+		for _, l := range []string{locale, fallback, "en"} {
+			if m, ok := c[l][key]; ok {
+				msg = m
+				break
+			}
+		}
+
+		if len(args) == 0 {
+			return msg
+		}
+
+		return fmt.Sprintf(msg, args...)
+	}
+}
+
+// match returns the supported locale for the passed language tag,
+// trying the full tag first (pt-br) and then its base (pt).
+func (c catalog) match(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "", false
+	}
+
+	if _, ok := c[tag]; ok {
+		return tag, true
+	}
+
+	base, _, _ := strings.Cut(tag, "-")
+	if _, ok := c[base]; ok {
+		return base, true
+	}
+
+	return "", false
+}
+
+// negotiateLocale determines the locale for the request, looking
+// at the lang query parameter, the locale cookie and the
+// Accept-Language header in that order. When the locale comes from
+// the query it is remembered in the cookie.
+func (m *maildoor) negotiateLocale(w http.ResponseWriter, r *http.Request) string {
+	if l, ok := m.catalog.match(r.URL.Query().Get(localeParam)); ok {
+		http.SetCookie(w, &http.Cookie{
+			Name:     localeCookie,
+			Value:    l,
+			Path:     m.tenant(r).prefix,
+			HttpOnly: true,
+			Secure:   m.secureCookies(),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		return l
+	}
+
+	if c, err := r.Cookie(localeCookie); err == nil {
+		if l, ok := m.catalog.match(c.Value); ok {
+			return l
+		}
+	}
+
+	for _, tag := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if l, ok := m.catalog.match(tag); ok {
+			return l
+		}
+	}
+
+	return m.defaultLocale
+}
+
+// acceptedLanguages parses an Accept-Language header and returns the
+// language tags sorted by their quality, highest first.
+func acceptedLanguages(header string) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+
+	var langs []lang
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+
+			q = f
+		}
+
+		if q <= 0 {
+			continue
+		}
+
+		langs = append(langs, lang{tag: tag, q: q})
+	}
+
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+
+	tags := make([]string, len(langs))
+	for i, l := range langs {
+		tags[i] = l.tag
+	}
+
+	return tags
+}
+
+// LocaleFrom returns the locale maildoor negotiated for the request,
+// it can be used in the AfterLogin and Logout hooks.
+func LocaleFrom(r *http.Request) string {
+	l, _ := r.Context().Value(localeKey).(string)
+	return l
+}
+
+// withLocale negotiates the locale and adds it to the request context.
+func (m *maildoor) withLocale(w http.ResponseWriter, r *http.Request) *http.Request {
+	l := m.negotiateLocale(w, r)
+	return r.WithContext(context.WithValue(r.Context(), localeKey, l))
+}
+
+// requestLocale returns the locale for the request or the
+// default one when it has not been negotiated.
+func (m *maildoor) requestLocale(r *http.Request) string {
+	if l := LocaleFrom(r); l != "" {
+		return l
+	}
+
+	return m.defaultLocale
+}
@@ -0,0 +1,149 @@
+package maildoor_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestLocales(t *testing.T) {
+	t.Run("defaults to english", func(t *testing.T) {
+		auth := maildoor.New()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Contains(t, w.Body.String(), `<html lang="en">`)
+		testhelpers.Contains(t, w.Body.String(), "Sign in to your account")
+	})
+
+	t.Run("accept-language header", func(t *testing.T) {
+		auth := maildoor.New()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.Header.Set("Accept-Language", "fr-CA;q=0.9, es-CO, en;q=0.5")
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Contains(t, w.Body.String(), `<html lang="es">`)
+		testhelpers.Contains(t, w.Body.String(), "Inicia sesión en tu cuenta")
+	})
+
+	t.Run("query parameter sets the cookie", func(t *testing.T) {
+		auth := maildoor.New(maildoor.Prefix("/auth"))
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/auth/login?lang=pt-BR", nil)
+		req.Header.Set("Accept-Language", "es")
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Contains(t, w.Body.String(), "Entre na sua conta")
+		testhelpers.Contains(t, w.Header().Get("Set-Cookie"), "maildoor_lang=pt")
+		testhelpers.Contains(t, w.Header().Get("Set-Cookie"), "Path=/auth")
+		testhelpers.NotContains(t, w.Header().Get("Set-Cookie"), "Secure")
+
+		w = httptest.NewRecorder()
+		auth = maildoor.New(maildoor.Prefix("/auth"), maildoor.BaseURL("https://example.com"))
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login?lang=pt-BR", nil))
+		testhelpers.Contains(t, w.Header().Get("Set-Cookie"), "Secure")
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		auth := maildoor.New()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/code", nil)
+		req.AddCookie(&http.Cookie{Name: "maildoor_lang", Value: "es"})
+		req.Form = url.Values{
+			"email": []string{"test@example.com"},
+			"code":  []string{"invalid"},
+		}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Contains(t, w.Body.String(), "Código inválido")
+	})
+
+	t.Run("emails are translated", func(t *testing.T) {
+		var msg maildoor.Message
+		auth := maildoor.New(
+			maildoor.ProductName("Acme"),
+			maildoor.MessageSender(func(m maildoor.Message) error {
+				msg = m
+				return nil
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Header.Set("Accept-Language", "es")
+		req.Form = url.Values{
+			"email": []string{"test@example.com"},
+		}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, "Tu código de acceso a Acme", msg.Subject)
+		testhelpers.Contains(t, msg.Text, "Código:")
+		testhelpers.Contains(t, msg.HTML, `lang="es"`)
+	})
+
+	t.Run("custom translations", func(t *testing.T) {
+		var locale string
+		auth := maildoor.New(
+			maildoor.DefaultLocale("de"),
+			maildoor.Translations("de", map[string]string{
+				"login.title": "Melden Sie sich an",
+			}),
+			maildoor.Translations("en", map[string]string{
+				"login.submit": "Email me a code",
+			}),
+			maildoor.LoginRenderer(func(data maildoor.Attempt) (string, error) {
+				locale = data.Locale
+				return data.T("login.title") + "|" + data.T("login.submit"), nil
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, "de", locale)
+
+		// Missing messages fall back to english.
+		testhelpers.Equals(t, "Melden Sie sich an|Email me a code", w.Body.String())
+
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/login", nil)
+		req.Header.Set("Accept-Language", "en-US")
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, "Sign in to your account|Email me a code", w.Body.String())
+	})
+
+	t.Run("locale in after login context", func(t *testing.T) {
+		var locale string
+		storage := maildoor.NewInMemoryTokenStorage(0)
+		storage.Store("test@example.com", "123456")
+
+		auth := maildoor.New(
+			maildoor.WithTokenStorage(storage),
+			maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+				locale = maildoor.LocaleFrom(r)
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/code?lang=pt", nil)
+		req.Form = url.Values{
+			"email": []string{"test@example.com"},
+			"code":  []string{"123456"},
+		}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, "pt", locale)
+	})
+}
@@ -0,0 +1,250 @@
+// Package jwt signs and verifies compact JSON Web Tokens (RFC 7519)
+// with the HS256, ES256 and EdDSA algorithms and publishes the public
+// keys as a JSON Web Key Set (RFC 7517).
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Algorithms supported.
+const (
+	HS256 = "HS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// Token types of the typ header, access tokens use the one of RFC 9068
+// so other tokens (e.g. ID tokens) can't be used in their place.
+const (
+	TypeJWT    = "JWT"
+	TypeAccess = "at+jwt"
+)
+
+var (
+	// ErrInvalid is returned for tokens that are malformed, signed with
+	// an unknown key or whose signature doesn't match.
+	ErrInvalid = errors.New("jwt: invalid token")
+
+	// ErrExpired is returned for tokens past their exp claim.
+	ErrExpired = errors.New("jwt: token expired")
+)
+
+var enc = base64.RawURLEncoding
+
+// Key signs and verifies the tokens with the kid ID.
+type Key struct {
+	ID        string
+	Algorithm string
+
+	secret  []byte
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+// NewHS256 returns a key that signs with HMAC-SHA256 and the secret.
+func NewHS256(id string, secret []byte) (Key, error) {
+	if len(secret) < 32 {
+		return Key{}, errors.New("jwt: HS256 secrets must be at least 32 bytes")
+	}
+
+	return Key{ID: id, Algorithm: HS256, secret: secret}, nil
+}
+
+// NewES256 returns a key that signs with ECDSA P-256 and SHA-256.
+func NewES256(id string, key *ecdsa.PrivateKey) (Key, error) {
+	if key == nil || key.Curve != elliptic.P256() {
+		return Key{}, errors.New("jwt: ES256 keys must use the P-256 curve")
+	}
+
+	return Key{ID: id, Algorithm: ES256, ecdsa: key}, nil
+}
+
+// NewEdDSA returns a key that signs with Ed25519.
+func NewEdDSA(id string, key ed25519.PrivateKey) (Key, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return Key{}, errors.New("jwt: invalid Ed25519 key")
+	}
+
+	return Key{ID: id, Algorithm: EdDSA, ed25519: key}, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Sign returns the token of the typ with the claims signed by the key.
+func Sign(k Key, typ string, claims map[string]any) (string, error) {
+	h, err := json.Marshal(header{Alg: k.Algorithm, Typ: typ, Kid: k.ID})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	sig, err := k.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + enc.EncodeToString(sig), nil
+}
+
+func (k Key) sign(input []byte) ([]byte, error) {
+	switch k.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case ES256:
+		digest := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, k.ecdsa, digest[:])
+		if err != nil {
+			return nil, err
+		}
+
+		// JWS uses the fixed size R || S encoding, not ASN.1.
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case EdDSA:
+		return ed25519.Sign(k.ed25519, input), nil
+	}
+
+	return nil, fmt.Errorf("jwt: unsupported algorithm %q", k.Algorithm)
+}
+
+func (k Key) verify(input, sig []byte) bool {
+	switch k.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case ES256:
+		if len(sig) != 64 {
+			return false
+		}
+
+		digest := sha256.Sum256(input)
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(&k.ecdsa.PublicKey, digest[:], r, s)
+	case EdDSA:
+		return ed25519.Verify(k.ed25519.Public().(ed25519.PublicKey), input, sig)
+	}
+
+	return false
+}
+
+// Verify checks the signature of the token with the key of its kid,
+// the exp claim, which is required, and the nbf claim when present.
+// It returns the claims. The alg of the header needs to be the one of
+// the key and the typ the one passed.
+func Verify(token, typ string, keys []Key, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalid
+	}
+
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil || !strings.EqualFold(h.Typ, typ) {
+		return nil, ErrInvalid
+	}
+
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	var key *Key
+	for i := range keys {
+		if keys[i].ID == h.Kid && keys[i].Algorithm == h.Alg {
+			key = &keys[i]
+			break
+		}
+	}
+
+	if key == nil || !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrInvalid
+	}
+
+	var claims map[string]any
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return nil, ErrInvalid
+	}
+
+	// Tokens without expiry are never accepted.
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, ErrInvalid
+	}
+
+	if now.Unix() >= int64(exp) {
+		return claims, ErrExpired
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return nil, ErrInvalid
+	}
+
+	return claims, nil
+}
+
+func decodeJSON(s string, v any) error {
+	b, err := enc.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// JWK is a public key of a JSON Web Key Set.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// Set returns the public keys of the asymmetric keys, HS256 secrets
+// are never published.
+func Set(keys []Key) []JWK {
+	set := []JWK{}
+	for _, k := range keys {
+		switch k.Algorithm {
+		case ES256:
+			x, y := make([]byte, 32), make([]byte, 32)
+			k.ecdsa.X.FillBytes(x)
+			k.ecdsa.Y.FillBytes(y)
+
+			set = append(set, JWK{Kty: "EC", Crv: "P-256", X: enc.EncodeToString(x), Y: enc.EncodeToString(y), Kid: k.ID, Alg: ES256, Use: "sig"})
+		case EdDSA:
+			pub := k.ed25519.Public().(ed25519.PublicKey)
+			set = append(set, JWK{Kty: "OKP", Crv: "Ed25519", X: enc.EncodeToString(pub), Kid: k.ID, Alg: EdDSA, Use: "sig"})
+		}
+	}
+
+	return set
+}
@@ -0,0 +1,565 @@
+// Package qr encodes text as QR codes (ISO/IEC 18004) in byte mode
+// with the medium error correction level, and renders them as SVG or
+// PNG images.
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// ErrTooLong is returned when the text does not fit in a QR code.
+var ErrTooLong = errors.New("qr: text too long")
+
+// quietZone is the number of light modules around the code.
+const quietZone = 4
+
+// Error correction codewords per block and number of blocks for each
+// version with the medium (M) error correction level.
+var (
+	eccPerBlock = [41]int{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	eccBlocks   = [41]int{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// Code is an encoded QR code.
+type Code struct {
+	// Size is the number of modules on each side.
+	Size int
+
+	modules  [][]bool
+	function [][]bool
+}
+
+// Encode returns the smallest QR code for the text, using the mask
+// with the lowest penalty.
+func Encode(text string) (*Code, error) {
+	for version := 1; version <= 40; version++ {
+		if len(text) <= capacity(version) {
+			return encode(text, version, -1), nil
+		}
+	}
+
+	return nil, ErrTooLong
+}
+
+// Black reports whether the module at x, y is dark.
+func (c *Code) Black(x, y int) bool {
+	return x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.modules[y][x]
+}
+
+// SVG renders the code as an SVG image, scale is the size in
+// pixels of each module.
+func (c *Code) SVG(scale int) []byte {
+	size := (c.Size + 2*quietZone) * scale
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %[1]d %[1]d" width="%[2]d" height="%[2]d" shape-rendering="crispEdges">`, c.Size+2*quietZone, size)
+	buf.WriteString(`<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="`)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// PNG renders the code as a PNG image, scale is the size in pixels
+// of each module.
+func (c *Code) PNG(scale int) []byte {
+	size := (c.Size + 2*quietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if c.Black(x/scale-quietZone, y/scale-quietZone) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	return buf.Bytes()
+}
+
+// capacity returns the number of bytes a version can hold.
+func capacity(version int) int {
+	bits := dataCodewords(version) * 8
+	bits -= 4 + countBits(version)
+
+	return bits / 8
+}
+
+// countBits is the length of the character count indicator.
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+
+	return 16
+}
+
+// encode builds the code for the text in the version, mask -1 picks
+// the mask with the lowest penalty.
+func encode(text string, version, mask int) *Code {
+	size := version*4 + 17
+	c := &Code{Size: size}
+	c.modules = make([][]bool, size)
+	c.function = make([][]bool, size)
+	for i := range c.modules {
+		c.modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+
+	c.drawFunctionPatterns(version)
+	c.drawCodewords(codewords(text, version))
+
+	if mask < 0 {
+		best := 0
+		for i := 0; i < 8; i++ {
+			c.applyMask(i)
+			c.drawFormat(i)
+			if p := c.penalty(); mask < 0 || p < best {
+				mask, best = i, p
+			}
+
+			c.applyMask(i)
+		}
+	}
+
+	c.applyMask(mask)
+	c.drawFormat(mask)
+
+	return c
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+// drawFunctionPatterns draws the finder, alignment and timing patterns
+// and the version information.
+func (c *Code) drawFunctionPatterns(version int) {
+	for i := 0; i < c.Size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+
+	for _, p := range [][2]int{{3, 3}, {c.Size - 4, 3}, {3, c.Size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := p[0]+dx, p[1]+dy
+				if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+					continue
+				}
+
+				d := max(abs(dx), abs(dy))
+				c.set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+
+	positions := alignmentPositions(version)
+	last := len(positions) - 1
+	for i, px := range positions {
+		for j, py := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(px+dx, py+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas, drawn with the mask.
+	c.drawFormat(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := c.Size-11+i%3, i/3
+			c.set(a, b, dark)
+			c.set(b, a, dark)
+		}
+	}
+}
+
+// drawFormat draws the error correction level and mask bits.
+func (c *Code) drawFormat(mask int) {
+	// The medium level is 00.
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.set(c.Size-1-i, 8, bit(i))
+	}
+
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(i))
+	}
+
+	c.set(8, c.Size-8, true)
+}
+
+// drawCodewords places the codewords in the zigzag order, from the
+// bottom right corner.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+
+				if c.function[y][x] || i >= len(data)*8 {
+					continue
+				}
+
+				c.modules[y][x] = data[i>>3]>>(7-i&7)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by the mask, applying
+// it twice removes it.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+
+			if invert && !c.function[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the code, masks with lower scores are easier to scan.
+func (c *Code) penalty() int {
+	score := 0
+	line := make([]bool, c.Size)
+	for _, horizontal := range []bool{true, false} {
+		for i := 0; i < c.Size; i++ {
+			for j := 0; j < c.Size; j++ {
+				if horizontal {
+					line[j] = c.modules[i][j]
+				} else {
+					line[j] = c.modules[j][i]
+				}
+			}
+
+			score += linePenalty(line)
+		}
+	}
+
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+
+			if x > 0 && y > 0 {
+				v := c.modules[y][x]
+				if v == c.modules[y-1][x] && v == c.modules[y][x-1] && v == c.modules[y-1][x-1] {
+					score += 3
+				}
+			}
+		}
+	}
+
+	total := c.Size * c.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	score += max(k, 0) * 10
+
+	return score
+}
+
+// linePenalty scores runs of five or more modules of the same color
+// and patterns looking like a finder in a row or column.
+func linePenalty(line []bool) int {
+	score := 0
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+
+		if run >= 5 {
+			score += 3 + run - 5
+		}
+
+		run = 1
+	}
+
+	// Light modules outside the code count for the finder patterns.
+	at := func(i int) bool { return i >= 0 && i < len(line) && line[i] }
+	pattern := []bool{true, false, true, true, true, false, true}
+	for i := -4; i < len(line); i++ {
+		match := true
+		for j, v := range pattern {
+			if at(i+j) != v {
+				match = false
+				break
+			}
+		}
+
+		if !match {
+			continue
+		}
+
+		before, after := true, true
+		for j := 1; j <= 4; j++ {
+			before = before && !at(i-j)
+			after = after && !at(i+6+j)
+		}
+
+		if before || after {
+			score += 40
+		}
+	}
+
+	return score
+}
+
+// codewords returns the data and error correction codewords for the
+// text, split in blocks and interleaved.
+func codewords(text string, version int) []byte {
+	capacity := dataCodewords(version)
+
+	var bits bitBuffer
+	bits.append(0b0100, 4)
+	bits.append(len(text), countBits(version))
+	for i := 0; i < len(text); i++ {
+		bits.append(int(text[i]), 8)
+	}
+
+	bits.append(0, min(4, capacity*8-bits.len))
+	bits.append(0, (8-bits.len%8)%8)
+
+	data := bits.bytes()
+	for pad := byte(0xEC); len(data) < capacity; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+
+	numBlocks := eccBlocks[version]
+	eccLen := eccPerBlock[version]
+	raw := rawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+	divisor := rsDivisor(eccLen)
+
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+
+		block := append([]byte{}, data[k:k+n]...)
+		k += n
+
+		ecc := rsRemainder(block, divisor)
+		if i < numShort {
+			block = append(block, 0)
+		}
+
+		blocks[i] = append(block, ecc...)
+	}
+
+	var result []byte
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			// Short blocks have a placeholder after their data.
+			if i != shortLen-eccLen || j >= numShort {
+				result = append(result, block[i])
+			}
+		}
+	}
+
+	return result
+}
+
+// dataCodewords is the number of data codewords of the version.
+func dataCodewords(version int) int {
+	return rawModules(version)/8 - eccPerBlock[version]*eccBlocks[version]
+}
+
+// rawModules is the number of modules available for codewords.
+func rawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+
+	return n
+}
+
+// alignmentPositions returns the centers of the alignment patterns.
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	n := version/7 + 2
+	step := (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	if version == 32 {
+		// The only version not following the formula.
+		step = 26
+	}
+
+	positions := make([]int, n)
+	positions[0] = 6
+	for i, pos := n-1, version*4+10; i > 0; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+
+	return positions
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the
+// degree, without the leading term.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+
+		root = gfMul(root, 0x02)
+	}
+
+	return result
+}
+
+// rsRemainder returns the error correction codewords for the data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+
+	return byte(z)
+}
+
+type bitBuffer struct {
+	data []byte
+	len  int
+}
+
+// append adds the n low bits of v, most significant first.
+func (b *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if b.len%8 == 0 {
+			b.data = append(b.data, 0)
+		}
+
+		if v>>i&1 == 1 {
+			b.data[b.len/8] |= 0x80 >> (b.len % 8)
+		}
+
+		b.len++
+	}
+}
+
+func (b *bitBuffer) bytes() []byte {
+	return b.data
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
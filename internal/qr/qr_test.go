@@ -0,0 +1,107 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestEncode(t *testing.T) {
+	t.Run("picks the smallest version", func(t *testing.T) {
+		c, err := Encode("maildoor")
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, 21, c.Size)
+
+		c, err = Encode(strings.Repeat("a", 100))
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, 6*4+17, c.Size)
+	})
+
+	t.Run("draws the finder patterns", func(t *testing.T) {
+		c, err := Encode("maildoor")
+		testhelpers.NoError(t, err)
+
+		for _, p := range [][2]int{{0, 0}, {c.Size - 7, 0}, {0, c.Size - 7}} {
+			testhelpers.True(t, c.Black(p[0], p[1]))
+			testhelpers.False(t, c.Black(p[0]+1, p[1]+1))
+			testhelpers.True(t, c.Black(p[0]+3, p[1]+3))
+		}
+	})
+
+	t.Run("text too long", func(t *testing.T) {
+		_, err := Encode(strings.Repeat("a", 3000))
+		testhelpers.Equals(t, ErrTooLong, err)
+	})
+
+	t.Run("renders images", func(t *testing.T) {
+		c, err := Encode("maildoor")
+		testhelpers.NoError(t, err)
+
+		svg := string(c.SVG(4))
+		testhelpers.Contains(t, svg, `viewBox="0 0 29 29"`)
+		testhelpers.Contains(t, svg, `width="116"`)
+
+		img, err := png.Decode(bytes.NewReader(c.PNG(2)))
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, 58, img.Bounds().Dx())
+	})
+}
+
+func TestReedSolomon(t *testing.T) {
+	// HELLO WORLD as version 1-M.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	ecc := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	testhelpers.Equals(t, ecc, rsRemainder(data, rsDivisor(len(ecc))))
+}
+
+// TestGolden compares the modules with the codes in testdata, generated
+// with an independent encoder. Each file has the text in the first line
+// and a row of modules per line, # for dark and . for light.
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.txt")
+	testhelpers.NoError(t, err)
+	testhelpers.True(t, len(files) > 0)
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			var version, mask int
+			_, err := fmt.Sscanf(filepath.Base(file), "v%d-mask%d.txt", &version, &mask)
+			testhelpers.NoError(t, err)
+
+			b, err := os.ReadFile(file)
+			testhelpers.NoError(t, err)
+
+			lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			text, rows := lines[0], lines[1:]
+
+			c := encode(text, version, mask)
+			testhelpers.Equals(t, len(rows), c.Size)
+			for y, row := range rows {
+				var got strings.Builder
+				for x := 0; x < c.Size; x++ {
+					if c.Black(x, y) {
+						got.WriteByte('#')
+					} else {
+						got.WriteByte('.')
+					}
+				}
+
+				if got.String() != row {
+					t.Fatalf("row %d: expected\n%s\ngot\n%s", y, row, got.String())
+				}
+			}
+
+			// Encode picks the same version for the text.
+			auto, err := Encode(text)
+			testhelpers.NoError(t, err)
+			testhelpers.Equals(t, c.Size, auto.Size)
+		})
+	}
+}
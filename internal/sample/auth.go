@@ -18,12 +18,13 @@ import (
 // and after login function
 var Auth = maildoor.New(
 	maildoor.Prefix("/auth/"),
+	maildoor.BaseURL("http://localhost:3000"),
 	maildoor.Icon("https://raw.githubusercontent.com/wawandco/maildoor/5de0561/internal/sample/logo.png"),
 	maildoor.Logo("https://raw.githubusercontent.com/wawandco/maildoor/5de0561/internal/sample/logo.png"),
 	maildoor.ProductName("Basse"),
 	maildoor.EmailValidator(validateEmail),
 	maildoor.AfterLogin(afterLogin),
-	maildoor.EmailSender(sendEmail),
+	maildoor.MessageSender(sendEmail),
 	maildoor.Logout(logout),
 )
 
@@ -44,18 +45,18 @@ var mtmpl string
 var emailTmpl = template.Must(template.New("email").Parse(mtmpl))
 
 // sendEmail function to send the multipart email to the user
-func sendEmail(to, html, txt string) error {
+func sendEmail(msg maildoor.Message) error {
 	from := os.Getenv("SMTP_FROM")
 	password := os.Getenv("SMTP_PASS")
 	user := os.Getenv("SMTP_USER")
 
 	mb := bytes.NewBuffer([]byte{})
 	err := emailTmpl.Execute(mb, email{
-		HTML:    html,
-		Text:    txt,
+		HTML:    msg.HTML,
+		Text:    msg.Text,
 		From:    from,
-		To:      to,
-		Subject: "Your authentication code",
+		To:      msg.To,
+		Subject: msg.Subject,
 	})
 
 	if err != nil {
@@ -63,7 +64,7 @@ func sendEmail(to, html, txt string) error {
 	}
 
 	auth := smtp.PlainAuth("", user, password, "smtp.resend.com")
-	err = smtp.SendMail("smtp.resend.com:587", auth, from, []string{to}, mb.Bytes())
+	err = smtp.SendMail("smtp.resend.com:587", auth, from, []string{msg.To}, mb.Bytes())
 	if err != nil {
 		return fmt.Errorf("error sending smtp message: %w", err)
 	}
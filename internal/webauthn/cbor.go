@@ -0,0 +1,162 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrMalformed is returned when a response can't be decoded.
+var ErrMalformed = errors.New("webauthn: malformed data")
+
+// maxDepth limits the nesting of the decoded CBOR items.
+const maxDepth = 16
+
+// decodeCBOR decodes the first CBOR (RFC 8949) item in b and returns
+// it with the remaining bytes. Integers are decoded as int64, byte
+// strings as []byte, text strings as string, arrays as []any and maps
+// as map[any]any. Indefinite lengths are not supported since WebAuthn
+// requires the CTAP2 canonical encoding.
+func decodeCBOR(b []byte) (any, []byte, error) {
+	return decodeItem(b, 0)
+}
+
+func decodeItem(b []byte, depth int) (any, []byte, error) {
+	if depth > maxDepth {
+		return nil, nil, fmt.Errorf("%w: cbor nested too deep", ErrMalformed)
+	}
+
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end of cbor", ErrMalformed)
+	}
+
+	major, info := b[0]>>5, b[0]&0x1f
+	arg, rest, err := decodeArgument(info, b[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: cbor integer overflow", ErrMalformed)
+		}
+
+		return int64(arg), rest, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: cbor integer overflow", ErrMalformed)
+		}
+
+		return -1 - int64(arg), rest, nil
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end of cbor", ErrMalformed)
+		}
+
+		if major == 3 {
+			return string(rest[:arg]), rest[arg:], nil
+		}
+
+		return append([]byte{}, rest[:arg]...), rest[arg:], nil
+	case 4:
+		// Each item takes at least one byte.
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end of cbor", ErrMalformed)
+		}
+
+		items := make([]any, arg)
+		for i := range items {
+			items[i], rest, err = decodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		return items, rest, nil
+	case 5:
+		if arg > uint64(len(rest))/2 {
+			return nil, nil, fmt.Errorf("%w: unexpected end of cbor", ErrMalformed)
+		}
+
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var k, v any
+			k, rest, err = decodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported cbor map key", ErrMalformed)
+			}
+
+			v, rest, err = decodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			m[k] = v
+		}
+
+		return m, rest, nil
+	case 6:
+		// Tags are ignored, the tagged item is returned.
+		return decodeItem(rest, depth+1)
+	default:
+		switch info {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), rest, nil
+		case 27:
+			return math.Float64frombits(arg), rest, nil
+		}
+
+		return nil, nil, fmt.Errorf("%w: unsupported cbor simple value %d", ErrMalformed, info)
+	}
+}
+
+// decodeArgument reads the argument of the item head.
+func decodeArgument(info byte, b []byte) (uint64, []byte, error) {
+	var n int
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24:
+		n = 1
+	case info == 25:
+		n = 2
+	case info == 26:
+		n = 4
+	case info == 27:
+		n = 8
+	default:
+		return 0, nil, fmt.Errorf("%w: unsupported cbor length", ErrMalformed)
+	}
+
+	if len(b) < n {
+		return 0, nil, fmt.Errorf("%w: unexpected end of cbor", ErrMalformed)
+	}
+
+	var arg uint64
+	switch n {
+	case 1:
+		arg = uint64(b[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(b))
+	case 8:
+		arg = binary.BigEndian.Uint64(b)
+	}
+
+	return arg, b[n:], nil
+}
@@ -0,0 +1,60 @@
+package webauthn
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// Examples from RFC 8949, appendix A.
+	for _, tc := range []struct {
+		hex  string
+		want any
+	}{
+		{"00", int64(0)},
+		{"1864", int64(100)},
+		{"1a000f4240", int64(1000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+	} {
+		b, _ := hex.DecodeString(tc.hex)
+		v, rest, err := decodeCBOR(b)
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, tc.want, v)
+		testhelpers.Equals(t, 0, len(rest))
+	}
+
+	t.Run("returns the remaining bytes", func(t *testing.T) {
+		v, rest, err := decodeCBOR([]byte{0x01, 0x02})
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, int64(1), v)
+		testhelpers.Equals(t, []byte{0x02}, rest)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, h := range []string{
+			"",
+			"44010203",   // short byte string
+			"9f0102ff",   // indefinite array
+			"9b7fffffff", // huge array
+			"a1820102f5", // array key
+			"8181818181818181818181818181818181818100", // too deep
+		} {
+			b, _ := hex.DecodeString(h)
+			_, _, err := decodeCBOR(b)
+			testhelpers.True(t, errors.Is(err, ErrMalformed))
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms supported for the credential keys.
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// Algorithms are the supported algorithms in order of preference.
+var Algorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// ErrUnsupported is returned for keys, algorithms or attestation
+// formats that are not supported.
+var ErrUnsupported = errors.New("webauthn: unsupported")
+
+// COSE key parameters (RFC 9053).
+const (
+	coseKty = 1
+	coseAlg = 3
+
+	coseCrv = -1
+	coseX   = -2
+	coseY   = -3
+	coseN   = -1
+	coseE   = -2
+
+	ktyOKP = 1
+	ktyEC2 = 2
+	ktyRSA = 3
+
+	crvP256    = 1
+	crvEd25519 = 6
+)
+
+// PublicKey is a credential public key.
+type PublicKey struct {
+	Algorithm int64
+
+	key crypto.PublicKey
+}
+
+// ParsePublicKey parses the COSE encoded public key at the start of b
+// and returns the remaining bytes.
+func ParsePublicKey(b []byte) (PublicKey, []byte, error) {
+	v, rest, err := decodeCBOR(b)
+	if err != nil {
+		return PublicKey{}, nil, err
+	}
+
+	m, ok := v.(map[any]any)
+	if !ok {
+		return PublicKey{}, nil, fmt.Errorf("%w: cose key is not a map", ErrMalformed)
+	}
+
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+	k := PublicKey{Algorithm: alg}
+
+	switch {
+	case kty == ktyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != crvP256 || len(x) != 32 || len(y) != 32 {
+			return PublicKey{}, nil, fmt.Errorf("%w: invalid P-256 key", ErrMalformed)
+		}
+
+		// ecdh validates the point is on the curve.
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return PublicKey{}, nil, fmt.Errorf("%w: invalid P-256 key", ErrMalformed)
+		}
+
+		k.key = &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+	case kty == ktyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != crvEd25519 || len(x) != ed25519.PublicKeySize {
+			return PublicKey{}, nil, fmt.Errorf("%w: invalid Ed25519 key", ErrMalformed)
+		}
+
+		k.key = ed25519.PublicKey(x)
+	case kty == ktyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseN)].([]byte)
+		e, _ := m[int64(coseE)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return PublicKey{}, nil, fmt.Errorf("%w: invalid RSA key", ErrMalformed)
+		}
+
+		k.key = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	default:
+		return PublicKey{}, nil, fmt.Errorf("%w: key type %d with algorithm %d", ErrUnsupported, kty, alg)
+	}
+
+	return k, rest, nil
+}
+
+// Verify checks the signature of the data with the key.
+func (k PublicKey) Verify(data, sig []byte) error {
+	digest := sha256.Sum256(data)
+
+	var ok bool
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, data, sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: invalid signature", ErrVerification)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+// Package webauthn verifies the responses of the WebAuthn registration
+// and authentication ceremonies (https://www.w3.org/TR/webauthn-2/).
+// Only the "none" attestation format is supported, authenticators are
+// trusted for the keys they create.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrVerification is returned when a response doesn't match the
+// ceremony, e.g. the challenge, origin or signature are wrong.
+var ErrVerification = errors.New("webauthn: verification failed")
+
+// Authenticator data flags.
+const (
+	FlagUserPresent  byte = 0x01
+	FlagUserVerified byte = 0x04
+	FlagAttested     byte = 0x40
+	FlagExtensions   byte = 0x80
+)
+
+// Ceremony is what the relying party expects from a response.
+type Ceremony struct {
+	// Challenge sent to the browser.
+	Challenge []byte
+
+	// Origin of the page, e.g. https://example.com.
+	Origin string
+
+	// RPID is the relying party id, the host of the origin.
+	RPID string
+}
+
+// Registration is a credential created by the registration ceremony.
+type Registration struct {
+	CredentialID []byte
+
+	// PublicKey is the COSE encoding of the credential key.
+	PublicKey []byte
+
+	SignCount    uint32
+	UserVerified bool
+}
+
+// Assertion is the result of the authentication ceremony.
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+// clientData is the client data JSON signed by the authenticator.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is the parsed authenticator data.
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// Set when the FlagAttested flag is set.
+	credentialID []byte
+	publicKey    []byte
+}
+
+// VerifyRegistration verifies the response of navigator.credentials.create
+// for the ceremony and returns the new credential.
+func VerifyRegistration(c Ceremony, clientDataJSON, attestationObject []byte) (Registration, error) {
+	if err := c.verifyClientData(clientDataJSON, "webauthn.create"); err != nil {
+		return Registration{}, err
+	}
+
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return Registration{}, err
+	}
+
+	obj, ok := v.(map[any]any)
+	if !ok {
+		return Registration{}, fmt.Errorf("%w: attestation object is not a map", ErrMalformed)
+	}
+
+	if format, _ := obj["fmt"].(string); format != "none" {
+		return Registration{}, fmt.Errorf("%w: attestation format %q", ErrUnsupported, format)
+	}
+
+	if stmt, _ := obj["attStmt"].(map[any]any); len(stmt) != 0 {
+		return Registration{}, fmt.Errorf("%w: none attestation with a statement", ErrMalformed)
+	}
+
+	raw, _ := obj["authData"].([]byte)
+	data, err := c.verifyAuthenticatorData(raw)
+	if err != nil {
+		return Registration{}, err
+	}
+
+	if data.flags&FlagAttested == 0 {
+		return Registration{}, fmt.Errorf("%w: no attested credential", ErrVerification)
+	}
+
+	return Registration{
+		CredentialID: data.credentialID,
+		PublicKey:    data.publicKey,
+		SignCount:    data.signCount,
+		UserVerified: data.flags&FlagUserVerified != 0,
+	}, nil
+}
+
+// VerifyAssertion verifies the response of navigator.credentials.get for
+// the ceremony with the COSE encoded public key of the credential.
+func VerifyAssertion(c Ceremony, publicKey, clientDataJSON, authData, signature []byte) (Assertion, error) {
+	if err := c.verifyClientData(clientDataJSON, "webauthn.get"); err != nil {
+		return Assertion{}, err
+	}
+
+	data, err := c.verifyAuthenticatorData(authData)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	key, _, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	hash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), hash[:]...)
+	if err := key.Verify(signed, signature); err != nil {
+		return Assertion{}, err
+	}
+
+	return Assertion{
+		SignCount:    data.signCount,
+		UserVerified: data.flags&FlagUserVerified != 0,
+	}, nil
+}
+
+// verifyClientData checks the type, challenge and origin of the client data.
+func (c Ceremony) verifyClientData(b []byte, typ string) error {
+	var data clientData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return fmt.Errorf("%w: client data: %v", ErrMalformed, err)
+	}
+
+	if data.Type != typ {
+		return fmt.Errorf("%w: client data type %q", ErrVerification, data.Type)
+	}
+
+	challenge, err := base64.RawURLEncoding.DecodeString(data.Challenge)
+	if err != nil || len(c.Challenge) == 0 || !bytes.Equal(challenge, c.Challenge) {
+		return fmt.Errorf("%w: challenge mismatch", ErrVerification)
+	}
+
+	if data.Origin != c.Origin {
+		return fmt.Errorf("%w: origin %q", ErrVerification, data.Origin)
+	}
+
+	return nil
+}
+
+// verifyAuthenticatorData parses the authenticator data and checks it
+// is for the relying party and the user was present.
+func (c Ceremony) verifyAuthenticatorData(b []byte) (authenticatorData, error) {
+	if len(b) < 37 {
+		return authenticatorData{}, fmt.Errorf("%w: authenticator data too short", ErrMalformed)
+	}
+
+	data := authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(data.rpIDHash, rpIDHash[:]) {
+		return authenticatorData{}, fmt.Errorf("%w: relying party mismatch", ErrVerification)
+	}
+
+	if data.flags&FlagUserPresent == 0 {
+		return authenticatorData{}, fmt.Errorf("%w: user not present", ErrVerification)
+	}
+
+	if data.flags&FlagAttested == 0 {
+		return data, nil
+	}
+
+	// Attested credential data: AAGUID, id length, id and COSE key.
+	rest := b[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, fmt.Errorf("%w: attested credential too short", ErrMalformed)
+	}
+
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if n == 0 || len(rest) < n {
+		return authenticatorData{}, fmt.Errorf("%w: invalid credential id", ErrMalformed)
+	}
+
+	data.credentialID = append([]byte{}, rest[:n]...)
+	rest = rest[n:]
+
+	_, after, err := ParsePublicKey(rest)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+
+	data.publicKey = append([]byte{}, rest[:len(rest)-len(after)]...)
+	if data.flags&FlagExtensions == 0 && len(after) > 0 {
+		return authenticatorData{}, fmt.Errorf("%w: trailing authenticator data", ErrMalformed)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,68 @@
+package webauthn_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/wawandco/maildoor/internal/testhelpers"
+	"github.com/wawandco/maildoor/internal/webauthn"
+	"github.com/wawandco/maildoor/internal/webauthn/webauthntest"
+)
+
+func TestCeremonies(t *testing.T) {
+	ceremony := webauthn.Ceremony{
+		Challenge: []byte("0123456789abcdef0123456789abcdef"),
+		Origin:    "https://example.com",
+		RPID:      "example.com",
+	}
+
+	register := func(a *webauthntest.Authenticator, challenge []byte) (webauthn.Registration, error) {
+		clientData, attestation := a.Create(challenge)
+		return webauthn.VerifyRegistration(ceremony, clientData, attestation)
+	}
+
+	for name, a := range map[string]*webauthntest.Authenticator{
+		"ES256": webauthntest.New("https://example.com", "example.com"),
+		"EdDSA": webauthntest.NewEd25519("https://example.com", "example.com"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			reg, err := register(a, ceremony.Challenge)
+			testhelpers.NoError(t, err)
+			testhelpers.Equals(t, a.CredentialID, reg.CredentialID)
+			testhelpers.Equals(t, a.PublicKey(), reg.PublicKey)
+			testhelpers.True(t, reg.UserVerified)
+
+			clientData, authData, sig := a.Get(ceremony.Challenge)
+			assertion, err := webauthn.VerifyAssertion(ceremony, reg.PublicKey, clientData, authData, sig)
+			testhelpers.NoError(t, err)
+			testhelpers.Equals(t, uint32(1), assertion.SignCount)
+
+			sig[len(sig)-1] ^= 0xff
+			_, err = webauthn.VerifyAssertion(ceremony, reg.PublicKey, clientData, authData, sig)
+			testhelpers.True(t, errors.Is(err, webauthn.ErrVerification))
+		})
+	}
+
+	t.Run("rejects other challenges, origins and relying parties", func(t *testing.T) {
+		for _, a := range []*webauthntest.Authenticator{
+			webauthntest.New("https://evil.com", "example.com"),
+			webauthntest.New("https://example.com", "evil.com"),
+		} {
+			_, err := register(a, ceremony.Challenge)
+			testhelpers.True(t, errors.Is(err, webauthn.ErrVerification))
+		}
+
+		a := webauthntest.New("https://example.com", "example.com")
+		_, err := register(a, []byte("other"))
+		testhelpers.True(t, errors.Is(err, webauthn.ErrVerification))
+
+		// An assertion can't be used to register.
+		clientData, authData, sig := a.Get(ceremony.Challenge)
+		_, err = webauthn.VerifyRegistration(ceremony, clientData, authData)
+		testhelpers.True(t, errors.Is(err, webauthn.ErrVerification))
+
+		// Other keys didn't sign it.
+		_, err = webauthn.VerifyAssertion(ceremony, webauthntest.New("", "").PublicKey(), clientData, authData, sig)
+		testhelpers.True(t, errors.Is(err, webauthn.ErrVerification))
+	})
+}
@@ -0,0 +1,174 @@
+// Package webauthntest provides a software authenticator to test the
+// WebAuthn ceremonies without a browser.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+)
+
+// Authenticator creates credentials and signs assertions like a
+// platform authenticator with the "none" attestation.
+type Authenticator struct {
+	Origin string
+	RPID   string
+
+	CredentialID []byte
+	SignCount    uint32
+
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+// New returns an authenticator with an ES256 (P-256) key.
+func New(origin, rpID string) *Authenticator {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return &Authenticator{Origin: origin, RPID: rpID, CredentialID: randomID(), ecdsa: key}
+}
+
+// NewEd25519 returns an authenticator with an EdDSA (Ed25519) key.
+func NewEd25519(origin, rpID string) *Authenticator {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	return &Authenticator{Origin: origin, RPID: rpID, CredentialID: randomID(), ed25519: key}
+}
+
+// Create returns the client data JSON and attestation object for the
+// registration challenge.
+func (a *Authenticator) Create(challenge []byte) ([]byte, []byte) {
+	cdj := a.clientData("webauthn.create", challenge)
+
+	authData := a.authData(0x01 | 0x04 | 0x40)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.CredentialID)))
+	authData = append(authData, a.CredentialID...)
+	authData = append(authData, a.PublicKey()...)
+
+	return cdj, encode(pairs{
+		{"fmt", "none"},
+		{"attStmt", pairs{}},
+		{"authData", authData},
+	})
+}
+
+// Get returns the client data JSON, authenticator data and signature
+// for the authentication challenge, it increments the sign count.
+func (a *Authenticator) Get(challenge []byte) ([]byte, []byte, []byte) {
+	a.SignCount++
+
+	cdj := a.clientData("webauthn.get", challenge)
+	authData := a.authData(0x01 | 0x04)
+
+	hash := sha256.Sum256(cdj)
+	signed := append(append([]byte{}, authData...), hash[:]...)
+
+	return cdj, authData, a.sign(signed)
+}
+
+// PublicKey returns the COSE encoding of the credential key.
+func (a *Authenticator) PublicKey() []byte {
+	if a.ed25519 != nil {
+		return encode(pairs{
+			{1, 1},
+			{3, -8},
+			{-1, 6},
+			{-2, []byte(a.ed25519.Public().(ed25519.PublicKey))},
+		})
+	}
+
+	pub := a.ecdsa.PublicKey
+	return encode(pairs{
+		{1, 2},
+		{3, -7},
+		{-1, 1},
+		{-2, pub.X.FillBytes(make([]byte, 32))},
+		{-3, pub.Y.FillBytes(make([]byte, 32))},
+	})
+}
+
+func (a *Authenticator) sign(data []byte) []byte {
+	if a.ed25519 != nil {
+		return ed25519.Sign(a.ed25519, data)
+	}
+
+	hash := sha256.Sum256(data)
+	sig, _ := ecdsa.SignASN1(rand.Reader, a.ecdsa, hash[:])
+
+	return sig
+}
+
+func (a *Authenticator) clientData(typ string, challenge []byte) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"type":        typ,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+
+	return b
+}
+
+func (a *Authenticator) authData(flags byte) []byte {
+	hash := sha256.Sum256([]byte(a.RPID))
+	b := append(hash[:], flags)
+
+	return binary.BigEndian.AppendUint32(b, a.SignCount)
+}
+
+func randomID() []byte {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return id
+}
+
+// pairs is a CBOR map keeping the order of its keys.
+type pairs []struct {
+	key   any
+	value any
+}
+
+// encode returns the CBOR encoding of ints, strings, byte strings
+// and maps.
+func encode(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case pairs:
+		b := head(5, uint64(len(v)))
+		for _, p := range v {
+			b = append(b, encode(p.key)...)
+			b = append(b, encode(p.value)...)
+		}
+
+		return b
+	}
+
+	panic("webauthntest: unsupported cbor value")
+}
@@ -0,0 +1,303 @@
+package maildoor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	// invitationKey is the context key of the accepted invitation.
+	invitationKey contextKey = "invitation"
+
+	// defaultInviteTTL is the time invitations are valid for.
+	defaultInviteTTL = 7 * 24 * time.Hour
+)
+
+var (
+	// ErrInvalidInvite is returned for invitation tokens that are not
+	// valid, expired, were revoked or already accepted.
+	ErrInvalidInvite = errors.New("maildoor: invalid or expired invitation")
+
+	errInvitesDisabled = errors.New("maildoor: invitations are not enabled, see Invitations")
+)
+
+// Invitation is an invite to sign in sent by SendInvite, it is signed
+// into the link of the invitation email.
+type Invitation struct {
+	// ID identifies the invitation to revoke it, set by SendInvite.
+	ID string `json:"id"`
+
+	// Email is the invited email, EmailValidator is not run for it.
+	Email string `json:"email"`
+
+	// Inviter is who sent the invitation (e.g. the admin name or
+	// email), it is shown in the email and the invitation page.
+	Inviter string `json:"inviter,omitempty"`
+
+	// Role and Metadata are passed back to OnInviteAccepted.
+	Role     string            `json:"role,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Tenant is the ID of the tenant of the inviter request, set by
+	// SendInvite. The invitation can only be accepted with it.
+	Tenant string `json:"tenant,omitempty"`
+
+	// ExpiresAt is set by SendInvite from the invitations TTL.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// invites signs the invitation tokens and remembers the ones that were
+// accepted or revoked in the nonce cache.
+type invites struct {
+	key    []byte
+	ttl    time.Duration
+	nonces NonceCache
+
+	subject *texttemplate.Template
+	html    *template.Template
+	text    *texttemplate.Template
+}
+
+func newInvites(secret []byte, ttl time.Duration, nonces NonceCache) (*invites, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("the secret must be at least 32 bytes")
+	}
+
+	if ttl <= 0 {
+		ttl = defaultInviteTTL
+	}
+
+	// Without a cache shared by the instances invitations could be
+	// accepted once per instance and revocations would be lost.
+	if nonces == nil {
+		return nil, errors.New("UsedNonces is required, pass a shared NonceCache (NewInMemoryNonceCache when running a single instance)")
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("maildoor invitation"))
+
+	return &invites{key: mac.Sum(nil), ttl: ttl, nonces: nonces}, nil
+}
+
+// token signs the invitation.
+func (s *invites) token(inv Invitation) (string, error) {
+	payload, err := json.Marshal(inv)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(s.sign(payload)), nil
+}
+
+// open returns the invitation of the token when its signature is valid,
+// it was sent by the tenant and it didn't expire, nor was accepted or
+// revoked.
+func (s *invites) open(token, tenant string) (Invitation, error) {
+	var inv Invitation
+
+	p, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return inv, ErrInvalidInvite
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return inv, ErrInvalidInvite
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.sign(payload)) {
+		return inv, ErrInvalidInvite
+	}
+
+	if err := json.Unmarshal(payload, &inv); err != nil {
+		return inv, ErrInvalidInvite
+	}
+
+	if inv.Tenant != tenant || time.Now().After(inv.ExpiresAt) || s.nonces.Used(nonceOf(inv)) {
+		return inv, ErrInvalidInvite
+	}
+
+	return inv, nil
+}
+
+// use marks the invitation as used, it returns false when it was
+// already accepted or revoked.
+func (s *invites) use(inv Invitation) bool {
+	return s.nonces.Use(nonceOf(inv), inv.ExpiresAt)
+}
+
+func (s *invites) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+// nonceOf keeps the invitation ids apart from the stateless code
+// nonces when they share the cache.
+func nonceOf(inv Invitation) string {
+	return "invite:" + inv.ID
+}
+
+// parseInviteTemplates parses the invitation email templates from the
+// FS, files not present fall back to the login email templates.
+func (m *maildoor) parseInviteTemplates(fsys fs.FS) error {
+	m.invites.subject, m.invites.html, m.invites.text = m.emailSubject, m.emailHTML, m.emailText
+	if fsys == nil {
+		return nil
+	}
+
+	if b, err := fs.ReadFile(fsys, "subject.txt"); err == nil {
+		if m.invites.subject, err = texttemplate.New("subject.txt").Parse(string(b)); err != nil {
+			return err
+		}
+	}
+
+	if b, err := fs.ReadFile(fsys, "message.txt"); err == nil {
+		if m.invites.text, err = texttemplate.New("message.txt").Parse(string(b)); err != nil {
+			return err
+		}
+	}
+
+	if b, err := fs.ReadFile(fsys, "message.html"); err == nil {
+		if m.invites.html, err = template.New("message.html").Parse(string(b)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// formInviteToken returns the invitation token posted with the form.
+func (m *maildoor) formInviteToken(r *http.Request) string {
+	if m.invites == nil {
+		return ""
+	}
+
+	return r.FormValue("invite")
+}
+
+// formInvite returns the invitation of the invite form value, it is
+// posted along the email and the code while accepting it.
+func (m *maildoor) formInvite(r *http.Request) (Invitation, bool) {
+	token := m.formInviteToken(r)
+	if token == "" {
+		return Invitation{}, false
+	}
+
+	inv, err := m.invites.open(token, m.tenant(r).ID)
+	return inv, err == nil
+}
+
+// invited returns true when the request carries a valid invitation
+// for the email.
+func (m *maildoor) invited(r *http.Request, email string) bool {
+	inv, ok := m.formInvite(r)
+	return ok && inv.Email == email
+}
+
+// acceptInvite marks the invitation as used once its email was
+// verified, it renders the code page with the error and returns false
+// when it was already accepted or revoked.
+func (m *maildoor) acceptInvite(w http.ResponseWriter, r *http.Request, inv Invitation) bool {
+	if !m.invites.use(inv) {
+		m.renderCodeError(w, r, inv.Email, "error.invalid_invite")
+		return false
+	}
+
+	m.emit(r, EventInviteAccepted, inv.Email, nil)
+	return true
+}
+
+// InvitationFrom returns the invitation accepted by the user, it is
+// available in the OnInviteAccepted and AfterLogin hooks.
+func InvitationFrom(r *http.Request) (Invitation, bool) {
+	inv, ok := r.Context().Value(invitationKey).(Invitation)
+	return inv, ok
+}
+
+// SendInvite emails an invitation to sign in to inv.Email with the
+// invitation templates, the link in it verifies the email with a code
+// and calls OnInviteAccepted. The request is the one of the inviter,
+// used for the tenant, the links (unless BaseURL is set) and the email
+// language.
+// It returns the invitation with its ID and ExpiresAt, keep them to
+// revoke it with RevokeInvite.
+func SendInvite(auth http.Handler, r *http.Request, inv Invitation) (Invitation, error) {
+	m, ok := auth.(*maildoor)
+	if !ok || m.invites == nil {
+		return inv, errInvitesDisabled
+	}
+
+	email, err := m.normalizeEmail(inv.Email)
+	if err != nil {
+		return inv, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return inv, err
+	}
+
+	inv.ID = hex.EncodeToString(id)
+	inv.Email = email
+	inv.Tenant = m.tenant(r).ID
+	inv.ExpiresAt = time.Now().Add(m.invites.ttl).Truncate(time.Second)
+
+	token, err := m.invites.token(inv)
+	if err != nil {
+		return inv, err
+	}
+
+	data := m.emailData(r, email, "", "")
+	data.Invitation = &inv
+	data.IP, data.Location = "", ""
+	data.MagicLink = m.link(r, "/invite", url.Values{"token": {token}})
+	data.ExpiresIn = m.invites.ttl
+	data.ExpiresAt = inv.ExpiresAt
+
+	_, span := m.startSpan(r, "maildoor.render_email", email)
+	subject, html, txt, err := executeMail(m.invites.subject, m.invites.html, m.invites.text, data)
+	endSpan(span, err)
+	if err != nil {
+		return inv, err
+	}
+
+	_, span = m.startSpan(r, "maildoor.send_email", email)
+	err = m.tenant(r).MessageSender(Message{To: email, Subject: subject, HTML: html, Text: txt})
+	endSpan(span, err)
+
+	if err != nil {
+		m.emit(r, EventSendFailed, email, err)
+		return inv, err
+	}
+
+	m.emit(r, EventInviteSent, email, nil)
+	return inv, nil
+}
+
+// RevokeInvite invalidates the invitation so it can't be accepted, inv
+// needs the ID and ExpiresAt returned by SendInvite.
+func RevokeInvite(auth http.Handler, inv Invitation) error {
+	m, ok := auth.(*maildoor)
+	if !ok || m.invites == nil {
+		return errInvitesDisabled
+	}
+
+	m.invites.use(inv)
+	return nil
+}
@@ -0,0 +1,278 @@
+package maildoor_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"testing/fstest"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestInvitations(t *testing.T) {
+	var msgs []maildoor.Message
+	var accepted []maildoor.Invitation
+	var logins []string
+
+	auth := maildoor.New(
+		maildoor.BaseURL("http://example.com"),
+		maildoor.Invitations(bytes.Repeat([]byte("k"), 32), 0),
+		maildoor.UsedNonces(maildoor.NewInMemoryNonceCache()),
+		maildoor.EmailValidator(func(email string) error {
+			return errors.New("only invited emails")
+		}),
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			msgs = append(msgs, msg)
+			return nil
+		}),
+		maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+			logins = append(logins, maildoor.EmailFrom(r))
+		}),
+		maildoor.OnInviteAccepted(func(w http.ResponseWriter, r *http.Request, inv maildoor.Invitation) {
+			testhelpers.Equals(t, inv.Email, maildoor.EmailFrom(r))
+			accepted = append(accepted, inv)
+		}),
+	)
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	invite := func(email string) (maildoor.Invitation, string) {
+		inv, err := maildoor.SendInvite(auth, httptest.NewRequest("POST", "/admin/invites", nil), maildoor.Invitation{
+			Email:    email,
+			Inviter:  "Ana",
+			Role:     "admin",
+			Metadata: map[string]string{"team": "billing"},
+		})
+
+		testhelpers.NoError(t, err)
+
+		link := regexp.MustCompile(`https?://\S+`).FindString(msgs[len(msgs)-1].Text)
+		u, err := url.Parse(link)
+		testhelpers.NoError(t, err)
+
+		return inv, u.Query().Get("token")
+	}
+
+	inv, token := invite("A@B.com")
+	testhelpers.Equals(t, "A@b.com", inv.Email)
+	testhelpers.NotEquals(t, "", inv.ID)
+	testhelpers.Equals(t, "You're invited to Maildoor", msgs[0].Subject)
+	testhelpers.Contains(t, msgs[0].Text, "Ana invited you to join Maildoor.")
+	testhelpers.NotContains(t, msgs[0].Text, "Code:")
+
+	w := httptest.NewRecorder()
+	auth.ServeHTTP(w, httptest.NewRequest("GET", "/invite?token="+token, nil))
+	testhelpers.Equals(t, http.StatusOK, w.Code)
+	testhelpers.Contains(t, w.Body.String(), "Ana invited you to Maildoor as")
+	testhelpers.Contains(t, w.Body.String(), `name="invite" value="`+token+`"`)
+
+	// The validator is not run for the invited email.
+	form := url.Values{"email": {"A@b.com"}, "invite": {token}}
+	w = post("/email", form)
+	testhelpers.Equals(t, http.StatusOK, w.Code)
+	testhelpers.Contains(t, w.Body.String(), `name="invite" value="`+token+`"`)
+
+	form.Set("code", regexp.MustCompile(`\b\d{6}\b`).FindString(msgs[len(msgs)-1].Text))
+	post("/code", form)
+	testhelpers.Equals(t, 1, len(accepted))
+	testhelpers.Equals(t, "admin", accepted[0].Role)
+	testhelpers.Equals(t, "billing", accepted[0].Metadata["team"])
+	testhelpers.Equals(t, 0, len(logins))
+
+	t.Run("invitations are accepted once", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/invite?token="+token, nil))
+		testhelpers.Equals(t, http.StatusGone, w.Code)
+
+		w = post("/email", url.Values{"email": {"A@b.com"}, "invite": {token}})
+		testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+	})
+
+	t.Run("revoked invitations", func(t *testing.T) {
+		inv, token := invite("c@d.com")
+		testhelpers.NoError(t, maildoor.RevokeInvite(auth, inv))
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/invite?token="+token, nil))
+		testhelpers.Equals(t, http.StatusGone, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "This invitation expired, was revoked or was already accepted")
+	})
+
+	t.Run("tampered invitations", func(t *testing.T) {
+		_, token := invite("e@f.com")
+
+		w := post("/email", url.Values{"email": {"g@h.com"}, "invite": {token}})
+		testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+
+		w = httptest.NewRecorder()
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/invite?token=x"+token, nil))
+		testhelpers.Equals(t, http.StatusGone, w.Code)
+	})
+
+	t.Run("requires Invitations", func(t *testing.T) {
+		_, err := maildoor.SendInvite(maildoor.New(), httptest.NewRequest("GET", "/", nil), maildoor.Invitation{Email: "a@b.com"})
+		testhelpers.Error(t, err)
+	})
+}
+
+func TestInvitationsCompleteTheLogin(t *testing.T) {
+	var msgs []maildoor.Message
+	var pairs []maildoor.TokenPair
+
+	auth := maildoor.New(
+		maildoor.BaseURL("http://example.com"),
+		maildoor.Invitations(bytes.Repeat([]byte("k"), 32), 0),
+		maildoor.UsedNonces(maildoor.NewInMemoryNonceCache()),
+		maildoor.JWT(nil, maildoor.HS256Key("hs", bytes.Repeat([]byte("s"), 32))),
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			msgs = append(msgs, msg)
+			return nil
+		}),
+		maildoor.OnInviteAccepted(func(w http.ResponseWriter, r *http.Request, inv maildoor.Invitation) {
+			pair, ok := maildoor.TokensFrom(r)
+			testhelpers.True(t, ok)
+			pairs = append(pairs, pair)
+		}),
+	)
+
+	_, err := maildoor.SendInvite(auth, httptest.NewRequest("POST", "/admin/invites", nil), maildoor.Invitation{Email: "a@b.com"})
+	testhelpers.NoError(t, err)
+
+	link, err := url.Parse(regexp.MustCompile(`https?://\S+`).FindString(msgs[0].Text))
+	testhelpers.NoError(t, err)
+
+	form := url.Values{"email": {"a@b.com"}, "invite": {link.Query().Get("token")}}
+	req := httptest.NewRequest("POST", "/email", nil)
+	req.Form = form
+	auth.ServeHTTP(httptest.NewRecorder(), req)
+
+	form.Set("code", regexp.MustCompile(`\b\d{6}\b`).FindString(msgs[1].Text))
+	req = httptest.NewRequest("POST", "/code", nil)
+	req.Form = form
+
+	auth.ServeHTTP(httptest.NewRecorder(), req)
+
+	testhelpers.Equals(t, 1, len(pairs))
+	testhelpers.NotEquals(t, "", pairs[0].AccessToken)
+}
+
+func TestInvitationsDropPendingAuthorizations(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var msgs []maildoor.Message
+	var accepted int
+	auth := maildoor.New(
+		maildoor.BaseURL("http://example.com"),
+		maildoor.Invitations(bytes.Repeat([]byte("k"), 32), 0),
+		maildoor.UsedNonces(maildoor.NewInMemoryNonceCache()),
+		maildoor.ResendCooldown(0),
+		maildoor.JWT(nil, maildoor.ES256Key("k1", key)),
+		maildoor.OIDC(maildoor.NewInMemoryClientRegistry(
+			maildoor.Client{ID: "web", Secret: "s3cret", RedirectURIs: []string{"https://app.example.com/callback"}},
+		)),
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			msgs = append(msgs, msg)
+			return nil
+		}),
+		maildoor.OnInviteAccepted(func(w http.ResponseWriter, r *http.Request, inv maildoor.Invitation) {
+			accepted++
+			http.Redirect(w, r, "/welcome", http.StatusSeeOther)
+		}),
+	)
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"web"},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid"},
+		"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		"code_challenge_method": {"S256"},
+	}
+
+	w := httptest.NewRecorder()
+	auth.ServeHTTP(w, httptest.NewRequest("GET", "/authorize?"+q.Encode(), nil))
+	pending := w.Result().Cookies()[0]
+
+	_, err := maildoor.SendInvite(auth, httptest.NewRequest("POST", "/admin/invites", nil), maildoor.Invitation{Email: "a@b.com"})
+	testhelpers.NoError(t, err)
+
+	link, err := url.Parse(regexp.MustCompile(`https?://\S+`).FindString(msgs[0].Text))
+	testhelpers.NoError(t, err)
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+		req.AddCookie(pending)
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	form := url.Values{"email": {"a@b.com"}, "invite": {link.Query().Get("token")}}
+	post("/email", form)
+
+	form.Set("code", regexp.MustCompile(`\b\d{6}\b`).FindString(msgs[1].Text))
+	w = post("/code", form)
+
+	testhelpers.Equals(t, 1, accepted)
+	testhelpers.Equals(t, "/welcome", w.Header().Get("Location"))
+
+	// The authorization was dropped, later logins don't complete it.
+	post("/email", url.Values{"email": {"a@b.com"}})
+	w = post("/code", url.Values{"email": {"a@b.com"}, "code": {regexp.MustCompile(`\b\d{6}\b`).FindString(msgs[2].Text)}})
+	testhelpers.NotContains(t, w.Header().Get("Location"), "app.example.com")
+}
+
+func TestInviteTemplates(t *testing.T) {
+	var msg maildoor.Message
+	auth := maildoor.New(
+		maildoor.BaseURL("http://example.com"),
+		maildoor.Invitations(bytes.Repeat([]byte("k"), 32), 0),
+		maildoor.UsedNonces(maildoor.NewInMemoryNonceCache()),
+		maildoor.InviteTemplates(fstest.MapFS{
+			"subject.txt": {Data: []byte("Join {{.Product}} as {{.Invitation.Role}}")},
+		}),
+		maildoor.MessageSender(func(m maildoor.Message) error {
+			msg = m
+			return nil
+		}),
+	)
+
+	_, err := maildoor.SendInvite(auth, httptest.NewRequest("GET", "/", nil), maildoor.Invitation{Email: "a@b.com", Role: "viewer"})
+	testhelpers.NoError(t, err)
+	testhelpers.Equals(t, "Join Maildoor as viewer", msg.Subject)
+	testhelpers.Contains(t, msg.Text, "Accept the invitation")
+}
+
+func TestInvitationsRequireUsedNonces(t *testing.T) {
+	defer func() {
+		err, _ := recover().(error)
+		testhelpers.NotNil(t, err)
+		testhelpers.Contains(t, err.Error(), "UsedNonces is required")
+	}()
+
+	maildoor.New(
+		maildoor.BaseURL("http://example.com"),
+		maildoor.Invitations(bytes.Repeat([]byte("k"), 32), 0),
+	)
+
+	t.Fatal("expected New to panic")
+}
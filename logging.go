@@ -0,0 +1,198 @@
+package maildoor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	requestIDKey contextKey = "request_id"
+	loggerKey    contextKey = "logger"
+)
+
+// defaultRequestIDHeader is the header the request id is taken
+// from and written to.
+const defaultRequestIDHeader = "X-Request-ID"
+
+// withRequestLogger adds the request id and a logger that includes it to
+// the request context. The id is taken from the request id header when
+// present and valid, otherwise a new one is generated.
+func (m *maildoor) withRequestLogger(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(m.requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+
+	w.Header().Set(m.requestIDHeader, id)
+	logger := m.logger.With("request_id", id)
+
+	ctx := context.WithValue(r.Context(), requestIDKey, id)
+	ctx = context.WithValue(ctx, loggerKey, logger)
+
+	return r.WithContext(ctx)
+}
+
+// validRequestID checks incoming request ids are short and printable
+// so they can't be used to inject content into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// RequestIDFrom returns the id maildoor assigned to the request.
+func RequestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// loggerFrom returns the request logger in the context or
+// the default logger when there is none.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return l
+	}
+
+	return slog.Default()
+}
+
+// logHandler logs the events of the flow with the request logger.
+type logHandler struct {
+	key emailKey
+}
+
+func (h logHandler) HandleEvent(ctx context.Context, e Event) {
+	level := slog.LevelInfo
+	if e.Outcome == OutcomeFailure {
+		level = slog.LevelWarn
+	}
+
+	attrs := []any{
+		"event", string(e.Type),
+		"outcome", string(e.Outcome),
+	}
+
+	if e.Email != "" {
+		attrs = append(attrs, "email_hash", h.key.hash(e.Email))
+	}
+
+	if e.Err != nil {
+		attrs = append(attrs, "error", e.Err.Error())
+	}
+
+	loggerFrom(ctx).Log(ctx, level, "maildoor event", attrs...)
+}
+
+// emailKey is the key of the HMAC the emails are hashed with in the
+// logs and spans, see EmailHashKey.
+type emailKey []byte
+
+// hash returns a short HMAC of the normalized email, it allows to
+// correlate the log lines of a user without logging the address.
+// Without the key the hash can't be reversed with a list of emails.
+func (k emailKey) hash(email string) string {
+	mac := hmac.New(sha256.New, k)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+
+	return hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// HashEmail returns the hash the auth handler logs for the email, e.g.
+// to find the log lines of a user.
+func HashEmail(auth http.Handler, email string) string {
+	m, ok := auth.(*maildoor)
+	if !ok {
+		return ""
+	}
+
+	return m.emailKey.hash(email)
+}
+
+// emailPattern matches things that look like email addresses.
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// redact replaces the email addresses in s with their hash.
+func (k emailKey) redact(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+
+	return emailPattern.ReplaceAllStringFunc(s, func(email string) string {
+		return "email:" + k.hash(email)
+	})
+}
+
+// redactHandler is a slog.Handler that replaces email addresses in
+// the messages and attributes with their hash before passing them to
+// the wrapped handler.
+type redactHandler struct {
+	slog.Handler
+	key emailKey
+}
+
+func (h redactHandler) Handle(ctx context.Context, rec slog.Record) error {
+	nr := slog.NewRecord(rec.Time, rec.Level, h.key.redact(rec.Message), rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		nr.AddAttrs(h.key.redactAttr(a))
+		return true
+	})
+
+	return h.Handler.Handle(ctx, nr)
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.key.redactAttr(a)
+	}
+
+	return redactHandler{h.Handler.WithAttrs(redacted), h.key}
+}
+
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{h.Handler.WithGroup(name), h.key}
+}
+
+func (k emailKey) redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, k.redact(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]any, len(attrs))
+		for i, ga := range attrs {
+			redacted[i] = k.redactAttr(ga)
+		}
+
+		return slog.Group(a.Key, redacted...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, k.redact(err.Error()))
+		}
+	}
+
+	return slog.Attr{Key: a.Key, Value: v}
+}
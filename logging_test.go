@@ -0,0 +1,118 @@
+package maildoor_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestLogging(t *testing.T) {
+	logs := func(buf *bytes.Buffer) []map[string]any {
+		var lines []map[string]any
+		for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			line := map[string]any{}
+			json.Unmarshal([]byte(l), &line)
+			lines = append(lines, line)
+		}
+
+		return lines
+	}
+
+	t.Run("request ids and redacted emails", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		auth := maildoor.New(
+			maildoor.Logger(slog.New(slog.NewJSONHandler(buf, nil))),
+			maildoor.EmailValidator(func(email string) error {
+				return errors.New(email + " is not allowed")
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {"Someone@Example.com"}}
+		auth.ServeHTTP(w, req)
+
+		id := w.Header().Get("X-Request-ID")
+		testhelpers.Equals(t, 16, len(id))
+		testhelpers.NotContains(t, buf.String(), "Someone@Example.com")
+
+		lines := logs(buf)
+		testhelpers.Equals(t, 2, len(lines))
+		for _, l := range lines {
+			testhelpers.Equals(t, id, l["request_id"])
+		}
+
+		testhelpers.Equals(t, "email_rejected", lines[0]["event"])
+		testhelpers.Equals(t, "failure", lines[0]["outcome"])
+		testhelpers.Equals(t, maildoor.HashEmail(auth, "someone@example.com"), lines[0]["email_hash"])
+		testhelpers.Equals(t, "email:"+maildoor.HashEmail(auth, "someone@example.com")+" is not allowed", lines[0]["error"])
+
+		testhelpers.Equals(t, "request", lines[1]["msg"])
+		testhelpers.Equals(t, "POST /email", lines[1]["route"])
+		testhelpers.Equals(t, float64(422), lines[1]["status"])
+	})
+
+	t.Run("uses the incoming request id", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		auth := maildoor.New(
+			maildoor.Logger(slog.New(slog.NewJSONHandler(buf, nil))),
+			maildoor.RequestIDHeader("X-Trace"),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.Header.Set("X-Trace", "abc-123")
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, "abc-123", w.Header().Get("X-Trace"))
+		testhelpers.Equals(t, "abc-123", logs(buf)[0]["request_id"])
+	})
+
+	t.Run("ignores invalid request ids", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.Logger(slog.New(slog.NewJSONHandler(&bytes.Buffer{}, nil))),
+			maildoor.LoginRenderer(func(data maildoor.Attempt) (string, error) {
+				return "", nil
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.Header.Set("X-Request-ID", "bad id\nwith newline")
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, 16, len(w.Header().Get("X-Request-ID")))
+	})
+	t.Run("hashes emails with the key", func(t *testing.T) {
+		key := bytes.Repeat([]byte("k"), 32)
+		a := maildoor.New(maildoor.EmailHashKey(key))
+		b := maildoor.New(maildoor.EmailHashKey(key))
+		other := maildoor.New()
+
+		testhelpers.Equals(t, maildoor.HashEmail(a, "a@b.com"), maildoor.HashEmail(b, " A@B.com"))
+		testhelpers.NotEquals(t, maildoor.HashEmail(a, "a@b.com"), maildoor.HashEmail(other, "a@b.com"))
+
+		// Not a plain hash that can be reversed with a list of emails.
+		sum := sha256.Sum256([]byte("a@b.com"))
+		testhelpers.NotEquals(t, hex.EncodeToString(sum[:6]), maildoor.HashEmail(a, "a@b.com"))
+	})
+
+	t.Run("panics with a short key", func(t *testing.T) {
+		defer func() {
+			testhelpers.NotNil(t, recover())
+		}()
+
+		maildoor.New(maildoor.EmailHashKey([]byte("short")))
+		t.Fatal("expected New to panic")
+	})
+}
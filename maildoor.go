@@ -2,21 +2,30 @@ package maildoor
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"embed"
+	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	texttemplate "text/template"
 	"time"
+
+	"github.com/wawandco/maildoor/internal/jwt"
 )
 
 var (
 	//go:embed *.html *.txt
 	templates embed.FS
 
-	//go:embed *.png
+	//go:embed assets
 	assets embed.FS
 )
 
@@ -29,20 +38,92 @@ type Attempt struct {
 	Email       string
 	Error       string
 	Code        string
+
+	// ResendIn is the number of seconds before another code can be
+	// sent to Email, see ResendCooldown.
+	ResendIn int
+
+	// Challenge carries the code when using stateless codes, it
+	// needs to be posted back with the code.
+	Challenge string
+
+	// AwaitingApproval is true when the code page waits for the login
+	// to be approved from the emailed link, see CrossDeviceApproval.
+	AwaitingApproval bool
+
+	// Approval is the login shown in the approval page.
+	Approval *Approval
+
+	// Handoff is true when the code page shows the QR code to approve
+	// the login from a signed in device, see QRHandoff.
+	Handoff bool
+
+	// Signup is true when the signup flow is enabled, see Signup.
+	Signup bool
+
+	// Passkeys is true when passkeys are enabled, see Passkeys.
+	Passkeys bool
+
+	// Return is the signed path to go back to after verifying the
+	// email again, see RequireRecentLogin.
+	Return string
+
+	// NewEmail is the email being verified to replace Email, see
+	// EmailChange.
+	NewEmail string
+
+	// Invite is the token of the invitation being accepted, it needs
+	// to be posted back with the email and the code.
+	Invite string
+
+	// Invitation is the one shown in the invitation page.
+	Invitation *Invitation
+
+	// Fields of the signup form with the values entered.
+	Fields []SignupField
+
+	// Locale is the language negotiated for the request (e.g. es).
+	Locale string
+
+	// Nonce is the CSP nonce for inline scripts and styles.
+	Nonce string
+
+	translate func(key string, args ...any) string
+	tenant    *tenant
+}
+
+// T translates the message id to the attempt locale, args are
+// formatted into the message with fmt.Sprintf.
+func (a Attempt) T(key string, args ...any) string {
+	if a.translate == nil {
+		return key
+	}
+
+	return a.translate(key, args...)
 }
 
-// New maildoor handler with the passed options.
+// New maildoor handler with the passed options. New panics if any
+// of the email or page templates fails to parse.
 func New(options ...option) http.Handler {
 	s := &maildoor{
 		mux:         http.NewServeMux(),
 		productName: "Maildoor",
-		logoURL:     "https://raw.githubusercontent.com/wawandco/maildoor/508ff43/assets/images/maildoor_logo.png",
-		iconURL:     "https://raw.githubusercontent.com/wawandco/maildoor/508ff43/assets/images/maildoor_icon.png",
+
+		parsed: map[string]*template.Template{},
+
+		catalog:       bundledCatalog(),
+		defaultLocale: "en",
+
+		securityHeaders: defaultSecurityHeaders(),
+		requestIDHeader: defaultRequestIDHeader,
+		resendCooldown:  defaultResendCooldown,
 
 		afterLogin: func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("Logged in!"))
 		},
 
+		normalizers: defaultNormalizers,
+
 		emailValidator: func(email string) error {
 			// All emails are valid by default
 			return nil
@@ -59,21 +140,232 @@ func New(options ...option) http.Handler {
 	// Set default code renderer
 	s.codeRenderer = s.defaultCodeRenderer
 
+	// Set default signup renderer
+	s.signupRenderer = s.defaultSignupRenderer
+
 	// Set default token storage
 	s.tokenStorage = NewInMemoryTokenStorage(0) // No expiration by default
 
+	// Set default attempt counter
+	s.attempts = NewInMemoryAttemptCounter()
+
+	// Set default cooldown store
+	s.cooldowns = NewInMemoryCooldownStore()
+
+	// Set default approval store
+	s.approvals = NewInMemoryApprovalStore()
+
+	// Set default pending signup store
+	s.pendingSignups = NewInMemoryPendingSignupStore()
+
+	// Set default authorization store
+	s.authorizations = NewInMemoryAuthorizationStore()
+
+	// Spans are discarded unless a tracer is set.
+	s.tracer = noopTracer{}
+
 	for _, opt := range options {
 		opt(s)
 	}
 
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+
+	// Without a key the hashes only correlate the logs of this process.
+	if s.emailKey == nil {
+		s.emailKey = make(emailKey, 32)
+		if _, err := rand.Read(s.emailKey); err != nil {
+			panic(fmt.Errorf("maildoor: email hash key: %w", err))
+		}
+	}
+
+	if len(s.emailKey) < 32 {
+		panic(fmt.Errorf("maildoor: the email hash key must be at least 32 bytes"))
+	}
+
+	// Email addresses are redacted from the logs and the events
+	// are logged with the request logger.
+	s.logger = slog.New(redactHandler{s.logger.Handler(), s.emailKey})
+	s.eventHandlers = append(s.eventHandlers, logHandler{s.emailKey})
+
+	// Links are built from BaseURL only, these features need them.
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"CrossDeviceApproval", s.crossDevice},
+		{"Invitations", s.invitesSecret != nil},
+		{"JWT", s.signingKeys != nil},
+		{"Passkeys", s.credentials != nil},
+	} {
+		if f.enabled && s.baseURL == "" {
+			panic(fmt.Errorf("maildoor: %s requires BaseURL", f.name))
+		}
+	}
+
+	// The relying party must be the host of the origin or a parent
+	// domain of it, or browsers reject the passkeys.
+	if s.credentials != nil && s.rpID != "" {
+		_, host := originHost(s.baseURL)
+		if host != s.rpID && !strings.HasSuffix(host, "."+s.rpID) {
+			panic(fmt.Errorf("maildoor: RelyingPartyID %q is not the host of BaseURL or a parent domain", s.rpID))
+		}
+	}
+
+	if s.statelessSecret != nil {
+		codes, err := newStatelessCodes(s.statelessSecret, s.statelessTTL, s.usedNonces)
+		if err != nil {
+			panic(fmt.Errorf("maildoor: stateless codes: %w", err))
+		}
+
+		s.stateless = codes
+	}
+
+	if s.stepUpSecret != nil {
+		stepUp, err := newStepUp(s.stepUpSecret, s.stepUpMaxAge)
+		if err != nil {
+			panic(fmt.Errorf("maildoor: step-up: %w", err))
+		}
+
+		s.stepUp = stepUp
+	}
+
+	if s.handoffSignedIn != nil {
+		handoff, err := newHandoff(s.handoffSecret, s.handoffSignedIn)
+		if err != nil {
+			panic(fmt.Errorf("maildoor: QR handoff: %w", err))
+		}
+
+		s.handoff = handoff
+	}
+
+	if err := s.parseEmailTemplates(); err != nil {
+		panic(fmt.Errorf("maildoor: parsing email templates: %w", err))
+	}
+
+	if err := s.setupTenants(); err != nil {
+		panic(fmt.Errorf("maildoor: tenants: %w", err))
+	}
+
+	if s.invitesSecret != nil {
+		invites, err := newInvites(s.invitesSecret, s.invitesTTL, s.usedNonces)
+		if err != nil {
+			panic(fmt.Errorf("maildoor: invitations: %w", err))
+		}
+
+		s.invites = invites
+		if err := s.parseInviteTemplates(s.invitesFS); err != nil {
+			panic(fmt.Errorf("maildoor: parsing invitation templates: %w", err))
+		}
+	}
+
+	if s.signingKeys != nil {
+		tokens, err := newTokens(s.signingKeys, s.refreshStore, s.accessTTL, s.refreshTTL)
+		if err != nil {
+			panic(fmt.Errorf("maildoor: tokens: %w", err))
+		}
+
+		tokens.claims = s.tokenClaims
+		s.tokens = tokens
+	}
+
+	if s.oidc != nil {
+		if s.tokens == nil {
+			panic(fmt.Errorf("maildoor: OIDC requires JWT"))
+		}
+
+		if s.tokens.keys[0].Algorithm == jwt.HS256 {
+			panic(fmt.Errorf("maildoor: OIDC requires an ES256 or EdDSA signing key"))
+		}
+	}
+
+	if err := s.parsePages(); err != nil {
+		panic(fmt.Errorf("maildoor: parsing page templates: %w", err))
+	}
+
 	s.HandleFunc("GET /login", s.handleLogin)
 	s.HandleFunc("POST /email", s.handleEmail)
+	s.HandleFunc("GET /code", s.handleCodeLink)
 	s.HandleFunc("POST /code", s.handleCode)
+	s.HandleFunc("POST /resend", s.handleResend)
 	s.HandleFunc("DELETE /logout", s.handleLogout)
 
+	if s.crossDevice {
+		s.HandleFunc("GET /status", s.handleStatus)
+		s.HandleFunc("GET /approve", s.handleApprovePage)
+		s.HandleFunc("POST /approve", s.handleApprove)
+		s.HandleFunc("POST /complete", s.handleComplete)
+	}
+
+	if s.handoff != nil {
+		if !s.crossDevice {
+			panic(fmt.Errorf("maildoor: QRHandoff requires CrossDeviceApproval"))
+		}
+
+		s.HandleFunc("GET /qr.svg", s.handleQR)
+		s.HandleFunc("GET /qr.png", s.handleQR)
+		s.HandleFunc("GET /handoff", s.handleHandoffPage)
+		s.HandleFunc("POST /handoff", s.handleHandoff)
+	}
+
+	if s.stepUp != nil {
+		s.HandleFunc("GET /stepup", s.handleStepUp)
+	}
+
+	if s.invites != nil {
+		s.HandleFunc("GET /invite", s.handleInvite)
+	}
+
+	if s.tokens != nil {
+		s.HandleFunc("GET /jwks.json", s.handleJWKS)
+		s.HandleFunc("POST /token/refresh", s.handleRefresh)
+	}
+
+	if s.oidc != nil {
+		s.HandleFunc("GET /.well-known/openid-configuration", s.handleDiscovery)
+		s.HandleFunc("GET /authorize", s.handleAuthorize)
+		s.HandleFunc("POST /token", s.handleToken)
+		s.HandleFunc("GET /userinfo", s.handleUserinfo)
+		s.HandleFunc("POST /userinfo", s.handleUserinfo)
+	}
+
+	if s.emailChange != nil {
+		s.HandleFunc("GET /change-email", s.handleChangeEmailPage)
+		s.HandleFunc("POST /change-email", s.handleChangeEmail)
+		s.HandleFunc("POST /change-email/verify", s.handleChangeEmailVerify)
+	}
+
+	if s.credentials != nil {
+		s.HandleFunc("POST /webauthn/register/options", s.handleRegisterOptions)
+		s.HandleFunc("POST /webauthn/register", s.handleRegister)
+		s.HandleFunc("POST /webauthn/skip", s.handleSkipPasskey)
+		s.HandleFunc("POST /webauthn/login/options", s.handleLoginOptions)
+		s.HandleFunc("POST /webauthn/login", s.handlePasskeyLogin)
+	}
+
+	if s.userStore != nil {
+		s.HandleFunc("GET /signup", s.handleSignupPage)
+		s.HandleFunc("POST /signup", s.handleSignup)
+	}
+
+	if s.metrics != nil {
+		s.eventHandlers = append(s.eventHandlers, metricsHandler{metrics: s.metrics})
+	}
+
+	if h, ok := s.metrics.(http.Handler); ok && s.serveMetrics {
+		s.Handle("GET /metrics", h)
+	}
+
 	// Adding the static assets handler
-	ah := http.StripPrefix(s.patternPrefix, http.FileServer(http.FS(assets)))
-	s.Handle("GET /*", ah)
+	s.HandleFunc("GET /assets/{file}", s.handleAsset)
+
+	// The logo used to be served at {prefix}/logo.png, pages and
+	// emails linking to it keep working.
+	s.HandleFunc("GET /logo.png", func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue("file", "logo.png")
+		s.handleAsset(w, r)
+	})
 
 	return s
 }
@@ -89,13 +381,89 @@ type maildoor struct {
 	afterLogin    http.HandlerFunc
 	logout        http.HandlerFunc
 
+	normalizers    []Normalizer
 	emailValidator func(email string) error
-	emailSender    func(email, html, txt string) error
+	messageSender  func(msg Message) error
+
+	emailFS      fs.FS
+	emailHTML    *template.Template
+	emailText    *texttemplate.Template
+	emailSubject *texttemplate.Template
+
+	baseURL    string
+	supportURL string
+	ipLocator  func(ip string) string
+
+	catalog       catalog
+	defaultLocale string
 
-	loginRenderer func(data Attempt) (string, error)
-	codeRenderer  func(data Attempt) (string, error)
+	templatesFS fs.FS
+	funcs       template.FuncMap
+	parsedMu    sync.RWMutex
+	parsed      map[string]*template.Template
+
+	securityHeaders map[string]string
+	eventHandlers   []EventHandler
+	metrics         Metrics
+	logger          *slog.Logger
+	emailKey        emailKey
+	requestIDHeader string
+	serveMetrics    bool
+
+	maxAttempts int
+	attempts    AttemptCounter
+
+	resendCooldown time.Duration
+	cooldowns      CooldownStore
+
+	userStore      UserStore
+	signupFields   []SignupField
+	pendingSignups PendingSignupStore
+
+	loginRenderer  func(data Attempt) (string, error)
+	codeRenderer   func(data Attempt) (string, error)
+	signupRenderer func(data Attempt) (string, error)
 
 	tokenStorage TokenStorage
+	crossDevice  bool
+	approvals    ApprovalStore
+	handoff      *handoff
+
+	handoffSecret   []byte
+	handoffSignedIn func(r *http.Request) string
+	emailChange     *emailChange
+	credentials     CredentialStore
+	ceremonies      *ceremonies
+	rpID            string
+	stateless       *statelessCodes
+
+	statelessSecret []byte
+	statelessTTL    time.Duration
+	stepUpSecret    []byte
+	stepUpMaxAge    time.Duration
+	stepUp          *stepUp
+	usedNonces      NonceCache
+	tracer          Tracer
+
+	invitesSecret    []byte
+	invitesTTL       time.Duration
+	invitesFS        fs.FS
+	invites          *invites
+	onInviteAccepted func(w http.ResponseWriter, r *http.Request, inv Invitation)
+
+	signingKeys    []SigningKey
+	refreshStore   RefreshTokenStore
+	accessTTL      time.Duration
+	refreshTTL     time.Duration
+	tokenClaims    func(ctx context.Context, email string) (map[string]any, error)
+	tokens         *tokens
+	oidc           *oidc
+	authorizations AuthorizationStore
+
+	tenantResolver TenantResolver
+	tenantConfigs  []Tenant
+	tenants        map[string]*tenant
+	base           *tenant
 }
 
 func (m *maildoor) HandleFunc(pattern string, handler http.HandlerFunc) {
@@ -127,11 +495,24 @@ func (m *maildoor) Handle(pattern string, handler http.Handler) {
 func (m *maildoor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Adding common things here, loggers and other things.
 	t := time.Now()
+	r = m.withRequestLogger(w, r)
+
+	r, err := m.withSecurityHeaders(w, r)
+	if err != nil {
+		m.httpError(w, r, err)
+		return
+	}
+
+	r, ok := m.withTenant(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
 	// Parsing form
-	err := r.ParseForm()
+	err = r.ParseForm()
 	if err != nil {
-		m.httpError(w, err)
+		m.httpError(w, r, err)
 		return
 	}
 
@@ -140,24 +521,83 @@ func (m *maildoor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.Method = r.FormValue("_method")
 	}
 
-	m.mux.ServeHTTP(w, r)
-	slog.Info(">", "method", r.Method, "path", r.URL.Path, "duration", time.Since(t))
+	r = m.withLocale(w, r)
+
+	_, route := m.mux.Handler(r)
+	if route == "" {
+		route = "unmatched"
+	}
+
+	ctx, span := m.tracer.Start(r.Context(), "maildoor.request",
+		Attr("http.method", r.Method),
+		Attr("http.route", route),
+	)
+
+	if id := TenantFrom(r); id != "" {
+		span.SetAttributes(Attr("maildoor.tenant", id))
+	}
+
+	r = r.WithContext(ctx)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+	m.mux.ServeHTTP(sw, r)
+
+	span.SetAttributes(Attr("http.status_code", sw.status))
+	span.End()
+
+	loggerFrom(r.Context()).Info("request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"route", route,
+		"status", sw.status,
+		"duration", time.Since(t),
+	)
+
+	m.observe("maildoor_http_request_duration_seconds", map[string]string{
+		"route":  route,
+		"status": strconv.Itoa(sw.status),
+	}, time.Since(t).Seconds())
+}
+
+// statusWriter keeps the status code written to the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush allows streaming responses through the writer.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the
+// underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 // render a template with the passed data and partials using
-// the templates FS. if using layout it should go first.
-func (m *maildoor) render(w io.Writer, data any, partials ...string) error {
+// the templates FS of the attempt tenant. if using layout it should
+// go first. Templates are parsed the first time they're rendered and
+// cached after.
+func (m *maildoor) render(w io.Writer, data Attempt, partials ...string) error {
 	if len(partials) == 0 {
 		return nil
 	}
 
-	tt := template.New(partials[0]).Funcs(template.FuncMap{
-		"prefixedPath": func(p string) string {
-			return path.Join(m.patternPrefix, p)
-		},
-	})
+	t := data.tenant
+	if t == nil {
+		t = m.base
+	}
 
-	tt, err := tt.ParseFS(templates, partials...)
+	tt, err := m.template(t, partials...)
 	if err != nil {
 		return err
 	}
@@ -165,8 +605,36 @@ func (m *maildoor) render(w io.Writer, data any, partials ...string) error {
 	return tt.Execute(w, data)
 }
 
-func (m *maildoor) httpError(w http.ResponseWriter, err error) {
-	slog.Error("*", "error", err.Error())
+// attempt returns an Attempt with the product details and the
+// locale of the passed request.
+func (m *maildoor) attempt(r *http.Request) Attempt {
+	l := m.requestLocale(r)
+	t := m.tenant(r)
+
+	return Attempt{
+		Logo:        t.Logo,
+		Icon:        t.Icon,
+		ProductName: t.ProductName,
+		Locale:      l,
+		Nonce:       NonceFrom(r),
+		Signup:      m.userStore != nil,
+		Passkeys:    m.credentials != nil,
+		Return:      m.formReturn(r),
+		Invite:      m.formInviteToken(r),
+		Handoff:     m.handoff != nil,
+		translate:   m.catalog.translator(l, m.defaultLocale),
+		tenant:      t,
+	}
+}
+
+// secureCookies returns whether the cookies set by maildoor should be
+// Secure, which is the case when the BaseURL is https.
+func (m *maildoor) secureCookies() bool {
+	return strings.HasPrefix(m.baseURL, "https://")
+}
+
+func (m *maildoor) httpError(w http.ResponseWriter, r *http.Request, err error) {
+	loggerFrom(r.Context()).Error("internal error", "path", r.URL.Path, "error", err.Error())
 	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 }
 
@@ -180,44 +648,22 @@ func (m *maildoor) defaultLoginRenderer(data Attempt) (string, error) {
 	return buf.String(), nil
 }
 
-// defaultCodeRenderer is the default renderer for code pages
-func (m *maildoor) defaultCodeRenderer(data Attempt) (string, error) {
+// defaultSignupRenderer is the default renderer for signup pages
+func (m *maildoor) defaultSignupRenderer(data Attempt) (string, error) {
 	var buf bytes.Buffer
-	err := m.render(&buf, data, "layout.html", "handle_code.html")
+	err := m.render(&buf, data, "layout.html", "handle_signup.html")
 	if err != nil {
 		return "", err
 	}
 	return buf.String(), nil
 }
 
-func (m *maildoor) mailBodies(code string) (string, string, error) {
-	data := struct {
-		Code    string
-		Logo    string
-		Product string
-		Year    string
-	}{
-		Code:    code,
-		Logo:    m.logoURL,
-		Product: m.productName,
-		Year:    time.Now().Format("2006"),
-	}
-
-	sw := bytes.NewBuffer([]byte{})
-	err := m.render(sw, data, "message.html")
-	if err != nil {
-		return "", "", err
-	}
-
-	html := sw.String()
-
-	sw = bytes.NewBuffer([]byte{})
-	err = m.render(sw, data, "message.txt")
+// defaultCodeRenderer is the default renderer for code pages
+func (m *maildoor) defaultCodeRenderer(data Attempt) (string, error) {
+	var buf bytes.Buffer
+	err := m.render(&buf, data, "layout.html", "handle_code.html")
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
-
-	txt := sw.String()
-
-	return html, txt, nil
+	return buf.String(), nil
 }
@@ -0,0 +1,248 @@
+package maildoor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics receives the measurements maildoor takes, implement it
+// to bridge maildoor metrics to other systems. MetricsRegistry is
+// the default implementation.
+type Metrics interface {
+	// IncCounter increments the named counter by one.
+	IncCounter(name string, labels map[string]string)
+
+	// ObserveHistogram records a value (e.g. seconds) in the
+	// named histogram.
+	ObserveHistogram(name string, labels map[string]string, value float64)
+}
+
+// metricHelp describes the metrics maildoor records.
+var metricHelp = map[string]string{
+	"maildoor_codes_issued_total":            "Login codes issued.",
+	"maildoor_email_send_duration_seconds":   "Time spent sending the login emails.",
+	"maildoor_email_send_failures_total":     "Login emails that failed to send.",
+	"maildoor_verifications_total":           "Code verifications by result.",
+	"maildoor_lockouts_total":                "Codes invalidated after too many attempts.",
+	"maildoor_rate_limited_total":            "Code requests rejected by the resend cooldown.",
+	"maildoor_signups_total":                 "Users created by the signup flow.",
+	"maildoor_passkeys_registered_total":     "Passkeys registered after logging in.",
+	"maildoor_passkey_failures_total":        "Passkey registrations and logins rejected.",
+	"maildoor_step_ups_total":                "Emails verified again by RequireRecentLogin.",
+	"maildoor_email_changes_total":           "Emails changed with the email change flow.",
+	"maildoor_invites_sent_total":            "Invitations emailed by SendInvite.",
+	"maildoor_invites_accepted_total":        "Invitations accepted.",
+	"maildoor_token_refreshes_total":         "Refresh tokens exchanged for new tokens.",
+	"maildoor_refresh_token_reuses_total":    "Refresh tokens reused, their families were revoked.",
+	"maildoor_http_request_duration_seconds": "Duration of the requests by route and status.",
+}
+
+// metricsHandler turns the events of the flow into metrics.
+type metricsHandler struct {
+	metrics Metrics
+}
+
+func (h metricsHandler) HandleEvent(ctx context.Context, e Event) {
+	switch e.Type {
+	case EventCodeRequested:
+		h.metrics.IncCounter("maildoor_codes_issued_total", nil)
+	case EventSendFailed:
+		h.metrics.IncCounter("maildoor_email_send_failures_total", nil)
+	case EventLogin:
+		h.metrics.IncCounter("maildoor_verifications_total", map[string]string{"result": "success"})
+	case EventInvalidCode:
+		h.metrics.IncCounter("maildoor_verifications_total", map[string]string{"result": "invalid"})
+	case EventCodeExpired:
+		h.metrics.IncCounter("maildoor_verifications_total", map[string]string{"result": "expired"})
+	case EventLockout:
+		h.metrics.IncCounter("maildoor_verifications_total", map[string]string{"result": "locked_out"})
+		h.metrics.IncCounter("maildoor_lockouts_total", nil)
+	case EventRateLimited:
+		h.metrics.IncCounter("maildoor_rate_limited_total", nil)
+	case EventSignup:
+		h.metrics.IncCounter("maildoor_signups_total", nil)
+	case EventPasskeyRegistered:
+		h.metrics.IncCounter("maildoor_passkeys_registered_total", nil)
+	case EventPasskeyFailed:
+		h.metrics.IncCounter("maildoor_passkey_failures_total", nil)
+	case EventStepUp:
+		h.metrics.IncCounter("maildoor_step_ups_total", nil)
+	case EventEmailChanged:
+		h.metrics.IncCounter("maildoor_email_changes_total", nil)
+	case EventInviteSent:
+		h.metrics.IncCounter("maildoor_invites_sent_total", nil)
+	case EventInviteAccepted:
+		h.metrics.IncCounter("maildoor_invites_accepted_total", nil)
+	case EventTokenRefreshed:
+		h.metrics.IncCounter("maildoor_token_refreshes_total", nil)
+	case EventRefreshReused:
+		h.metrics.IncCounter("maildoor_refresh_token_reuses_total", nil)
+	}
+}
+
+// observe records the value in the histogram if metrics are enabled.
+func (m *maildoor) observe(name string, labels map[string]string, value float64) {
+	if m.metrics == nil {
+		return
+	}
+
+	m.metrics.ObserveHistogram(name, labels, value)
+}
+
+// defaultBuckets are the upper bounds of the histograms in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// MetricsRegistry keeps the metrics in memory and serves them in
+// the Prometheus text exposition format.
+type MetricsRegistry struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// NewMetricsRegistry creates an empty metrics registry.
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		counters:   map[string]map[string]float64{},
+		histograms: map[string]map[string]*histogram{},
+	}
+}
+
+// IncCounter implements Metrics.IncCounter.
+func (r *MetricsRegistry) IncCounter(name string, labels map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.counters[name] == nil {
+		r.counters[name] = map[string]float64{}
+	}
+
+	r.counters[name][formatLabels(labels)]++
+}
+
+// ObserveHistogram implements Metrics.ObserveHistogram.
+func (r *MetricsRegistry) ObserveHistogram(name string, labels map[string]string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.histograms[name] == nil {
+		r.histograms[name] = map[string]*histogram{}
+	}
+
+	key := formatLabels(labels)
+	h := r.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(defaultBuckets))}
+		r.histograms[name][key] = h
+	}
+
+	for i, b := range defaultBuckets {
+		if value <= b {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += value
+	h.count++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format to w.
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sb strings.Builder
+	for _, name := range sortedKeys(r.counters) {
+		writeHeader(&sb, name, "counter")
+		series := r.counters[name]
+		for _, labels := range sortedKeys(series) {
+			fmt.Fprintf(&sb, "%s%s %s\n", name, labels, formatFloat(series[labels]))
+		}
+	}
+
+	for _, name := range sortedKeys(r.histograms) {
+		writeHeader(&sb, name, "histogram")
+		series := r.histograms[name]
+		for _, labels := range sortedKeys(series) {
+			h := series[labels]
+			for i, b := range defaultBuckets {
+				fmt.Fprintf(&sb, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatFloat(b)), h.counts[i])
+			}
+
+			fmt.Fprintf(&sb, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), h.count)
+			fmt.Fprintf(&sb, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+			fmt.Fprintf(&sb, "%s_count%s %d\n", name, labels, h.count)
+		}
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func writeHeader(sb *strings.Builder, name, kind string) {
+	if help, ok := metricHelp[name]; ok {
+		fmt.Fprintf(sb, "# HELP %s %s\n", name, help)
+	}
+
+	fmt.Fprintf(sb, "# TYPE %s %s\n", name, kind)
+}
+
+// formatLabels returns the labels in the exposition format sorted
+// by name, e.g. {result="success"}, it is also used as series key.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for _, k := range sortedKeys(labels) {
+		pairs = append(pairs, k+`="`+labelEscaper.Replace(labels[k])+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label to the already formatted labels.
+func withLabel(labels, name, value string) string {
+	l := name + `="` + labelEscaper.Replace(value) + `"`
+	if labels == "" {
+		return "{" + l + "}"
+	}
+
+	return strings.TrimSuffix(labels, "}") + "," + l + "}"
+}
+
+// labelEscaper escapes label values as the exposition format expects.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,86 @@
+package maildoor_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("records the flow", func(t *testing.T) {
+		reg := maildoor.NewMetricsRegistry()
+		auth := maildoor.New(
+			maildoor.Prefix("/auth"),
+			maildoor.WithMetrics(reg),
+			maildoor.ServeMetrics(),
+			maildoor.MaxCodeAttempts(2),
+			maildoor.EmailSender(func(to, html, txt string) error {
+				if to == "fail@b.com" {
+					return errors.New("smtp down")
+				}
+
+				return nil
+			}),
+		)
+
+		post := func(path string, form url.Values) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", path, nil)
+			req.Form = form
+			auth.ServeHTTP(w, req)
+		}
+
+		post("/auth/email", url.Values{"email": {"a@b.com"}})
+		post("/auth/email", url.Values{"email": {"fail@b.com"}})
+		post("/auth/code", url.Values{"email": {"a@b.com"}, "code": {"x"}})
+		post("/auth/code", url.Values{"email": {"a@b.com"}, "code": {"x"}})
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/auth/metrics", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+
+		body := w.Body.String()
+		testhelpers.Contains(t, body, "# TYPE maildoor_codes_issued_total counter\nmaildoor_codes_issued_total 2\n")
+		testhelpers.Contains(t, body, "maildoor_email_send_failures_total 1\n")
+		testhelpers.Contains(t, body, `maildoor_verifications_total{result="invalid"} 1`)
+		testhelpers.Contains(t, body, `maildoor_verifications_total{result="locked_out"} 1`)
+		testhelpers.Contains(t, body, "maildoor_lockouts_total 1\n")
+		testhelpers.Contains(t, body, "# TYPE maildoor_email_send_duration_seconds histogram")
+		testhelpers.Contains(t, body, `maildoor_email_send_duration_seconds_bucket{le="+Inf"} 2`)
+		testhelpers.Contains(t, body, "maildoor_email_send_duration_seconds_count 2\n")
+		testhelpers.Contains(t, body, `maildoor_http_request_duration_seconds_count{route="POST /auth/email",status="200"} 1`)
+		testhelpers.Contains(t, body, `maildoor_http_request_duration_seconds_count{route="POST /auth/email",status="500"} 1`)
+	})
+
+	t.Run("endpoint is optional", func(t *testing.T) {
+		auth := maildoor.New(maildoor.WithMetrics(maildoor.NewMetricsRegistry()))
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("escapes label values", func(t *testing.T) {
+		reg := maildoor.NewMetricsRegistry()
+		reg.IncCounter("custom_total", map[string]string{"b": "x\"y", "a": "1\\2\n"})
+		reg.ObserveHistogram("custom_seconds", nil, 0.3)
+
+		var sb strings.Builder
+		reg.WriteTo(&sb)
+
+		testhelpers.Contains(t, sb.String(), "# TYPE custom_total counter\ncustom_total{a=\"1\\\\2\\n\",b=\"x\\\"y\"} 1\n")
+		testhelpers.Contains(t, sb.String(), "custom_seconds_bucket{le=\"0.25\"} 0\ncustom_seconds_bucket{le=\"0.5\"} 1\n")
+		testhelpers.Contains(t, sb.String(), "custom_seconds_sum 0.3\n")
+	})
+}
@@ -0,0 +1,258 @@
+package maildoor
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrInvalidEmail is returned by the normalizers when the email
+// can't be normalized.
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// Normalizer is a step of the email normalization, it returns the
+// email in its canonical form or an error when it is invalid.
+type Normalizer func(email string) (string, error)
+
+// defaultNormalizers trim the email and lowercase its domain.
+var defaultNormalizers = []Normalizer{TrimEmail, LowercaseDomain}
+
+// TrimEmail removes the spaces around the email.
+func TrimEmail(email string) (string, error) {
+	return strings.TrimSpace(email), nil
+}
+
+// LowercaseDomain lowercases the domain, which is case insensitive.
+func LowercaseDomain(email string) (string, error) {
+	local, domain, ok := splitEmail(email)
+	if !ok {
+		return email, nil
+	}
+
+	return local + "@" + strings.ToLower(domain), nil
+}
+
+// LowercaseEmail lowercases the whole email. The local part is case
+// sensitive by the RFCs but most providers ignore its case.
+func LowercaseEmail(email string) (string, error) {
+	return strings.ToLower(email), nil
+}
+
+// PunycodeDomain converts internationalized domains to their ASCII
+// form (e.g. bücher.example to xn--bcher-kva.example).
+func PunycodeDomain(email string) (string, error) {
+	local, domain, ok := splitEmail(email)
+	if !ok {
+		return email, nil
+	}
+
+	labels := strings.Split(strings.ToLower(domain), ".")
+	for i, l := range labels {
+		if !utf8.ValidString(l) {
+			return email, ErrInvalidEmail
+		}
+
+		if isASCII(l) {
+			continue
+		}
+
+		labels[i] = "xn--" + punycode(l)
+	}
+
+	domain = strings.Join(labels, ".")
+	for _, l := range labels {
+		if l == "" || len(l) > 63 {
+			return email, ErrInvalidEmail
+		}
+	}
+
+	if len(domain) > 253 {
+		return email, ErrInvalidEmail
+	}
+
+	return local + "@" + domain, nil
+}
+
+// FoldGmail removes the dots and the +tag from the local part of
+// Gmail addresses, which Gmail ignores, and uses gmail.com for
+// googlemail.com. Other addresses are not changed.
+func FoldGmail(email string) (string, error) {
+	local, domain, ok := splitEmail(email)
+	if !ok {
+		return email, nil
+	}
+
+	switch strings.ToLower(domain) {
+	case "gmail.com", "googlemail.com":
+	default:
+		return email, nil
+	}
+
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+
+	local = strings.ToLower(strings.ReplaceAll(local, ".", ""))
+	if local == "" {
+		return email, ErrInvalidEmail
+	}
+
+	return local + "@gmail.com", nil
+}
+
+// splitEmail splits the email in its local part and domain at the last @.
+func splitEmail(email string) (string, string, bool) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "", "", false
+	}
+
+	return email[:at], email[at+1:], true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// punycode encodes the label as defined in RFC 3492, without the
+// xn-- prefix.
+func punycode(label string) string {
+	const (
+		base        = 36
+		tmin        = 1
+		tmax        = 26
+		skew        = 38
+		damp        = 700
+		initialBias = 72
+		initialN    = 128
+	)
+
+	adapt := func(delta, points int, first bool) int {
+		if first {
+			delta /= damp
+		} else {
+			delta /= 2
+		}
+
+		delta += delta / points
+		k := 0
+		for delta > ((base-tmin)*tmax)/2 {
+			delta /= base - tmin
+			k += base
+		}
+
+		return k + (base-tmin+1)*delta/(delta+skew)
+	}
+
+	digit := func(d int) byte {
+		if d < 26 {
+			return byte('a' + d)
+		}
+
+		return byte('0' + d - 26)
+	}
+
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := initialN, 0, initialBias
+	for h < len(runes) {
+		m := int(^uint(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+
+			if int(r) != n {
+				continue
+			}
+
+			q := delta
+			for k := base; ; k += base {
+				t := k - bias
+				if t < tmin {
+					t = tmin
+				} else if t > tmax {
+					t = tmax
+				}
+
+				if q < t {
+					break
+				}
+
+				out = append(out, digit(t+(q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+
+			out = append(out, digit(q))
+			bias = adapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+
+		delta++
+		n++
+	}
+
+	return string(out)
+}
+
+// normalizeEmail runs the normalizers on the email, when one fails
+// the trimmed email is returned with the error.
+func (m *maildoor) normalizeEmail(email string) (string, error) {
+	canonical := email
+	for _, n := range m.normalizers {
+		var err error
+		canonical, err = n(canonical)
+		if err != nil {
+			return strings.TrimSpace(email), err
+		}
+	}
+
+	// Emails with control characters are rejected whatever the
+	// normalizers, internal keys (see changeKey) rely on it.
+	if strings.IndexFunc(canonical, unicode.IsControl) >= 0 {
+		return strings.TrimSpace(email), ErrInvalidEmail
+	}
+
+	return canonical, nil
+}
+
+// formEmail returns the canonical form of the email in the request form.
+func (m *maildoor) formEmail(r *http.Request) (string, error) {
+	return m.normalizeEmail(r.FormValue("email"))
+}
+
+// EmailFrom returns the canonical email of the user that logged in,
+// it is available in the AfterLogin hook.
+func EmailFrom(r *http.Request) string {
+	email, _ := r.Context().Value("email").(string)
+	return email
+}
@@ -0,0 +1,114 @@
+package maildoor_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestNormalizers(t *testing.T) {
+	cases := []struct {
+		normalizer maildoor.Normalizer
+		in, out    string
+	}{
+		{maildoor.TrimEmail, " User@Example.com\n", "User@Example.com"},
+		{maildoor.LowercaseDomain, "User@Example.COM", "User@example.com"},
+		{maildoor.LowercaseEmail, "User@Example.COM", "user@example.com"},
+		{maildoor.PunycodeDomain, "ana@Bücher.example", "ana@xn--bcher-kva.example"},
+		{maildoor.PunycodeDomain, "ana@münchen.de", "ana@xn--mnchen-3ya.de"},
+		{maildoor.PunycodeDomain, "ana@example.com", "ana@example.com"},
+		{maildoor.FoldGmail, "First.Last+news@googlemail.com", "firstlast@gmail.com"},
+		{maildoor.FoldGmail, "first.last+news@example.com", "first.last+news@example.com"},
+	}
+
+	for _, c := range cases {
+		out, err := c.normalizer(c.in)
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, c.out, out)
+	}
+
+	_, err := maildoor.PunycodeDomain("ana@example..com")
+	testhelpers.Equals(t, maildoor.ErrInvalidEmail, err)
+
+	_, err = maildoor.FoldGmail("+tag@gmail.com")
+	testhelpers.Equals(t, maildoor.ErrInvalidEmail, err)
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	codePattern := regexp.MustCompile(`\b\d{6}\b`)
+
+	t.Run("same code for the same address", func(t *testing.T) {
+		var code, validated string
+		var logins []string
+		auth := maildoor.New(
+			maildoor.EmailValidator(func(email string) error {
+				validated = email
+				return nil
+			}),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				code = codePattern.FindString(msg.Text)
+				return nil
+			}),
+			maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+				logins = append(logins, maildoor.EmailFrom(r))
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {" User@Example.com "}}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, "User@example.com", validated)
+
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("POST", "/code", nil)
+		req.Form = url.Values{"email": {"User@EXAMPLE.com"}, "code": {code}}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, []string{"User@example.com"}, logins)
+	})
+
+	t.Run("configurable pipeline", func(t *testing.T) {
+		var sent []string
+		auth := maildoor.New(
+			maildoor.NormalizeEmail(maildoor.TrimEmail, maildoor.LowercaseEmail, maildoor.FoldGmail),
+			maildoor.ResendCooldown(0),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				sent = append(sent, msg.To)
+				return nil
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {"Jane.Doe+promo@Gmail.com"}}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, []string{"janedoe@gmail.com"}, sent)
+		testhelpers.Contains(t, w.Body.String(), `value="janedoe@gmail.com"`)
+	})
+
+	t.Run("rejects emails that fail to normalize", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.NormalizeEmail(maildoor.PunycodeDomain),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				t.Fatal("should not send")
+				return nil
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {"a@.com"}}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "invalid email address")
+	})
+}
@@ -0,0 +1,348 @@
+package maildoor
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wawandco/maildoor/internal/jwt"
+)
+
+const (
+	// oidcCookie identifies the authorization request of the browser
+	// while it goes through the login pages.
+	oidcCookie = "maildoor_oidc"
+
+	// authorizeTTL is the time to log in after /authorize.
+	authorizeTTL = 10 * time.Minute
+
+	// authCodeTTL is the time clients have to exchange the
+	// authorization code at /token.
+	authCodeTTL = time.Minute
+)
+
+// ErrClientNotFound is returned by ClientRegistry.FindClient when
+// there is no client with the id.
+var ErrClientNotFound = errors.New("maildoor: client not found")
+
+// Client is an application that logs its users in with maildoor
+// through OpenID Connect.
+type Client struct {
+	ID string
+
+	// Tenant is the ID of the tenant the client logs its users in to,
+	// the client is not found with the other tenants, see Tenants.
+	Tenant string
+
+	// Secret authenticates confidential clients at the token endpoint,
+	// public clients (e.g. single page or mobile apps) don't have one.
+	Secret string
+
+	// RedirectURIs are the exact URIs the users can be sent back to.
+	RedirectURIs []string
+}
+
+// ClientRegistry finds the OpenID Connect clients, it allows to keep
+// them in a database or any other backend.
+type ClientRegistry interface {
+	// FindClient returns the client with the id or ErrClientNotFound.
+	FindClient(ctx context.Context, id string) (Client, error)
+}
+
+// InMemoryClientRegistry is a ClientRegistry with a fixed list of
+// clients, e.g. read from the configuration.
+type InMemoryClientRegistry struct {
+	clients map[string]Client
+}
+
+// NewInMemoryClientRegistry creates a registry with the clients.
+func NewInMemoryClientRegistry(clients ...Client) *InMemoryClientRegistry {
+	r := &InMemoryClientRegistry{clients: map[string]Client{}}
+	for _, c := range clients {
+		r.clients[c.ID] = c
+	}
+
+	return r
+}
+
+// FindClient implements ClientRegistry.FindClient
+func (r *InMemoryClientRegistry) FindClient(ctx context.Context, id string) (Client, error) {
+	c, ok := r.clients[id]
+	if !ok {
+		return Client{}, ErrClientNotFound
+	}
+
+	return c, nil
+}
+
+// ErrAuthorizationNotFound is returned by AuthorizationStore.Take
+// when there is no authorization with the id.
+var ErrAuthorizationNotFound = errors.New("maildoor: authorization not found")
+
+// Authorization is an OpenID Connect authorization request, pending
+// while the user logs in and then waiting for its code to be exchanged.
+type Authorization struct {
+	ClientID    string
+	RedirectURI string
+	State       string
+	Nonce       string
+
+	// CodeChallenge is the S256 PKCE challenge of the request.
+	CodeChallenge string
+
+	// Email and AuthTime are set once the user logged in.
+	Email    string
+	AuthTime time.Time
+
+	// Tenant is the ID of the tenant the authorization was requested
+	// with, it can only be completed with the same tenant.
+	Tenant string
+
+	ExpiresAt time.Time
+}
+
+// AuthorizationStore keeps the authorization requests while the users
+// log in and the codes until the clients exchange them. Services with
+// several instances should share it, e.g. with Redis.
+type AuthorizationStore interface {
+	// Save keeps the authorization with the id until it expires.
+	Save(ctx context.Context, id string, a Authorization) error
+
+	// Take returns and removes the authorization with the id or
+	// ErrAuthorizationNotFound. It needs to be atomic so a code can't
+	// be exchanged twice by concurrent requests.
+	Take(ctx context.Context, id string) (Authorization, error)
+}
+
+// InMemoryAuthorizationStore keeps the authorizations in memory until
+// they expire.
+type InMemoryAuthorizationStore struct {
+	mu             sync.Mutex
+	authorizations map[string]Authorization
+}
+
+// NewInMemoryAuthorizationStore creates an empty in-memory
+// authorization store.
+func NewInMemoryAuthorizationStore() *InMemoryAuthorizationStore {
+	return &InMemoryAuthorizationStore{authorizations: map[string]Authorization{}}
+}
+
+// Save implements AuthorizationStore.Save
+func (s *InMemoryAuthorizationStore) Save(ctx context.Context, id string, a Authorization) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range s.authorizations {
+		if now.After(v.ExpiresAt) {
+			delete(s.authorizations, k)
+		}
+	}
+
+	s.authorizations[id] = a
+	return nil
+}
+
+// Take implements AuthorizationStore.Take
+func (s *InMemoryAuthorizationStore) Take(ctx context.Context, id string) (Authorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.authorizations[id]
+	delete(s.authorizations, id)
+	if !ok || time.Now().After(a.ExpiresAt) {
+		return Authorization{}, ErrAuthorizationNotFound
+	}
+
+	return a, nil
+}
+
+// oidc finds the clients of the OpenID Connect provider.
+type oidc struct {
+	clients ClientRegistry
+}
+
+func newOIDC(clients ClientRegistry) *oidc {
+	return &oidc{clients: clients}
+}
+
+// putAuthorization saves the authorization with a new random id of the
+// kind (pending or code) in the tenant of the request and returns the id.
+func (m *maildoor) putAuthorization(r *http.Request, kind string, a Authorization) (string, error) {
+	id := randomToken()
+	if err := m.authorizations.Save(r.Context(), m.storageKey(r, kind+":"+id), a); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// takeAuthorization removes the authorization of the kind with the id
+// and returns it, authorizations and codes can only be used once and
+// only with the tenant they were requested with.
+func (m *maildoor) takeAuthorization(r *http.Request, kind, id string) (Authorization, bool) {
+	if id == "" {
+		return Authorization{}, false
+	}
+
+	a, err := m.authorizations.Take(r.Context(), m.storageKey(r, kind+":"+id))
+	return a, err == nil && a.Tenant == m.tenant(r).ID
+}
+
+// findClient returns the client with the id when it belongs to the
+// tenant of the request.
+func (m *maildoor) findClient(r *http.Request, id string) (Client, error) {
+	client, err := m.oidc.clients.FindClient(r.Context(), id)
+	if err != nil {
+		return Client{}, err
+	}
+
+	if client.Tenant != m.tenant(r).ID {
+		return Client{}, ErrClientNotFound
+	}
+
+	return client, nil
+}
+
+// issuer is the URL maildoor is served at, the OpenID Connect issuer
+// and the iss of the tokens.
+func (m *maildoor) issuer(r *http.Request) string {
+	return m.issuerOf(m.tenant(r))
+}
+
+// issuerOf returns the issuer of the tokens of the tenant.
+func (m *maildoor) issuerOf(t *tenant) string {
+	return strings.TrimSuffix(m.baseURL+path.Join(t.prefix, "/"), "/")
+}
+
+// redirectAuthorization sends the browser back to the client with
+// an authorization code when it is logging in through /authorize.
+// It returns false when the login should continue.
+func (m *maildoor) redirectAuthorization(w http.ResponseWriter, r *http.Request, email string) bool {
+	a, ok := m.takePendingAuthorization(w, r)
+	if !ok {
+		return false
+	}
+
+	a.Email = email
+	a.AuthTime = time.Now()
+	a.ExpiresAt = a.AuthTime.Add(authCodeTTL)
+
+	code, err := m.putAuthorization(r, "code", a)
+	if err != nil {
+		m.httpError(w, r, err)
+		return true
+	}
+
+	http.Redirect(w, r, authorizationRedirect(a.RedirectURI, "code", code, a.State), http.StatusSeeOther)
+	return true
+}
+
+// takePendingAuthorization removes the authorization the browser is
+// logging in for through /authorize and returns it.
+func (m *maildoor) takePendingAuthorization(w http.ResponseWriter, r *http.Request) (Authorization, bool) {
+	if m.oidc == nil {
+		return Authorization{}, false
+	}
+
+	c, err := r.Cookie(oidcCookie)
+	if err != nil {
+		return Authorization{}, false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Path:     m.tenant(r).prefix,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   m.secureCookies(),
+	})
+
+	return m.takeAuthorization(r, "pending", c.Value)
+}
+
+// authorizationRedirect adds the parameter and the state to the
+// query of the redirect URI of the client.
+func authorizationRedirect(redirectURI, key, value, state string) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	q := u.Query()
+	q.Set(key, value)
+	if state != "" {
+		q.Set("state", state)
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// authenticateClient returns the client of the token request, with the
+// client_secret_basic or client_secret_post methods, or only the id
+// for public clients.
+func (m *maildoor) authenticateClient(r *http.Request) (Client, bool) {
+	id, secret, basic := r.BasicAuth()
+	if !basic {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+
+	client, err := m.findClient(r, id)
+	if err != nil {
+		return Client{}, false
+	}
+
+	if client.Secret == "" {
+		return client, secret == ""
+	}
+
+	return client, subtle.ConstantTimeCompare([]byte(secret), []byte(client.Secret)) == 1
+}
+
+// verifyPKCE checks the code verifier against the S256 challenge.
+func verifyPKCE(verifier, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return verifier != "" && subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// idToken signs the ID token of the authorization for its client.
+func (m *maildoor) idToken(r *http.Request, a Authorization) (string, error) {
+	now := time.Now()
+	claims := map[string]any{
+		"iss":            m.issuer(r),
+		"sub":            a.Email,
+		"aud":            a.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(m.tokens.accessTTL).Unix(),
+		"auth_time":      a.AuthTime.Unix(),
+		"email":          a.Email,
+		"email_verified": true,
+	}
+
+	if a.Nonce != "" {
+		claims["nonce"] = a.Nonce
+	}
+
+	if a.Tenant != "" {
+		claims["tid"] = a.Tenant
+	}
+
+	return jwt.Sign(m.tokens.keys[0], jwt.TypeJWT, claims)
+}
+
+// validRedirect returns true when the URI is one of the client ones.
+func (c Client) validRedirect(uri string) bool {
+	return uri != "" && slices.Contains(c.RedirectURIs, uri)
+}
@@ -0,0 +1,303 @@
+package maildoor_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestOIDC(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var code string
+	authorizations := &savedAuthorizations{InMemoryAuthorizationStore: maildoor.NewInMemoryAuthorizationStore()}
+	auth := maildoor.New(
+		maildoor.Prefix("/auth"),
+		maildoor.BaseURL("http://example.com"),
+		maildoor.JWT(nil, maildoor.ES256Key("k1", key)),
+		maildoor.OIDC(maildoor.NewInMemoryClientRegistry(
+			maildoor.Client{ID: "web", Secret: "s3cret", RedirectURIs: []string{"https://app.example.com/callback"}},
+			maildoor.Client{ID: "spa", RedirectURIs: []string{"https://spa.example.com/cb"}},
+		)),
+		maildoor.Authorizations(authorizations),
+		maildoor.ResendCooldown(0),
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			code = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+			return nil
+		}),
+	)
+
+	serve := func(req *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	post := func(path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+
+		return serve(req, cookies...)
+	}
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// authorize logs in through the pages and returns the redirect
+	// to the client.
+	authorize := func(client, redirectURI string) *url.URL {
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {client},
+			"redirect_uri":          {redirectURI},
+			"scope":                 {"openid email"},
+			"state":                 {"xyz"},
+			"nonce":                 {"n-0S6"},
+			"code_challenge":        {challenge},
+			"code_challenge_method": {"S256"},
+		}
+
+		w := serve(httptest.NewRequest("GET", "/auth/authorize?"+q.Encode(), nil))
+		testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+		testhelpers.Equals(t, "/auth/login", w.Header().Get("Location"))
+
+		cookie := w.Result().Cookies()[0]
+		post("/auth/email", url.Values{"email": {"a@b.com"}}, cookie)
+		w = post("/auth/code", url.Values{"email": {"a@b.com"}, "code": {code}}, cookie)
+		testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+
+		u, err := url.Parse(w.Header().Get("Location"))
+		testhelpers.NoError(t, err)
+
+		return u
+	}
+
+	w := serve(httptest.NewRequest("GET", "/auth/.well-known/openid-configuration", nil))
+	var discovery map[string]any
+	testhelpers.NoError(t, json.NewDecoder(w.Body).Decode(&discovery))
+	testhelpers.Equals(t, "http://example.com/auth", discovery["issuer"])
+	testhelpers.Equals(t, "http://example.com/auth/jwks.json", discovery["jwks_uri"])
+
+	u := authorize("web", "https://app.example.com/callback")
+	testhelpers.Equals(t, "app.example.com", u.Host)
+	testhelpers.Equals(t, "xyz", u.Query().Get("state"))
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {u.Query().Get("code")},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"code_verifier": {verifier},
+	}
+
+	req := httptest.NewRequest("POST", "/auth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("web", "s3cret")
+	w = serve(req)
+	testhelpers.Equals(t, http.StatusOK, w.Code)
+	testhelpers.Equals(t, "no-store", w.Header().Get("Cache-Control"))
+
+	var res struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		IDToken      string `json:"id_token"`
+	}
+
+	testhelpers.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+
+	parts := strings.Split(res.IDToken, ".")
+	testhelpers.Equals(t, 3, len(parts))
+
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]any
+	testhelpers.NoError(t, json.Unmarshal(payload, &claims))
+	testhelpers.Equals(t, "http://example.com/auth", claims["iss"])
+	testhelpers.Equals(t, "web", claims["aud"])
+	testhelpers.Equals(t, "a@b.com", claims["sub"])
+	testhelpers.Equals(t, "n-0S6", claims["nonce"])
+
+	// The pending request and the code went through the store.
+	testhelpers.Equals(t, 2, authorizations.saved)
+
+	payload, _ = base64.RawURLEncoding.DecodeString(strings.Split(res.AccessToken, ".")[1])
+	var access map[string]any
+	testhelpers.NoError(t, json.Unmarshal(payload, &access))
+	testhelpers.Equals(t, "web", access["aud"])
+	testhelpers.Equals(t, "web", access["client_id"])
+
+	// The access tokens of the client are not accepted by the app.
+	_, err := maildoor.VerifyAccessToken(auth, res.AccessToken)
+	testhelpers.Equals(t, maildoor.ErrInvalidToken, err)
+
+	t.Run("userinfo", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/auth/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+res.AccessToken)
+
+		w := serve(req)
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Body.String(), `"email":"a@b.com"`)
+
+		w = serve(httptest.NewRequest("GET", "/auth/userinfo", nil))
+		testhelpers.Equals(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("ID tokens are not access tokens", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/auth/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+res.IDToken)
+
+		w := serve(req)
+		testhelpers.Equals(t, http.StatusUnauthorized, w.Code)
+
+		_, err := maildoor.VerifyAccessToken(auth, res.IDToken)
+		testhelpers.Equals(t, maildoor.ErrInvalidToken, err)
+	})
+
+	t.Run("refresh tokens are bound to the client", func(t *testing.T) {
+		w := post("/auth/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {res.RefreshToken},
+			"client_id":     {"spa"},
+		})
+
+		testhelpers.Equals(t, http.StatusBadRequest, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "invalid_grant")
+
+		w = post("/auth/token/refresh", url.Values{"refresh_token": {res.RefreshToken}})
+		testhelpers.Equals(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("codes are used once", func(t *testing.T) {
+		form.Set("client_id", "web")
+		form.Set("client_secret", "s3cret")
+
+		w := post("/auth/token", form)
+		testhelpers.Equals(t, http.StatusBadRequest, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "invalid_grant")
+	})
+
+	t.Run("refresh grant", func(t *testing.T) {
+		w := post("/auth/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {res.RefreshToken},
+			"client_id":     {"web"},
+			"client_secret": {"s3cret"},
+		})
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "access_token")
+	})
+
+	t.Run("public clients need the verifier", func(t *testing.T) {
+		u := authorize("spa", "https://spa.example.com/cb")
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {"spa"},
+			"code":          {u.Query().Get("code")},
+			"redirect_uri":  {"https://spa.example.com/cb"},
+			"code_verifier": {"wrong"},
+		}
+
+		w := post("/auth/token", form)
+		testhelpers.Equals(t, http.StatusBadRequest, w.Code)
+
+		u = authorize("spa", "https://spa.example.com/cb")
+		form.Set("code", u.Query().Get("code"))
+		form.Set("code_verifier", verifier)
+
+		w = post("/auth/token", form)
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("rejects wrong client secrets", func(t *testing.T) {
+		w := post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "client_id": {"web"}, "client_secret": {"nope"}})
+		testhelpers.Equals(t, http.StatusUnauthorized, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "invalid_client")
+	})
+
+	t.Run("rejects unknown redirect URIs", func(t *testing.T) {
+		w := serve(httptest.NewRequest("GET", "/auth/authorize?client_id=web&redirect_uri=https://evil.com/&response_type=code", nil))
+		testhelpers.Equals(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("requires PKCE", func(t *testing.T) {
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {"web"},
+			"redirect_uri":  {"https://app.example.com/callback"},
+			"scope":         {"openid"},
+			"state":         {"abc"},
+		}
+
+		w := serve(httptest.NewRequest("GET", "/auth/authorize?"+q.Encode(), nil))
+		testhelpers.Equals(t, "https://app.example.com/callback?error=invalid_request&state=abc", w.Header().Get("Location"))
+	})
+
+	t.Run("requires an asymmetric key", func(t *testing.T) {
+		defer func() {
+			testhelpers.NotNil(t, recover())
+		}()
+
+		maildoor.New(
+			maildoor.BaseURL("http://example.com"),
+			maildoor.JWT(nil, maildoor.HS256Key("hs", bytes.Repeat([]byte("s"), 32))),
+			maildoor.OIDC(maildoor.NewInMemoryClientRegistry()),
+		)
+	})
+}
+
+// savedAuthorizations counts the authorizations saved to the store.
+type savedAuthorizations struct {
+	*maildoor.InMemoryAuthorizationStore
+	saved int
+}
+
+func (s *savedAuthorizations) Save(ctx context.Context, id string, a maildoor.Authorization) error {
+	s.saved++
+	return s.InMemoryAuthorizationStore.Save(ctx, id, a)
+}
+
+func TestOIDCSecureCookie(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	auth := maildoor.New(
+		maildoor.BaseURL("https://example.com"),
+		maildoor.JWT(nil, maildoor.ES256Key("k1", key)),
+		maildoor.OIDC(maildoor.NewInMemoryClientRegistry(
+			maildoor.Client{ID: "spa", RedirectURIs: []string{"https://spa.example.com/cb"}},
+		)),
+	)
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {"https://spa.example.com/cb"},
+		"scope":                 {"openid"},
+		"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		"code_challenge_method": {"S256"},
+	}
+
+	w := httptest.NewRecorder()
+	auth.ServeHTTP(w, httptest.NewRequest("GET", "/authorize?"+q.Encode(), nil))
+
+	cookie := w.Result().Cookies()[0]
+	testhelpers.Equals(t, "maildoor_oidc", cookie.Name)
+	testhelpers.True(t, cookie.Secure)
+}
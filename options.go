@@ -1,6 +1,15 @@
 package maildoor
 
-import "net/http"
+import (
+	"context"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
 
 // option for the auth
 type option func(*maildoor)
@@ -61,12 +70,100 @@ func EmailValidator(fn func(email string) error) option {
 	}
 }
 
+// NormalizeEmail sets the steps that turn the entered email into the
+// canonical one used for validation, the token storage, the events
+// and the AfterLogin hook (see EmailFrom). By default the email is
+// trimmed and its domain lowercased:
+//
+//	maildoor.NormalizeEmail(
+//		maildoor.TrimEmail,
+//		maildoor.LowercaseEmail,
+//		maildoor.PunycodeDomain,
+//		maildoor.FoldGmail,
+//	)
+func NormalizeEmail(steps ...Normalizer) option {
+	return func(m *maildoor) {
+		m.normalizers = steps
+	}
+}
+
 // EmailSender is the function that will be called after the email
 // has been determined to be valid. so the app can send the email to
 // the user with the token. Txt and html are the email body in plain text and html format.
 func EmailSender(fn func(to, html, txt string) error) option {
 	return func(m *maildoor) {
-		m.emailSender = fn
+		m.messageSender = func(msg Message) error {
+			return fn(msg.To, msg.HTML, msg.Text)
+		}
+	}
+}
+
+// MessageSender is like EmailSender but receives the whole message,
+// including the subject rendered from the subject template.
+func MessageSender(fn func(msg Message) error) option {
+	return func(m *maildoor) {
+		m.messageSender = fn
+	}
+}
+
+// EmailTemplates sets a FS to read the email templates from. The FS
+// may contain subject.txt, message.html and message.txt, files not
+// present fall back to the default ones.
+func EmailTemplates(fsys fs.FS) option {
+	return func(m *maildoor) {
+		m.emailFS = fsys
+	}
+}
+
+// EmailHTMLTemplate sets the template used for the html body
+// of the email. It receives an EmailData.
+func EmailHTMLTemplate(t *template.Template) option {
+	return func(m *maildoor) {
+		m.emailHTML = t
+	}
+}
+
+// EmailTextTemplate sets the template used for the plain text
+// body of the email. It receives an EmailData.
+func EmailTextTemplate(t *texttemplate.Template) option {
+	return func(m *maildoor) {
+		m.emailText = t
+	}
+}
+
+// EmailSubjectTemplate sets the template used for the subject
+// of the email. It receives an EmailData.
+func EmailSubjectTemplate(t *texttemplate.Template) option {
+	return func(m *maildoor) {
+		m.emailSubject = t
+	}
+}
+
+// BaseURL sets the absolute URL the app is served from (e.g.
+// https://example.com), used to build the links and the logo URL in
+// the emails. Without it the emails go without them, the request host
+// is never used since anyone can set it. CrossDeviceApproval,
+// Invitations, JWT and Passkeys require it.
+func BaseURL(u string) option {
+	return func(m *maildoor) {
+		m.baseURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+// SupportURL sets a URL users can reach for help, it is passed
+// to the email templates.
+func SupportURL(u string) option {
+	return func(m *maildoor) {
+		m.supportURL = u
+	}
+}
+
+// IPLocator sets the function used to describe the location
+// of the IP that requested a code (e.g. "Bogotá, Colombia"),
+// it is passed to the email templates.
+func IPLocator(fn func(ip string) string) option {
+	return func(m *maildoor) {
+		m.ipLocator = fn
 	}
 }
 
@@ -88,6 +185,242 @@ func CodeRenderer(fn func(data Attempt) (string, error)) option {
 	}
 }
 
+// SignupRenderer sets a custom renderer function for the signup page,
+// Attempt.Fields contains the fields to render with their values.
+// If not set, the default template will be used.
+func SignupRenderer(fn func(data Attempt) (string, error)) option {
+	return func(m *maildoor) {
+		m.signupRenderer = fn
+	}
+}
+
+// Signup enables the signup flow at {prefix}/signup. The form asks for
+// the email and the passed fields, the user is created in the store
+// once the email is verified with the login code. Emails without a
+// user are sent to the signup page after entering the code. Use
+// IsNewSignup and UserFrom in the AfterLogin hook.
+func Signup(store UserStore, fields ...SignupField) option {
+	return func(m *maildoor) {
+		m.userStore = store
+		m.signupFields = fields
+	}
+}
+
+// PendingSignups sets the store that keeps the signup values until the
+// email is verified, in memory by default. Pass a shared store when
+// running several instances.
+func PendingSignups(store PendingSignupStore) option {
+	return func(m *maildoor) {
+		m.pendingSignups = store
+	}
+}
+
+// StatelessCodes derives the login codes from an encrypted challenge
+// (email, expiry and nonce) sent to the browser in a hidden field and a
+// cookie, instead of keeping them in the TokenStorage. The secret needs
+// to be at least 32 random bytes and shared by all the instances, codes
+// are valid for ttl (10 minutes when 0). Used challenges are recorded in
+// memory, pass a shared cache with UsedNonces when running several
+// instances.
+func StatelessCodes(secret []byte, ttl time.Duration) option {
+	return func(m *maildoor) {
+		m.statelessSecret = secret
+		m.statelessTTL = ttl
+	}
+}
+
+// UsedNonces sets the cache that remembers the used challenges of
+// the stateless codes so they can't be replayed, and the accepted or
+// revoked invitations.
+func UsedNonces(cache NonceCache) option {
+	return func(m *maildoor) {
+		m.usedNonces = cache
+	}
+}
+
+// CrossDeviceApproval makes the emailed link approve the login waiting
+// in the browser that requested the code, e.g. the code is requested on
+// a desktop and the email read on a phone. The code page polls
+// {prefix}/status and completes the login once the link is approved,
+// the code keeps working as well. Waiting logins are kept in the
+// ApprovalStore, see Approvals.
+func CrossDeviceApproval() option {
+	return func(m *maildoor) {
+		m.crossDevice = true
+	}
+}
+
+// Approvals sets the store of the logins waiting for approval, in
+// memory by default. Pass a shared store when running several
+// instances.
+func Approvals(store ApprovalStore) option {
+	return func(m *maildoor) {
+		m.approvals = store
+	}
+}
+
+// StepUp enables RequireRecentLogin, logins and code challenges record
+// the time the email was verified in a cookie signed with the secret
+// (at least 32 random bytes). Verifications are recent for maxAge, 15
+// minutes by default. New panics if the secret is too short.
+func StepUp(secret []byte, maxAge time.Duration) option {
+	return func(m *maildoor) {
+		m.stepUpSecret = secret
+		m.stepUpMaxAge = maxAge
+	}
+}
+
+// EmailChange enables {prefix}/change-email, where signed in users
+// enter a new email and confirm the change with a code sent to the
+// current email and another one sent to the new email. The signedIn
+// function returns the email of the signed in user (usually from the
+// application session), onChange is called with the current and new
+// emails once both codes are entered and, like AfterLogin, writes the
+// response.
+func EmailChange(signedIn func(r *http.Request) string, onChange func(w http.ResponseWriter, r *http.Request, oldEmail, newEmail string)) option {
+	return func(m *maildoor) {
+		m.emailChange = &emailChange{signedIn: signedIn, onChange: onChange}
+	}
+}
+
+// Invitations enables SendInvite and RevokeInvite, invitations are
+// signed with the secret (at least 32 random bytes) and valid for ttl,
+// 7 days when 0. Invited emails don't go through EmailValidator and
+// each invitation can be accepted once.
+//
+// Accepted and revoked invitations are recorded in the UsedNonces
+// cache, which is required: New panics without it. Pass a cache shared
+// by all the instances, an in-memory one only works for a single
+// instance and forgets them on restarts.
+func Invitations(secret []byte, ttl time.Duration) option {
+	return func(m *maildoor) {
+		m.invitesSecret = secret
+		m.invitesTTL = ttl
+	}
+}
+
+// InviteTemplates sets a FS to read the invitation email templates
+// from (subject.txt, message.html and message.txt), files not present
+// fall back to the login email templates. They receive an EmailData
+// with the Invitation.
+func InviteTemplates(fsys fs.FS) option {
+	return func(m *maildoor) {
+		m.invitesFS = fsys
+	}
+}
+
+// OnInviteAccepted sets the function called instead of AfterLogin when
+// the invited user verifies the email, it receives the invitation (e.g.
+// to create the account with its role) and writes the response.
+func OnInviteAccepted(fn func(w http.ResponseWriter, r *http.Request, inv Invitation)) option {
+	return func(m *maildoor) {
+		m.onInviteAccepted = fn
+	}
+}
+
+// JWT issues a signed access token and a refresh token after the code
+// is verified. API clients get them as JSON by posting the code with
+// "Accept: application/json", otherwise AfterLogin is called with them
+// (see TokensFrom). The first key signs the access tokens, the rest
+// still verify them so keys can be rotated by their kid. Refresh tokens
+// are kept in the store, in memory when nil, and exchanged for new ones
+// at {prefix}/token/refresh. New panics if a key is not valid.
+func JWT(store RefreshTokenStore, keys ...SigningKey) option {
+	return func(m *maildoor) {
+		m.refreshStore = store
+		m.signingKeys = keys
+	}
+}
+
+// TokenTTL sets the lifetime of the access and refresh tokens, 15
+// minutes and 30 days by default.
+func TokenTTL(access, refresh time.Duration) option {
+	return func(m *maildoor) {
+		m.accessTTL = access
+		m.refreshTTL = refresh
+	}
+}
+
+// TokenClaims sets a function that returns extra claims for the access
+// tokens of the email (e.g. roles). The iss, aud, sub, email, iat,
+// exp and jti claims are always set by maildoor.
+func TokenClaims(fn func(ctx context.Context, email string) (map[string]any, error)) option {
+	return func(m *maildoor) {
+		m.tokenClaims = fn
+	}
+}
+
+// OIDC makes maildoor a minimal OpenID Connect provider for the
+// clients in the registry, apps in other languages log their users in
+// with the authorization code flow and PKCE through the login pages.
+// It requires JWT with an ES256 or EdDSA key to sign the ID tokens.
+// Authorization requests and codes are kept in memory unless a store
+// is set with Authorizations.
+func OIDC(clients ClientRegistry) option {
+	return func(m *maildoor) {
+		m.oidc = newOIDC(clients)
+	}
+}
+
+// Authorizations sets the store of the OpenID Connect authorization
+// requests and codes, in memory by default. Pass a shared store when
+// running several instances.
+func Authorizations(store AuthorizationStore) option {
+	return func(m *maildoor) {
+		m.authorizations = store
+	}
+}
+
+// Tenants serves many workspaces with the handler, each request is
+// served with the branding, validator, sender, templates and storage
+// namespace of the tenant the resolver returns for it. Requests for
+// unknown tenants get a 404.
+//
+//	maildoor.Tenants(maildoor.TenantByHost(),
+//		maildoor.Tenant{ID: "acme.example.com", ProductName: "Acme"},
+//		maildoor.Tenant{ID: "globex.example.com", ProductName: "Globex"},
+//	)
+func Tenants(resolver TenantResolver, tenants ...Tenant) option {
+	return func(m *maildoor) {
+		m.tenantResolver = resolver
+		m.tenantConfigs = tenants
+	}
+}
+
+// Passkeys offers to register a passkey after logging in with the email
+// code and adds "Sign in with a passkey" to the login page. Passkeys are
+// saved in the credential store.
+func Passkeys(store CredentialStore) option {
+	return func(m *maildoor) {
+		m.credentials = store
+		m.ceremonies = newCeremonies()
+	}
+}
+
+// RelyingPartyID sets the WebAuthn relying party ID of the passkeys,
+// e.g. example.com to share them between its subdomains. It must be
+// the host of BaseURL or a parent domain of it, the host of BaseURL is
+// used by default.
+func RelyingPartyID(id string) option {
+	return func(m *maildoor) {
+		m.rpID = id
+	}
+}
+
+// QRHandoff shows a QR code in the code page to approve the login from
+// a device already signed in with the same email, e.g. a phone. The
+// signedIn function returns the email signed in on the device scanning
+// the code (usually read from the application session) or an empty
+// string. The tokens in the QR codes are signed with a key derived from
+// the secret (at least 32 random bytes), New panics if it is too short.
+// It requires CrossDeviceApproval.
+func QRHandoff(secret []byte, signedIn func(r *http.Request) string) option {
+	return func(m *maildoor) {
+		m.handoffSecret = secret
+		m.handoffSignedIn = signedIn
+	}
+}
+
 // WithTokenStorage sets a custom token storage implementation.
 // This allows you to use Redis, database, or any other storage backend
 // instead of the default in-memory storage. The storage implementation
@@ -97,3 +430,167 @@ func WithTokenStorage(storage TokenStorage) option {
 		m.tokenStorage = storage
 	}
 }
+
+// DefaultLocale sets the locale used when none of the locales
+// requested by the user is supported. By default it is en.
+func DefaultLocale(l string) option {
+	return func(m *maildoor) {
+		m.defaultLocale = strings.ToLower(l)
+	}
+}
+
+// Translations registers the messages for the passed locale, they
+// are merged with the bundled messages (en, es and pt) so it can be
+// used to add a new locale or to change some of the existing copy.
+func Translations(locale string, messages map[string]string) option {
+	return func(m *maildoor) {
+		m.catalog.add(locale, messages)
+	}
+}
+
+// Templates sets a FS that overlays the default page templates, files
+// in it (e.g. layout.html, handle_login.html or handle_code.html) take
+// precedence over the bundled ones with the same name.
+func Templates(fsys fs.FS) option {
+	return func(m *maildoor) {
+		m.templatesFS = fsys
+	}
+}
+
+// TemplateFuncs adds functions to the ones available in the page
+// templates. These are merged with the default ones (prefixedPath).
+func TemplateFuncs(funcs template.FuncMap) option {
+	return func(m *maildoor) {
+		if m.funcs == nil {
+			m.funcs = template.FuncMap{}
+		}
+
+		for k, fn := range funcs {
+			m.funcs[k] = fn
+		}
+	}
+}
+
+// SecurityHeaders sets headers on every response, these are merged
+// with the defaults (Content-Security-Policy, X-Frame-Options,
+// Referrer-Policy, X-Content-Type-Options and Cache-Control). An empty
+// value removes a default header and {nonce} is replaced with the
+// request CSP nonce, available to renderers as Attempt.Nonce.
+func SecurityHeaders(headers map[string]string) option {
+	return func(m *maildoor) {
+		for k, v := range headers {
+			m.securityHeaders[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+}
+
+// OnEvent registers a handler for the events of the authentication
+// flow (code requested, sent, invalid, login...), it can be called
+// multiple times to register several handlers.
+func OnEvent(h EventHandler) option {
+	return func(m *maildoor) {
+		m.eventHandlers = append(m.eventHandlers, h)
+	}
+}
+
+// MaxCodeAttempts sets the number of wrong codes allowed for an email
+// before its code gets invalidated and a new one has to be requested.
+// Requesting another code doesn't reset the attempts. By default there
+// is no limit.
+func MaxCodeAttempts(n int) option {
+	return func(m *maildoor) {
+		m.maxAttempts = n
+	}
+}
+
+// FailedAttempts sets the counter of the wrong codes for MaxCodeAttempts,
+// in memory by default. Pass a shared counter when running several
+// instances so they share the limit.
+func FailedAttempts(counter AttemptCounter) option {
+	return func(m *maildoor) {
+		m.attempts = counter
+	}
+}
+
+// ResendCooldown sets the time an email needs to wait after a code was
+// sent before {prefix}/email or {prefix}/resend send it another one, 30
+// seconds by default. Zero disables the cooldown.
+func ResendCooldown(d time.Duration) option {
+	return func(m *maildoor) {
+		m.resendCooldown = d
+	}
+}
+
+// Cooldowns sets the store of the resend cooldowns, in memory by
+// default. Pass a shared store when running several instances so the
+// cooldown applies to all of them and survives restarts.
+func Cooldowns(store CooldownStore) option {
+	return func(m *maildoor) {
+		m.cooldowns = store
+	}
+}
+
+// WithAuditLog writes the events of the authentication flow to
+// the passed audit log, e.g. a FileAuditLog.
+func WithAuditLog(l AuditLog) option {
+	return func(m *maildoor) {
+		m.eventHandlers = append(m.eventHandlers, auditHandler{log: l})
+	}
+}
+
+// WithMetrics records maildoor metrics (codes issued, send latency
+// and failures, verifications, lockouts and request durations) in
+// the passed Metrics, e.g. a MetricsRegistry.
+func WithMetrics(metrics Metrics) option {
+	return func(m *maildoor) {
+		m.metrics = metrics
+	}
+}
+
+// ServeMetrics exposes the metrics at {prefix}/metrics when the Metrics
+// passed to WithMetrics is an http.Handler (as MetricsRegistry is).
+// The endpoint is public, protect it or mount the registry elsewhere
+// when maildoor is exposed to the internet.
+func ServeMetrics() option {
+	return func(m *maildoor) {
+		m.serveMetrics = true
+	}
+}
+
+// Logger sets the logger maildoor uses, by default slog.Default().
+// Email addresses are replaced by their hash (see HashEmail) in the
+// messages and attributes maildoor logs.
+func Logger(l *slog.Logger) option {
+	return func(m *maildoor) {
+		m.logger = l
+	}
+}
+
+// EmailHashKey sets the key of the HMAC that hashes the emails in the
+// logs and spans. It is random by default, so the hashes of a user
+// only match within a process. Pass the same secret key (at least 32
+// random bytes) to all the instances to correlate their logs. New
+// panics if the key is too short.
+func EmailHashKey(key []byte) option {
+	return func(m *maildoor) {
+		m.emailKey = key
+	}
+}
+
+// RequestIDHeader sets the header the request id is read from and
+// written to, by default X-Request-ID. When the request does not have
+// it maildoor generates a new id.
+func RequestIDHeader(name string) option {
+	return func(m *maildoor) {
+		m.requestIDHeader = name
+	}
+}
+
+// WithTracer sets the tracer maildoor uses to create spans around
+// token storage, page and email rendering and email sending. Spans
+// carry the hashed email (see HashEmail), never the address.
+func WithTracer(t Tracer) option {
+	return func(m *maildoor) {
+		m.tracer = t
+	}
+}
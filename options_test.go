@@ -235,7 +235,7 @@ func TestOptions(t *testing.T) {
 		// Should contain default product name
 		testhelpers.Contains(t, w.Body.String(), "Maildoor")
 		// Should contain default logo URL
-		testhelpers.Contains(t, w.Body.String(), "maildoor_logo.png")
+		testhelpers.Contains(t, w.Body.String(), "/assets/logo.")
 	})
 
 	t.Run("empty prefix option", func(t *testing.T) {
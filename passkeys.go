@@ -0,0 +1,319 @@
+package maildoor
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wawandco/maildoor/internal/webauthn"
+)
+
+const (
+	// webauthnCookie identifies the passkey ceremony of the browser.
+	webauthnCookie = "maildoor_webauthn"
+
+	// webauthnTTL is the time to complete a passkey ceremony.
+	webauthnTTL = 5 * time.Minute
+
+	// passkeyOfferedKey marks the logins that shouldn't be offered a
+	// passkey, e.g. the ones using a passkey already.
+	passkeyOfferedKey contextKey = "passkey_offered"
+)
+
+var (
+	// ErrCredentialNotFound is returned by CredentialStore.Find when
+	// there is no credential with the id.
+	ErrCredentialNotFound = errors.New("maildoor: credential not found")
+
+	// errCredentialRegistered is returned when a registration reuses
+	// the id of a credential in the store.
+	errCredentialRegistered = errors.New("passkey already registered")
+)
+
+// Credential is a passkey registered after logging in with the
+// email code.
+type Credential struct {
+	ID []byte
+
+	// Email is the email of the user. With Tenants it is prefixed with
+	// the Namespace of the tenant and a colon, e.g. acme:a@b.com, so
+	// passkeys only log in to the tenant they were registered with.
+	Email string
+
+	// PublicKey is the COSE encoding of the credential key.
+	PublicKey []byte
+
+	// SignCount is the signature counter of the authenticator,
+	// it detects cloned authenticators.
+	SignCount uint32
+
+	CreatedAt time.Time
+}
+
+// CredentialStore keeps the passkeys of the users, it allows to
+// keep them in a database or any other backend.
+type CredentialStore interface {
+	// Find returns the credential with the id or ErrCredentialNotFound.
+	Find(ctx context.Context, id []byte) (Credential, error)
+
+	// List returns the credentials of the email.
+	List(ctx context.Context, email string) ([]Credential, error)
+
+	// Add saves a new credential.
+	Add(ctx context.Context, c Credential) error
+
+	// UpdateSignCount saves the signature counter of the credential
+	// after a login.
+	UpdateSignCount(ctx context.Context, id []byte, count uint32) error
+}
+
+// InMemoryCredentialStore keeps the credentials in memory, it is
+// meant for development and tests.
+type InMemoryCredentialStore struct {
+	mu          sync.RWMutex
+	credentials []Credential
+}
+
+// NewInMemoryCredentialStore creates an empty in-memory credential store.
+func NewInMemoryCredentialStore() *InMemoryCredentialStore {
+	return &InMemoryCredentialStore{}
+}
+
+// Find implements CredentialStore.Find
+func (s *InMemoryCredentialStore) Find(ctx context.Context, id []byte) (Credential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, c := range s.credentials {
+		if bytes.Equal(c.ID, id) {
+			return c, nil
+		}
+	}
+
+	return Credential{}, ErrCredentialNotFound
+}
+
+// List implements CredentialStore.List
+func (s *InMemoryCredentialStore) List(ctx context.Context, email string) ([]Credential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var list []Credential
+	for _, c := range s.credentials {
+		if c.Email == email {
+			list = append(list, c)
+		}
+	}
+
+	return list, nil
+}
+
+// Add implements CredentialStore.Add
+func (s *InMemoryCredentialStore) Add(ctx context.Context, c Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.credentials = append(s.credentials, c)
+	return nil
+}
+
+// UpdateSignCount implements CredentialStore.UpdateSignCount
+func (s *InMemoryCredentialStore) UpdateSignCount(ctx context.Context, id []byte, count uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.credentials {
+		if bytes.Equal(c.ID, id) {
+			s.credentials[i].SignCount = count
+			return nil
+		}
+	}
+
+	return ErrCredentialNotFound
+}
+
+// ceremony is a passkey registration or login in progress. Email is
+// set for the registrations, offered once the email was verified.
+type ceremony struct {
+	email     string
+	challenge []byte
+	expires   time.Time
+}
+
+// ceremonies keeps the passkey ceremonies in progress in memory.
+type ceremonies struct {
+	mu   sync.Mutex
+	byID map[string]*ceremony
+}
+
+func newCeremonies() *ceremonies {
+	return &ceremonies{byID: map[string]*ceremony{}}
+}
+
+// start stores a new ceremony for the email under the key, removing
+// the expired ones.
+func (c *ceremonies) start(key, email string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for id, cr := range c.byID {
+		if now.After(cr.expires) {
+			delete(c.byID, id)
+		}
+	}
+
+	c.byID[key] = &ceremony{email: email, expires: now.Add(webauthnTTL)}
+}
+
+// challenge sets a new challenge for the ceremony and returns it
+// with the email of the ceremony.
+func (c *ceremonies) challenge(id string) ([]byte, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cr, ok := c.byID[id]
+	if !ok || time.Now().After(cr.expires) {
+		return nil, "", false
+	}
+
+	cr.challenge = make([]byte, 32)
+	rand.Read(cr.challenge)
+
+	return cr.challenge, cr.email, true
+}
+
+// take removes the ceremony and returns it, ceremonies can only
+// be completed once.
+func (c *ceremonies) take(id string) (ceremony, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cr, ok := c.byID[id]
+	delete(c.byID, id)
+	if !ok || time.Now().After(cr.expires) {
+		return ceremony{}, false
+	}
+
+	return *cr, true
+}
+
+// startCeremony starts a passkey ceremony for the email in the tenant
+// of the request, binds it to the browser with a cookie and returns
+// its key.
+func (m *maildoor) startCeremony(w http.ResponseWriter, r *http.Request, email string) string {
+	id := randomToken()
+	m.ceremonies.start(m.storageKey(r, id), email)
+	http.SetCookie(w, &http.Cookie{
+		Name:     webauthnCookie,
+		Value:    id,
+		Path:     m.tenant(r).prefix,
+		MaxAge:   int(webauthnTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   m.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return m.storageKey(r, id)
+}
+
+// takeCeremony removes the passkey ceremony of the browser and
+// returns it.
+func (m *maildoor) takeCeremony(w http.ResponseWriter, r *http.Request) (ceremony, bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     webauthnCookie,
+		Path:     m.tenant(r).prefix,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   m.secureCookies(),
+	})
+
+	return m.ceremonies.take(m.ceremonyID(r))
+}
+
+// ceremonyID returns the key of the passkey ceremony of the browser in
+// the tenant of the request.
+func (m *maildoor) ceremonyID(r *http.Request) string {
+	c, err := r.Cookie(webauthnCookie)
+	if err != nil {
+		return ""
+	}
+
+	return m.storageKey(r, c.Value)
+}
+
+// webauthnCeremony returns what the responses of the authenticator
+// are verified against. The origin comes from BaseURL and the relying
+// party is RelyingPartyID or the host of the origin, never the host of
+// the request.
+func (m *maildoor) webauthnCeremony(r *http.Request, challenge []byte) webauthn.Ceremony {
+	origin, host := originHost(m.origin(r))
+	return webauthn.Ceremony{Challenge: challenge, Origin: origin, RPID: cmp.Or(m.rpID, host)}
+}
+
+// originHost returns the origin of the base URL, which may include a
+// path, and its host name without the port.
+func originHost(base string) (string, string) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return base, base
+	}
+
+	return u.Scheme + "://" + u.Host, u.Hostname()
+}
+
+// offerPasskey renders the page offering to register a passkey to the
+// users without one, right after verifying their email. It returns
+// false when the login should continue.
+func (m *maildoor) offerPasskey(w http.ResponseWriter, r *http.Request, email string) bool {
+	if m.credentials == nil || r.Context().Value(passkeyOfferedKey) != nil {
+		return false
+	}
+
+	// New users are offered a passkey once they signed up.
+	if m.userStore != nil {
+		if _, err := m.userStore.Find(r.Context(), email); err != nil {
+			return false
+		}
+	}
+
+	list, err := m.credentials.List(r.Context(), m.storageKey(r, email))
+	if err != nil || len(list) > 0 {
+		return false
+	}
+
+	m.startCeremony(w, r, email)
+
+	data := m.attempt(r)
+	data.Email = email
+	m.writePasskeyPage(w, r, data)
+
+	return true
+}
+
+// credentialEmail returns the email of the credential when it was
+// registered with the tenant of the request.
+func (m *maildoor) credentialEmail(r *http.Request, cred Credential) (string, bool) {
+	return strings.CutPrefix(cred.Email, m.storageKey(r, ""))
+}
+
+// continueLogin completes the login of the email without offering
+// a passkey.
+func (m *maildoor) continueLogin(w http.ResponseWriter, r *http.Request, email string) {
+	r = r.WithContext(context.WithValue(r.Context(), passkeyOfferedKey, true))
+	m.completeLogin(w, r, email)
+}
+
+// decodeField returns the base64url encoded form field.
+func decodeField(r *http.Request, name string) []byte {
+	b, _ := base64.RawURLEncoding.DecodeString(r.FormValue(name))
+	return b
+}
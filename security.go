@@ -0,0 +1,79 @@
+package maildoor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const nonceKey contextKey = "nonce"
+
+// noncePlaceholder is replaced with the request nonce in the
+// values of the security headers.
+const noncePlaceholder = "{nonce}"
+
+// defaultSecurityHeaders are the headers set on every response,
+// the CSP only allows inline scripts and styles with the request
+// nonce and prevents the pages from being framed.
+func defaultSecurityHeaders() map[string]string {
+	return map[string]string{
+		"Content-Security-Policy": strings.Join([]string{
+			"default-src 'self'",
+			"script-src 'self' 'nonce-{nonce}'",
+			"style-src 'self' 'nonce-{nonce}'",
+			"img-src 'self' https: data:",
+			"object-src 'none'",
+			"base-uri 'none'",
+			"frame-ancestors 'none'",
+		}, "; "),
+
+		"X-Frame-Options":        "DENY",
+		"X-Content-Type-Options": "nosniff",
+
+		// Magic links carry the code in the query, no referrer
+		// prevents it from leaking to other sites.
+		"Referrer-Policy": "no-referrer",
+
+		// Pages show emails and codes so these should not be stored,
+		// assets override it to be cached.
+		"Cache-Control": "no-store",
+	}
+}
+
+// newNonce returns a random base64 value to be used as CSP nonce.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// withSecurityHeaders generates the request nonce, sets the security
+// headers on the response and adds the nonce to the request context.
+func (m *maildoor) withSecurityHeaders(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return r, err
+	}
+
+	for k, v := range m.securityHeaders {
+		if v == "" {
+			continue
+		}
+
+		w.Header().Set(k, strings.ReplaceAll(v, noncePlaceholder, nonce))
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), nonceKey, nonce)), nil
+}
+
+// NonceFrom returns the CSP nonce for the request, pages rendered
+// by the AfterLogin hook need it in their inline scripts and styles.
+func NonceFrom(r *http.Request) string {
+	n, _ := r.Context().Value(nonceKey).(string)
+	return n
+}
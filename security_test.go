@@ -0,0 +1,110 @@
+package maildoor_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	t.Run("default headers", func(t *testing.T) {
+		var nonce string
+		auth := maildoor.New(
+			maildoor.LoginRenderer(func(data maildoor.Attempt) (string, error) {
+				nonce = data.Nonce
+				return "login", nil
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.NotEquals(t, "", nonce)
+		testhelpers.Contains(t, w.Header().Get("Content-Security-Policy"), fmt.Sprintf("script-src 'self' 'nonce-%s'", nonce))
+		testhelpers.Contains(t, w.Header().Get("Content-Security-Policy"), "frame-ancestors 'none'")
+		testhelpers.Equals(t, "DENY", w.Header().Get("X-Frame-Options"))
+		testhelpers.Equals(t, "no-referrer", w.Header().Get("Referrer-Policy"))
+		testhelpers.Equals(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		testhelpers.Equals(t, "no-store", w.Header().Get("Cache-Control"))
+	})
+
+	t.Run("nonce changes per request", func(t *testing.T) {
+		auth := maildoor.New()
+
+		csp := func() string {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/login", nil)
+			auth.ServeHTTP(w, req)
+
+			return w.Header().Get("Content-Security-Policy")
+		}
+
+		testhelpers.NotEquals(t, csp(), csp())
+	})
+
+	t.Run("code pages are not stored", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.EmailSender(func(to, html, txt string) error {
+				return nil
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {"test@example.com"}}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Equals(t, "no-store", w.Header().Get("Cache-Control"))
+	})
+
+	t.Run("assets can be cached", func(t *testing.T) {
+		auth := maildoor.New()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/assets/logo.png", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, "no-cache", w.Header().Get("Cache-Control"))
+	})
+
+	t.Run("custom headers", func(t *testing.T) {
+		var nonce string
+		auth := maildoor.New(
+			maildoor.SecurityHeaders(map[string]string{
+				"content-security-policy":   "default-src 'self'; script-src 'nonce-{nonce}'; frame-ancestors https://app.example.com",
+				"X-Frame-Options":           "",
+				"Strict-Transport-Security": "max-age=63072000",
+			}),
+			maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+				nonce = maildoor.NonceFrom(r)
+			}),
+			maildoor.WithTokenStorage(storageWith("test@example.com", "123456")),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/code", nil)
+		req.Form = url.Values{"email": {"test@example.com"}, "code": {"123456"}}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, "default-src 'self'; script-src 'nonce-"+nonce+"'; frame-ancestors https://app.example.com", w.Header().Get("Content-Security-Policy"))
+		testhelpers.Equals(t, "", w.Header().Get("X-Frame-Options"))
+		testhelpers.Equals(t, "max-age=63072000", w.Header().Get("Strict-Transport-Security"))
+		testhelpers.Equals(t, "no-referrer", w.Header().Get("Referrer-Policy"))
+	})
+}
+
+// storageWith returns an in memory token storage with the
+// passed token stored for the email.
+func storageWith(email, token string) maildoor.TokenStorage {
+	s := maildoor.NewInMemoryTokenStorage(0)
+	s.Store(email, token)
+
+	return s
+}
@@ -0,0 +1,247 @@
+package maildoor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// challengeField is the form field and challengeCookie the cookie
+	// that carry the challenge of the stateless codes.
+	challengeField  = "challenge"
+	challengeCookie = "maildoor_challenge"
+
+	// defaultStatelessTTL is the time stateless codes are valid for
+	// when no TTL is passed.
+	defaultStatelessTTL = 10 * time.Minute
+)
+
+var (
+	errChallengeInvalid = errors.New("maildoor: invalid challenge")
+	errChallengeExpired = errors.New("maildoor: challenge expired")
+	errChallengeUsed    = errors.New("maildoor: challenge already used")
+)
+
+// NonceCache remembers the nonces of the stateless codes that were
+// used so they can't be replayed. Services with several instances
+// should share it, e.g. with Redis.
+type NonceCache interface {
+	// Use records the nonce as used until expires, it returns false
+	// when the nonce was already used.
+	Use(nonce string, expires time.Time) bool
+
+	// Used returns true when the nonce was already used.
+	Used(nonce string) bool
+}
+
+// InMemoryNonceCache is a NonceCache that keeps the nonces in memory
+// until they expire.
+type InMemoryNonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+// NewInMemoryNonceCache creates an empty in-memory nonce cache.
+func NewInMemoryNonceCache() *InMemoryNonceCache {
+	return &InMemoryNonceCache{nonces: map[string]time.Time{}}
+}
+
+// Use implements NonceCache.Use
+func (c *InMemoryNonceCache) Use(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for n, exp := range c.nonces {
+		if now.After(exp) {
+			delete(c.nonces, n)
+		}
+	}
+
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+
+	c.nonces[nonce] = expires
+	return true
+}
+
+// Used implements NonceCache.Used
+func (c *InMemoryNonceCache) Used(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.nonces[nonce]
+	return ok
+}
+
+// challenge is the content of the encrypted blob sent to the
+// browser instead of storing the code.
+type challenge struct {
+	Email   string `json:"e"`
+	Expires int64  `json:"x"`
+	Nonce   string `json:"n"`
+}
+
+// statelessCodes derives the login codes from encrypted challenges so
+// no server side storage is needed, only the used nonces are kept.
+type statelessCodes struct {
+	aead    cipher.AEAD
+	codeKey []byte
+	ttl     time.Duration
+	nonces  NonceCache
+}
+
+// newStatelessCodes derives the encryption and code keys from the secret.
+func newStatelessCodes(secret []byte, ttl time.Duration, nonces NonceCache) (*statelessCodes, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("the secret must be at least 32 bytes")
+	}
+
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+
+	block, err := aes.NewCipher(derive("maildoor challenge encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl <= 0 {
+		ttl = defaultStatelessTTL
+	}
+
+	if nonces == nil {
+		nonces = NewInMemoryNonceCache()
+	}
+
+	return &statelessCodes{
+		aead:    aead,
+		codeKey: derive("maildoor challenge code"),
+		ttl:     ttl,
+		nonces:  nonces,
+	}, nil
+}
+
+// issue creates a challenge for the email and returns its code along
+// with the encrypted challenge.
+func (s *statelessCodes) issue(email string) (string, string, error) {
+	n := make([]byte, 16)
+	if _, err := rand.Read(n); err != nil {
+		return "", "", err
+	}
+
+	c := challenge{
+		Email:   email,
+		Expires: time.Now().Add(s.ttl).Unix(),
+		Nonce:   hex.EncodeToString(n),
+	}
+
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+
+	blob := s.aead.Seal(nonce, nonce, payload, nil)
+	return s.code(c), base64.RawURLEncoding.EncodeToString(blob), nil
+}
+
+// open decrypts the challenge and checks it belongs to the email, has
+// not expired and was not used.
+func (s *statelessCodes) open(blob, email string) (challenge, error) {
+	var c challenge
+	b, err := base64.RawURLEncoding.DecodeString(blob)
+	if err != nil || len(b) < s.aead.NonceSize() {
+		return c, errChallengeInvalid
+	}
+
+	ns := s.aead.NonceSize()
+	payload, err := s.aead.Open(nil, b[:ns], b[ns:], nil)
+	if err != nil {
+		return c, errChallengeInvalid
+	}
+
+	if err := json.Unmarshal(payload, &c); err != nil || c.Email != email {
+		return c, errChallengeInvalid
+	}
+
+	if time.Now().Unix() > c.Expires {
+		return c, errChallengeExpired
+	}
+
+	if s.nonces.Used(c.Nonce) {
+		return c, errChallengeUsed
+	}
+
+	return c, nil
+}
+
+// use marks the challenge as used, it returns false when it already was.
+func (s *statelessCodes) use(c challenge) bool {
+	return s.nonces.Use(c.Nonce, time.Unix(c.Expires, 0))
+}
+
+// code derives the six digit code of the challenge.
+func (s *statelessCodes) code(c challenge) string {
+	mac := hmac.New(sha256.New, s.codeKey)
+	fmt.Fprintf(mac, "%s|%s|%d", c.Nonce, c.Email, c.Expires)
+	sum := mac.Sum(nil)
+
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum)%1000000)
+}
+
+// requestChallenge returns the challenge in the form or the cookie.
+func (m *maildoor) requestChallenge(r *http.Request) string {
+	if c := r.FormValue(challengeField); c != "" {
+		return c
+	}
+
+	if c, err := r.Cookie(challengeCookie); err == nil {
+		return c.Value
+	}
+
+	return ""
+}
+
+// setChallenge sends the challenge to the browser in a cookie, the code
+// page has it in a hidden field as well.
+func (m *maildoor) setChallenge(w http.ResponseWriter, r *http.Request, data *Attempt, challenge string) {
+	if challenge == "" {
+		return
+	}
+
+	data.Challenge = challenge
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    challenge,
+		Path:     m.tenant(r).prefix,
+		MaxAge:   int(m.stateless.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   m.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
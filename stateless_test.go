@@ -0,0 +1,151 @@
+package maildoor_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+// failingStorage fails the test when the token storage is used.
+type failingStorage struct{ t *testing.T }
+
+func (s failingStorage) Store(email, token string) error { s.t.Fatal("storage used"); return nil }
+func (s failingStorage) Get(email string) (string, bool) { s.t.Fatal("storage used"); return "", false }
+func (s failingStorage) Delete(email string) bool        { s.t.Fatal("storage used"); return false }
+
+func TestStatelessCodes(t *testing.T) {
+	secret := []byte(strings.Repeat("s", 32))
+	codePattern := regexp.MustCompile(`\b\d{6}\b`)
+	challengePattern := regexp.MustCompile(`name="challenge" value="([^"]+)"`)
+
+	setup := func(t *testing.T) (http.Handler, *string, *int) {
+		var code string
+		var logins int
+		auth := maildoor.New(
+			maildoor.StatelessCodes(secret, time.Minute),
+			maildoor.WithTokenStorage(failingStorage{t}),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				code = codePattern.FindString(msg.Text)
+				return nil
+			}),
+			maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+				logins++
+			}),
+		)
+
+		return auth, &code, &logins
+	}
+
+	request := func(auth http.Handler) (*httptest.ResponseRecorder, string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {"a@b.com"}}
+		auth.ServeHTTP(w, req)
+
+		m := challengePattern.FindStringSubmatch(w.Body.String())
+		if m == nil {
+			t.Fatal("no challenge in the code page")
+		}
+
+		return w, m[1]
+	}
+
+	verify := func(auth http.Handler, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/code", nil)
+		req.Form = form
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	t.Run("verifies the code against the challenge", func(t *testing.T) {
+		auth, code, logins := setup(t)
+		w, challenge := request(auth)
+
+		cookie := w.Result().Cookies()[0]
+		testhelpers.Equals(t, "maildoor_challenge", cookie.Name)
+		testhelpers.Equals(t, challenge, cookie.Value)
+		testhelpers.True(t, cookie.HttpOnly)
+		testhelpers.NotContains(t, challenge, "a@b.com")
+
+		form := url.Values{"email": {"a@b.com"}, "code": {*code}, "challenge": {challenge}}
+		verify(auth, form)
+		testhelpers.Equals(t, 1, *logins)
+
+		// The challenge can't be replayed.
+		w = verify(auth, form)
+		testhelpers.Equals(t, 1, *logins)
+		testhelpers.Contains(t, w.Body.String(), "Invalid token")
+	})
+
+	t.Run("reads the challenge from the cookie", func(t *testing.T) {
+		auth, code, logins := setup(t)
+		rec, _ := request(auth)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/code", nil)
+		req.Form = url.Values{"email": {"a@b.com"}, "code": {*code}}
+		req.AddCookie(rec.Result().Cookies()[0])
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, 1, *logins)
+	})
+
+	t.Run("rejects other emails and tampered challenges", func(t *testing.T) {
+		auth, code, logins := setup(t)
+		_, challenge := request(auth)
+
+		verify(auth, url.Values{"email": {"c@d.com"}, "code": {*code}, "challenge": {challenge}})
+		tampered := challenge[:len(challenge)-2] + "AA"
+		if tampered == challenge {
+			tampered = challenge[:len(challenge)-2] + "BB"
+		}
+
+		w := verify(auth, url.Values{"email": {"a@b.com"}, "code": {*code}, "challenge": {tampered}})
+
+		testhelpers.Equals(t, 0, *logins)
+		testhelpers.Contains(t, w.Body.String(), "Invalid token")
+	})
+
+	t.Run("puts the challenge in the magic link", func(t *testing.T) {
+		var link string
+		auth := maildoor.New(
+			maildoor.BaseURL("http://example.com"),
+			maildoor.StatelessCodes(secret, 0),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				link = regexp.MustCompile(`https?://\S+`).FindString(msg.Text)
+				return nil
+			}),
+		)
+
+		_, challenge := request(auth)
+		testhelpers.Contains(t, link, "challenge="+challenge)
+	})
+
+	t.Run("the cookie is secure with an https BaseURL", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.BaseURL("https://example.com"),
+			maildoor.StatelessCodes(secret, 0),
+			maildoor.MessageSender(func(msg maildoor.Message) error { return nil }),
+		)
+
+		w, _ := request(auth)
+		testhelpers.True(t, w.Result().Cookies()[0].Secure)
+	})
+
+	t.Run("panics with a short secret", func(t *testing.T) {
+		defer func() {
+			testhelpers.NotNil(t, recover())
+		}()
+
+		maildoor.New(maildoor.StatelessCodes([]byte("short"), 0))
+	})
+}
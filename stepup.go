@@ -0,0 +1,236 @@
+package maildoor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// verifiedCookie is the recently verified marker, it holds the
+	// tenant, the email and the time it was last verified.
+	verifiedCookie = "maildoor_verified"
+
+	// defaultStepUpMaxAge is the time a verification is recent for.
+	defaultStepUpMaxAge = 15 * time.Minute
+)
+
+// stepUp signs the recently verified markers.
+type stepUp struct {
+	key    []byte
+	maxAge time.Duration
+}
+
+func newStepUp(secret []byte, maxAge time.Duration) (*stepUp, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("the secret must be at least 32 bytes")
+	}
+
+	if maxAge <= 0 {
+		maxAge = defaultStepUpMaxAge
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("maildoor step-up marker"))
+
+	return &stepUp{key: mac.Sum(nil), maxAge: maxAge}, nil
+}
+
+// marker returns the signed marker for the email of the tenant
+// verified at.
+func (s *stepUp) marker(tenant, email string, at time.Time) string {
+	payload := binary.BigEndian.AppendUint64(nil, uint64(at.Unix()))
+	payload = append(payload, tenant+"\x00"+email...)
+
+	return base64.RawURLEncoding.EncodeToString(append(payload, s.sign(payload)...))
+}
+
+// verifiedAt returns the tenant and the email of the marker and the
+// time they were verified when the signature is valid.
+func (s *stepUp) verifiedAt(marker string) (string, string, time.Time, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(marker)
+	if err != nil || len(b) < 8+sha256.Size {
+		return "", "", time.Time{}, false
+	}
+
+	payload, sig := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	if !hmac.Equal(sig, s.sign(payload)) {
+		return "", "", time.Time{}, false
+	}
+
+	tenant, email, ok := strings.Cut(string(payload[8:]), "\x00")
+	at := time.Unix(int64(binary.BigEndian.Uint64(payload[:8])), 0)
+
+	return tenant, email, at, ok
+}
+
+func (s *stepUp) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+// recent returns true when the request has a marker for the email of
+// the tenant verified within the max age.
+func (s *stepUp) recent(r *http.Request, tenant, email string) bool {
+	c, err := r.Cookie(verifiedCookie)
+	if err != nil {
+		return false
+	}
+
+	t, verified, at, ok := s.verifiedAt(c.Value)
+	return ok && t == tenant && verified == email && time.Since(at) < s.maxAge
+}
+
+// markVerified records the email was just verified in the tenant of
+// the request, the marker is visible to all the application routes
+// and only counts for the tenant.
+func (m *maildoor) markVerified(w http.ResponseWriter, r *http.Request, email string) {
+	if m.stepUp == nil {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     verifiedCookie,
+		Value:    m.stepUp.marker(m.tenant(r).ID, email, time.Now()),
+		Path:     "/",
+		MaxAge:   int(m.stepUp.maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   m.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// returnToken signs the return path of the step-up flow for the email
+// of the tenant, its forms carry the token so other logins can't
+// choose where they return to.
+func (s *stepUp) returnToken(tenant, email, ret string) string {
+	sig := s.sign([]byte("return\x00" + tenant + "\x00" + email + "\x00" + ret))
+	return base64.RawURLEncoding.EncodeToString([]byte(ret)) + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// returnPath returns the path of the return token when it was signed
+// for the email of the tenant.
+func (s *stepUp) returnPath(tenant, email, token string) (string, bool) {
+	enc, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+
+	ret, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return "", false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(b, s.sign([]byte("return\x00"+tenant+"\x00"+email+"\x00"+string(ret)))) {
+		return "", false
+	}
+
+	return string(ret), true
+}
+
+// stepUpReturn returns the path to return to after the step-up
+// verification of the email, the return token must come from the
+// step-up page and only local paths are accepted.
+func (m *maildoor) stepUpReturn(r *http.Request, email string) string {
+	if m.stepUp == nil {
+		return ""
+	}
+
+	ret, ok := m.stepUp.returnPath(m.tenant(r).ID, email, r.FormValue("return"))
+	if !ok || !localPath(ret) {
+		return ""
+	}
+
+	return ret
+}
+
+// formReturn returns the return token in the form when it is valid
+// for the email in the form, the pages of the flow pass it along.
+func (m *maildoor) formReturn(r *http.Request) string {
+	email, _ := m.formEmail(r)
+	if m.stepUpReturn(r, email) == "" {
+		return ""
+	}
+
+	return r.FormValue("return")
+}
+
+// localPath reports whether ret is a path in this site. Browsers drop
+// tabs and newlines from URLs and read backslashes as slashes, so
+// paths like "/\t/evil.com" would leave the site.
+func localPath(ret string) bool {
+	if !strings.HasPrefix(ret, "/") {
+		return false
+	}
+
+	for _, c := range ret {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return false
+		}
+	}
+
+	u, err := url.Parse(ret)
+	return err == nil && u.Scheme == "" && u.Host == "" && !strings.HasPrefix(ret, "//")
+}
+
+// completeStepUp records the email was verified again and returns
+// the user to the request that required it, without calling the
+// AfterLogin hook.
+func (m *maildoor) completeStepUp(w http.ResponseWriter, r *http.Request, email, ret string) {
+	m.emit(r, EventStepUp, email, nil)
+	m.markVerified(w, r, email)
+
+	http.Redirect(w, r, ret, http.StatusSeeOther)
+}
+
+// RequireRecentLogin returns middleware that sends the users through
+// the email code again when their email was not verified within the
+// max age of StepUp, and then back to the request. The email function
+// returns the email of the signed in user (usually from the application
+// session), requests without one are sent to the login page.
+//
+// Requests other than GET and HEAD can't be repeated so the users
+// return to the page that made them. RequireRecentLogin panics when
+// auth is not a maildoor handler with StepUp.
+func RequireRecentLogin(auth http.Handler, email func(r *http.Request) string) func(http.Handler) http.Handler {
+	m, ok := auth.(*maildoor)
+	if !ok || m.stepUp == nil {
+		panic("maildoor: RequireRecentLogin requires a handler with StepUp")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e, err := m.normalizeEmail(email(r))
+			if err != nil || e == "" {
+				http.Redirect(w, r, path.Join(m.tenant(r).prefix, "login"), http.StatusSeeOther)
+				return
+			}
+
+			if m.stepUp.recent(r, m.tenant(r).ID, e) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ret := r.URL.RequestURI()
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				ret = "/"
+				if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host {
+					ret = ref.RequestURI()
+				}
+			}
+
+			q := url.Values{"email": {e}, "return": {ret}}
+			http.Redirect(w, r, path.Join(m.tenant(r).prefix, "stepup")+"?"+q.Encode(), http.StatusSeeOther)
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package maildoor_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestRequireRecentLogin(t *testing.T) {
+	var code string
+	var logins []string
+	auth := maildoor.New(
+		maildoor.StepUp(bytes.Repeat([]byte("k"), 32), 0),
+		maildoor.ResendCooldown(0),
+		maildoor.MessageSender(func(msg maildoor.Message) error {
+			code = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+			return nil
+		}),
+		maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+			logins = append(logins, maildoor.EmailFrom(r))
+		}),
+	)
+
+	signedIn := "a@b.com"
+	recent := maildoor.RequireRecentLogin(auth, func(r *http.Request) string { return signedIn })
+	app := recent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("sensitive"))
+	}))
+
+	get := func(h http.Handler, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		return w
+	}
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := get(app, "/account/delete?confirm=1", nil)
+	testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+	testhelpers.Equals(t, "/stepup?email=a%40b.com&return=%2Faccount%2Fdelete%3Fconfirm%3D1", w.Header().Get("Location"))
+
+	w = get(auth, w.Header().Get("Location"), nil)
+	testhelpers.Equals(t, http.StatusOK, w.Code)
+	testhelpers.Contains(t, w.Body.String(), "Confirm it&#39;s you")
+	testhelpers.Contains(t, w.Body.String(), `name="email" value="a@b.com"`)
+
+	// The return path is signed for the email by the step-up page.
+	ret := regexp.MustCompile(`name="return" value="([^"]+)"`).FindStringSubmatch(w.Body.String())[1]
+
+	form := url.Values{"email": {"a@b.com"}, "return": {ret}}
+	w = post("/email", form)
+	testhelpers.Contains(t, w.Body.String(), `name="return" value="`+ret+`"`)
+
+	form.Set("code", code)
+	w = post("/code", form)
+	testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+	testhelpers.Equals(t, "/account/delete?confirm=1", w.Header().Get("Location"))
+	testhelpers.Equals(t, 0, len(logins))
+
+	cookie := w.Result().Cookies()[0]
+	testhelpers.Equals(t, "maildoor_verified", cookie.Name)
+	testhelpers.Equals(t, "/", cookie.Path)
+
+	w = get(app, "/account/delete?confirm=1", cookie)
+	testhelpers.Equals(t, http.StatusOK, w.Code)
+	testhelpers.Equals(t, "sensitive", w.Body.String())
+
+	t.Run("requires the marker of the signed in email", func(t *testing.T) {
+		signedIn = "c@d.com"
+		defer func() { signedIn = "a@b.com" }()
+
+		w := get(app, "/account/delete", cookie)
+		testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+		testhelpers.Contains(t, w.Header().Get("Location"), "/stepup?email=c%40d.com")
+	})
+
+	t.Run("rejects tampered markers", func(t *testing.T) {
+		tampered := *cookie
+		tampered.Value = "x" + cookie.Value[1:]
+
+		w := get(app, "/account/delete", &tampered)
+		testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+	})
+
+	t.Run("sends users without email to login", func(t *testing.T) {
+		signedIn = ""
+		defer func() { signedIn = "a@b.com" }()
+
+		w := get(app, "/account/delete", nil)
+		testhelpers.Equals(t, "/login", w.Header().Get("Location"))
+	})
+
+	t.Run("ignores external returns", func(t *testing.T) {
+		for _, ret := range []string{
+			"",
+			"account",
+			"//evil.com/x",
+			"/\\evil.com",
+			"/\t/evil.com",
+			"/\n/evil.com",
+			"/\r/evil.com",
+			"https://evil.com/x",
+			"https:/evil.com",
+			"/account\x00",
+		} {
+			q := url.Values{"email": {"a@b.com"}, "return": {ret}}
+			w := get(auth, "/stepup?"+q.Encode(), nil)
+			testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+			testhelpers.Equals(t, "/login", w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("returns only on the step-up flow", func(t *testing.T) {
+		logins = nil
+
+		// Returns that weren't signed by the step-up page.
+		for _, ret := range []string{"/account", ret + "x"} {
+			form := url.Values{"email": {"a@b.com"}, "return": {ret}}
+			post("/email", form)
+
+			form.Set("code", code)
+			w := post("/code", form)
+			testhelpers.NotContains(t, w.Header().Get("Location"), "/account")
+		}
+
+		// The token of an email doesn't work for another one.
+		form := url.Values{"email": {"e@f.com"}, "return": {ret}}
+		post("/email", form)
+
+		form.Set("code", code)
+		w := post("/code", form)
+		testhelpers.NotContains(t, w.Header().Get("Location"), "/account")
+		testhelpers.Equals(t, []string{"a@b.com", "a@b.com", "e@f.com"}, logins)
+	})
+
+	t.Run("logins mark the email as verified", func(t *testing.T) {
+		post("/email", url.Values{"email": {"a@b.com"}})
+		w := post("/code", url.Values{"email": {"a@b.com"}, "code": {code}})
+
+		cookie := w.Result().Cookies()[0]
+		testhelpers.Equals(t, "maildoor_verified", cookie.Name)
+
+		w = get(app, "/account/delete", cookie)
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("the marker is secure with an https BaseURL", func(t *testing.T) {
+		var code string
+		auth := maildoor.New(
+			maildoor.BaseURL("https://example.com"),
+			maildoor.StepUp(bytes.Repeat([]byte("k"), 32), 0),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				code = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+				return nil
+			}),
+		)
+
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {"a@b.com"}}
+		auth.ServeHTTP(httptest.NewRecorder(), req)
+
+		w := httptest.NewRecorder()
+		req = httptest.NewRequest("POST", "/code", nil)
+		req.Form = url.Values{"email": {"a@b.com"}, "code": {code}}
+		auth.ServeHTTP(w, req)
+
+		cookie := w.Result().Cookies()[0]
+		testhelpers.Equals(t, "maildoor_verified", cookie.Name)
+		testhelpers.True(t, cookie.Secure)
+	})
+
+	t.Run("panics without StepUp", func(t *testing.T) {
+		defer func() {
+			testhelpers.NotNil(t, recover())
+		}()
+
+		maildoor.RequireRecentLogin(maildoor.New(), func(r *http.Request) string { return "" })
+	})
+}
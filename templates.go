@@ -0,0 +1,120 @@
+package maildoor
+
+import (
+	"errors"
+	"html/template"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// pages are the template sets maildoor renders by default, these
+// are parsed when the handler is created.
+var pages = [][]string{
+	{"layout.html", "handle_login.html"},
+	{"layout.html", "handle_code.html"},
+	{"layout.html", "handle_signup.html"},
+	{"layout.html", "handle_approve.html"},
+	{"layout.html", "handle_passkey.html"},
+	{"layout.html", "handle_stepup.html"},
+	{"layout.html", "handle_change_email.html"},
+	{"layout.html", "handle_invite.html"},
+}
+
+// overlayFS is a fs.FS that looks for files in the upper FS
+// first and falls back to the lower one when not found there.
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil {
+		return f, nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return o.lower.Open(name)
+}
+
+// templateFS returns the FS the page templates of the tenant are
+// read from, the ones of the tenant overlay the Templates ones.
+func (m *maildoor) templateFS(t *tenant) fs.FS {
+	fsys := fs.FS(templates)
+	if m.templatesFS != nil {
+		fsys = overlayFS{upper: m.templatesFS, lower: fsys}
+	}
+
+	if t.Templates != nil {
+		fsys = overlayFS{upper: t.Templates, lower: fsys}
+	}
+
+	return fsys
+}
+
+// templateFuncs returns the functions available to the page
+// templates, custom functions can override the default ones.
+func (m *maildoor) templateFuncs(t *tenant) template.FuncMap {
+	funcs := template.FuncMap{
+		"prefixedPath": func(p string) string {
+			return path.Join(t.prefix, p)
+		},
+
+		"asset": func(name string) string {
+			return assetURL(t.prefix, name)
+		},
+	}
+
+	for k, fn := range m.funcs {
+		funcs[k] = fn
+	}
+
+	return funcs
+}
+
+// template returns the template of the tenant for the passed partials,
+// it is parsed from the templates FS the first time and cached after.
+func (m *maildoor) template(t *tenant, partials ...string) (*template.Template, error) {
+	key := t.ID + ":" + strings.Join(partials, ",")
+
+	m.parsedMu.RLock()
+	tt, ok := m.parsed[key]
+	m.parsedMu.RUnlock()
+	if ok {
+		return tt, nil
+	}
+
+	tt, err := template.New(partials[0]).Funcs(m.templateFuncs(t)).ParseFS(m.templateFS(t), partials...)
+	if err != nil {
+		return nil, err
+	}
+
+	m.parsedMu.Lock()
+	m.parsed[key] = tt
+	m.parsedMu.Unlock()
+
+	return tt, nil
+}
+
+// parsePages parses the default page templates of each tenant so
+// errors surface when the handler is created.
+func (m *maildoor) parsePages() error {
+	tenants := []*tenant{m.base}
+	for _, t := range m.tenants {
+		tenants = append(tenants, t)
+	}
+
+	for _, t := range tenants {
+		for _, partials := range pages {
+			if _, err := m.template(t, partials...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
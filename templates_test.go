@@ -0,0 +1,96 @@
+package maildoor_test
+
+import (
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+// countingFS counts the files opened from the wrapped FS.
+type countingFS struct {
+	fs.FS
+	opens atomic.Int32
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.opens.Add(1)
+	return c.FS.Open(name)
+}
+
+func TestTemplates(t *testing.T) {
+	t.Run("overrides the layout", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.Prefix("/auth"),
+			maildoor.Templates(fstest.MapFS{
+				"layout.html": {Data: []byte(`<html><body class="custom">{{block "yield" .}}{{end}}</body></html>`)},
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/auth/login", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Body.String(), `<body class="custom">`)
+
+		// handle_login.html is still the bundled one.
+		testhelpers.Contains(t, w.Body.String(), "Sign in to your account")
+		testhelpers.Contains(t, w.Body.String(), "/auth/email")
+	})
+
+	t.Run("overrides a page with custom funcs", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.TemplateFuncs(template.FuncMap{
+				"upper": strings.ToUpper,
+			}),
+			maildoor.Templates(fstest.MapFS{
+				"handle_code.html": {Data: []byte(`{{define "yield"}}<p>{{upper .Email}}</p>{{end}}`)},
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/code?email=a@b.com", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "<p>A@B.COM</p>")
+		testhelpers.Contains(t, w.Body.String(), "<!DOCTYPE html>")
+	})
+
+	t.Run("parses templates once", func(t *testing.T) {
+		fsys := &countingFS{FS: fstest.MapFS{}}
+		auth := maildoor.New(maildoor.Templates(fsys))
+
+		opens := fsys.opens.Load()
+		testhelpers.True(t, opens > 0)
+
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/login", nil)
+			auth.ServeHTTP(w, req)
+			testhelpers.Equals(t, http.StatusOK, w.Code)
+		}
+
+		testhelpers.Equals(t, opens, fsys.opens.Load())
+	})
+
+	t.Run("parse errors panic on New", func(t *testing.T) {
+		defer func() {
+			testhelpers.NotNil(t, recover())
+		}()
+
+		maildoor.New(maildoor.Templates(fstest.MapFS{
+			"handle_login.html": {Data: []byte("{{define")},
+		}))
+
+		t.Fatal("expected New to panic")
+	})
+}
@@ -0,0 +1,283 @@
+package maildoor
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+// tenantKey is the context key of the tenant of the request.
+const tenantKey contextKey = "tenant"
+
+// Tenant is one of the workspaces served by the handler, see Tenants.
+// Empty fields fall back to the options of the handler.
+type Tenant struct {
+	// ID is what the TenantResolver returns for the requests of
+	// the tenant, e.g. its host.
+	ID string
+
+	ProductName string
+	Logo        string
+	Icon        string
+
+	// EmailValidator and MessageSender replace the ones set with the
+	// options of the same name for the tenant.
+	EmailValidator func(email string) error
+	MessageSender  func(msg Message) error
+
+	// Templates overlays the page templates and EmailTemplates the
+	// email ones, see the Templates and EmailTemplates options.
+	Templates      fs.FS
+	EmailTemplates fs.FS
+
+	// Namespace prefixes the keys of the codes, attempts, cooldowns,
+	// pending signups, approvals, passkeys and OpenID Connect
+	// authorizations of the tenant so they don't collide across
+	// tenants. It defaults to the ID.
+	Namespace string
+}
+
+// TenantResolver determines the tenant of the requests, see
+// TenantByHost, TenantByHeader, TenantByPath and TenantFunc.
+type TenantResolver struct {
+	id func(r *http.Request) string
+
+	// segment is true when the tenant id is the first segment of
+	// the path, it is removed before routing the request.
+	segment bool
+}
+
+// TenantByHost resolves the tenant by the host of the request without
+// the port, e.g. acme.example.com.
+func TenantByHost() TenantResolver {
+	return TenantFunc(func(r *http.Request) string {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		return strings.ToLower(host)
+	})
+}
+
+// TenantByHeader resolves the tenant by the value of the header, e.g.
+// one set by a proxy in front of the app.
+func TenantByHeader(name string) TenantResolver {
+	return TenantFunc(func(r *http.Request) string {
+		return r.Header.Get(name)
+	})
+}
+
+// TenantByPath resolves the tenant by the first segment of the path,
+// the routes of the acme tenant are served under /acme/auth/ with the
+// /auth prefix.
+func TenantByPath() TenantResolver {
+	return TenantResolver{
+		id: func(r *http.Request) string {
+			id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+			return id
+		},
+
+		segment: true,
+	}
+}
+
+// TenantFunc resolves the tenant with the passed function.
+func TenantFunc(fn func(r *http.Request) string) TenantResolver {
+	return TenantResolver{id: fn}
+}
+
+// tenant is a Tenant with the fields the handler derives from it.
+type tenant struct {
+	Tenant
+
+	// prefix is the path the routes of the tenant are served under.
+	prefix string
+
+	emailSubject *texttemplate.Template
+	emailHTML    *template.Template
+	emailText    *texttemplate.Template
+}
+
+// setupTenants builds the default tenant from the options and the ones
+// passed to Tenants, filling their empty fields with the default ones.
+func (m *maildoor) setupTenants() error {
+	m.base = m.newTenant(Tenant{
+		ProductName:    m.productName,
+		Logo:           m.logoURL,
+		Icon:           m.iconURL,
+		EmailValidator: m.emailValidator,
+		MessageSender:  m.messageSender,
+	})
+
+	m.tenants = map[string]*tenant{}
+	for _, tc := range m.tenantConfigs {
+		if tc.ID == "" {
+			return fmt.Errorf("tenant without ID")
+		}
+
+		if _, ok := m.tenants[tc.ID]; ok {
+			return fmt.Errorf("duplicated tenant %q", tc.ID)
+		}
+
+		t := m.newTenant(tc)
+		t.ProductName = cmp.Or(t.ProductName, m.base.ProductName)
+		t.Namespace = cmp.Or(t.Namespace, t.ID)
+		if t.EmailValidator == nil {
+			t.EmailValidator = m.base.EmailValidator
+		}
+
+		if t.MessageSender == nil {
+			t.MessageSender = m.base.MessageSender
+		}
+
+		if err := m.parseTenantEmails(t); err != nil {
+			return fmt.Errorf("tenant %q: %w", tc.ID, err)
+		}
+
+		m.tenants[tc.ID] = t
+	}
+
+	return nil
+}
+
+// newTenant returns the tenant with its prefix, the default logo and
+// icon are served from the assets under it.
+func (m *maildoor) newTenant(tc Tenant) *tenant {
+	t := &tenant{Tenant: tc, prefix: path.Join("/", m.patternPrefix)}
+	if m.tenantResolver.segment && tc.ID != "" {
+		t.prefix = path.Join("/", tc.ID, m.patternPrefix)
+	}
+
+	t.Logo = cmp.Or(t.Logo, m.logoURL, assetURL(t.prefix, "logo.png"))
+	t.Icon = cmp.Or(t.Icon, m.iconURL, assetURL(t.prefix, "icon.png"))
+	t.emailSubject, t.emailHTML, t.emailText = m.emailSubject, m.emailHTML, m.emailText
+
+	return t
+}
+
+// parseTenantEmails parses the email templates of the tenant, files
+// not present fall back to the email templates of the handler.
+func (m *maildoor) parseTenantEmails(t *tenant) error {
+	if t.EmailTemplates == nil {
+		return nil
+	}
+
+	if b, err := fs.ReadFile(t.EmailTemplates, "subject.txt"); err == nil {
+		if t.emailSubject, err = texttemplate.New("subject.txt").Parse(string(b)); err != nil {
+			return err
+		}
+	}
+
+	if b, err := fs.ReadFile(t.EmailTemplates, "message.txt"); err == nil {
+		if t.emailText, err = texttemplate.New("message.txt").Parse(string(b)); err != nil {
+			return err
+		}
+	}
+
+	if b, err := fs.ReadFile(t.EmailTemplates, "message.html"); err == nil {
+		if t.emailHTML, err = template.New("message.html").Parse(string(b)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveTenant returns the tenant of the request and the request path
+// without the tenant, false when the tenant is not known.
+func (m *maildoor) resolveTenant(r *http.Request) (*tenant, string, bool) {
+	if m.tenantResolver.id == nil {
+		return m.base, r.URL.Path, true
+	}
+
+	id := m.tenantResolver.id(r)
+	t, ok := m.tenants[id]
+	if !ok {
+		return nil, "", false
+	}
+
+	p := r.URL.Path
+	if m.tenantResolver.segment {
+		p = "/" + strings.TrimPrefix(strings.TrimPrefix(p, "/"+id), "/")
+	}
+
+	return t, p, true
+}
+
+// withTenant adds the tenant to the request context and removes it
+// from the path when it is part of it. It returns false when the
+// tenant is not known.
+func (m *maildoor) withTenant(r *http.Request) (*http.Request, bool) {
+	t, p, ok := m.resolveTenant(r)
+	if !ok {
+		return r, false
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), tenantKey, t))
+	if p != r.URL.Path {
+		u := *r.URL
+		u.Path, u.RawPath = p, ""
+		r.URL = &u
+	}
+
+	return r, true
+}
+
+// tenant returns the tenant of the request. Requests that don't go
+// through the handler, e.g. the ones of RequireRecentLogin, are
+// resolved when needed and fall back to the default tenant.
+func (m *maildoor) tenant(r *http.Request) *tenant {
+	if t, ok := r.Context().Value(tenantKey).(*tenant); ok {
+		return t
+	}
+
+	if t, _, ok := m.resolveTenant(r); ok {
+		return t
+	}
+
+	return m.base
+}
+
+// allTenants returns the tenants served by the handler, the ones passed
+// to Tenants or the default one when the tenants are not resolved.
+func (m *maildoor) allTenants() []*tenant {
+	if m.tenantResolver.id == nil {
+		return []*tenant{m.base}
+	}
+
+	all := make([]*tenant, 0, len(m.tenants))
+	for _, t := range m.tenants {
+		all = append(all, t)
+	}
+
+	return all
+}
+
+// storageKey namespaces the key with the tenant of the request, e.g.
+// the email of a code or the id of a pending signup.
+func (m *maildoor) storageKey(r *http.Request, key string) string {
+	if ns := m.tenant(r).Namespace; ns != "" {
+		return ns + ":" + key
+	}
+
+	return key
+}
+
+// TenantFrom returns the ID of the tenant of the request, e.g. in the
+// AfterLogin hook. It is empty when Tenants is not used.
+func TenantFrom(r *http.Request) string {
+	t, _ := r.Context().Value(tenantKey).(*tenant)
+	if t == nil {
+		return ""
+	}
+
+	return t.ID
+}
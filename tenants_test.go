@@ -0,0 +1,596 @@
+package maildoor_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"testing/fstest"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+	"github.com/wawandco/maildoor/internal/webauthn/webauthntest"
+)
+
+func TestTenants(t *testing.T) {
+	t.Run("branding by host", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.Prefix("/auth"),
+			maildoor.ProductName("Default"),
+			maildoor.Tenants(maildoor.TenantByHost(),
+				maildoor.Tenant{ID: "acme.example.com", ProductName: "Acme", Logo: "https://acme.example.com/logo.png"},
+				maildoor.Tenant{ID: "globex.example.com"},
+			),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/auth/login", nil)
+		req.Host = "acme.example.com:8080"
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "Acme")
+		testhelpers.Contains(t, w.Body.String(), "https://acme.example.com/logo.png")
+
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/auth/login", nil)
+		req.Host = "globex.example.com"
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "Default")
+		testhelpers.Contains(t, w.Body.String(), "/auth/assets/logo.")
+
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/auth/login", nil)
+		req.Host = "unknown.example.com"
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("tenant in the path", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.Prefix("/auth"),
+			maildoor.Tenants(maildoor.TenantByPath(),
+				maildoor.Tenant{ID: "acme", ProductName: "Acme"},
+			),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/acme/auth/login", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Contains(t, w.Body.String(), `action="/acme/auth/email"`)
+		testhelpers.Contains(t, w.Body.String(), "/acme/auth/assets/logo.")
+
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/acme/auth/assets/logo.png", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/auth/login", nil)
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("validator and sender by header", func(t *testing.T) {
+		var sent []string
+		auth := maildoor.New(
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				sent = append(sent, "default:"+msg.To)
+				return nil
+			}),
+			maildoor.Tenants(maildoor.TenantByHeader("X-Tenant"),
+				maildoor.Tenant{
+					ID: "acme",
+					EmailValidator: func(email string) error {
+						return errors.New("only acme.com emails")
+					},
+				},
+				maildoor.Tenant{
+					ID: "globex",
+					MessageSender: func(msg maildoor.Message) error {
+						sent = append(sent, "globex:"+msg.To)
+						return nil
+					},
+				},
+			),
+		)
+
+		post := func(tenant string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/email", nil)
+			req.Header.Set("X-Tenant", tenant)
+			req.Form = url.Values{"email": {"a@b.com"}}
+
+			w := httptest.NewRecorder()
+			auth.ServeHTTP(w, req)
+
+			return w
+		}
+
+		w := post("acme")
+		testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "only acme.com emails")
+
+		w = post("globex")
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Equals(t, []string{"globex:a@b.com"}, sent)
+
+		w = post("")
+		testhelpers.Equals(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("codes are namespaced", func(t *testing.T) {
+		var code string
+		var tenants []string
+		auth := maildoor.New(
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				code = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+				return nil
+			}),
+			maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+				tenants = append(tenants, maildoor.TenantFrom(r))
+			}),
+			maildoor.Tenants(maildoor.TenantByHeader("X-Tenant"),
+				maildoor.Tenant{ID: "acme"},
+				maildoor.Tenant{ID: "globex"},
+			),
+		)
+
+		post := func(tenant, path string, form url.Values) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", path, nil)
+			req.Header.Set("X-Tenant", tenant)
+			req.Form = form
+
+			w := httptest.NewRecorder()
+			auth.ServeHTTP(w, req)
+
+			return w
+		}
+
+		w := post("acme", "/email", url.Values{"email": {"a@b.com"}})
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+
+		w = post("globex", "/code", url.Values{"email": {"a@b.com"}, "code": {code}})
+		testhelpers.Equals(t, 0, len(tenants))
+
+		w = post("acme", "/code", url.Values{"email": {"a@b.com"}, "code": {code}})
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+		testhelpers.Equals(t, []string{"acme"}, tenants)
+	})
+
+	t.Run("templates by tenant", func(t *testing.T) {
+		var subject string
+		auth := maildoor.New(
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				subject = msg.Subject
+				return nil
+			}),
+			maildoor.Tenants(maildoor.TenantByHeader("X-Tenant"),
+				maildoor.Tenant{
+					ID: "acme",
+					Templates: fstest.MapFS{
+						"layout.html": {Data: []byte(`<html><body class="acme">{{block "yield" .}}{{end}}</body></html>`)},
+					},
+					EmailTemplates: fstest.MapFS{
+						"subject.txt": {Data: []byte(`Your Acme code is {{.Code}}`)},
+					},
+				},
+				maildoor.Tenant{ID: "globex"},
+			),
+		)
+
+		get := func(tenant string) string {
+			req := httptest.NewRequest("GET", "/login", nil)
+			req.Header.Set("X-Tenant", tenant)
+
+			w := httptest.NewRecorder()
+			auth.ServeHTTP(w, req)
+			testhelpers.Equals(t, http.StatusOK, w.Code)
+
+			return w.Body.String()
+		}
+
+		testhelpers.Contains(t, get("acme"), `<body class="acme">`)
+		testhelpers.NotContains(t, get("globex"), `<body class="acme">`)
+
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Header.Set("X-Tenant", "acme")
+		req.Form = url.Values{"email": {"a@b.com"}}
+		auth.ServeHTTP(httptest.NewRecorder(), req)
+
+		testhelpers.Contains(t, subject, "Your Acme code is ")
+	})
+
+	t.Run("panics with duplicated tenants", func(t *testing.T) {
+		defer func() {
+			testhelpers.NotNil(t, recover())
+		}()
+
+		maildoor.New(maildoor.Tenants(maildoor.TenantByHost(),
+			maildoor.Tenant{ID: "acme.example.com"},
+			maildoor.Tenant{ID: "acme.example.com"},
+		))
+	})
+}
+
+func TestTenantIsolation(t *testing.T) {
+	tenants := maildoor.Tenants(maildoor.TenantByHeader("X-Tenant"),
+		maildoor.Tenant{ID: "acme"},
+		maildoor.Tenant{ID: "globex"},
+	)
+
+	var msgs []maildoor.Message
+	sender := maildoor.MessageSender(func(msg maildoor.Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+
+	code := func() string {
+		return regexp.MustCompile(`\b\d{6}\b`).FindString(msgs[len(msgs)-1].Text)
+	}
+
+	link := func() *url.URL {
+		u, err := url.Parse(regexp.MustCompile(`https?://\S+`).FindString(msgs[len(msgs)-1].Text))
+		testhelpers.NoError(t, err)
+
+		return u
+	}
+
+	serve := func(h http.Handler, tenant string, req *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req.Header.Set("X-Tenant", tenant)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		return w
+	}
+
+	post := func(h http.Handler, tenant, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Form = form
+
+		return serve(h, tenant, req, cookies...)
+	}
+
+	cookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+
+		t.Fatalf("no %s cookie", name)
+		return nil
+	}
+
+	var logins []string
+	afterLogin := maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+		logins = append(logins, maildoor.TenantFrom(r))
+	})
+
+	secret := bytes.Repeat([]byte("s"), 32)
+
+	t.Run("invitations", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.BaseURL("http://example.com"),
+			maildoor.Invitations(secret, 0),
+			maildoor.UsedNonces(maildoor.NewInMemoryNonceCache()),
+			sender,
+			maildoor.Tenants(maildoor.TenantByHeader("X-Tenant"),
+				maildoor.Tenant{ID: "acme"},
+				maildoor.Tenant{
+					ID: "globex",
+					EmailValidator: func(email string) error {
+						return errors.New("only globex.com emails")
+					},
+				},
+			),
+		)
+
+		req := httptest.NewRequest("POST", "/admin/invites", nil)
+		req.Header.Set("X-Tenant", "acme")
+		inv, err := maildoor.SendInvite(auth, req, maildoor.Invitation{Email: "a@b.com"})
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, "acme", inv.Tenant)
+
+		token := link().Query().Get("token")
+		w := serve(auth, "globex", httptest.NewRequest("GET", "/invite?token="+token, nil))
+		testhelpers.Equals(t, http.StatusGone, w.Code)
+
+		// The invitation doesn't skip the validator of other tenants.
+		w = post(auth, "globex", "/email", url.Values{"email": {"a@b.com"}, "invite": {token}})
+		testhelpers.Equals(t, http.StatusUnprocessableEntity, w.Code)
+		testhelpers.Contains(t, w.Body.String(), "only globex.com emails")
+
+		w = serve(auth, "acme", httptest.NewRequest("GET", "/invite?token="+token, nil))
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("passkeys", func(t *testing.T) {
+		logins = nil
+		b64 := base64.RawURLEncoding.EncodeToString
+		store := maildoor.NewInMemoryCredentialStore()
+		auth := maildoor.New(
+			maildoor.BaseURL("http://example.com"),
+			maildoor.Passkeys(store),
+			maildoor.ResendCooldown(0),
+			sender,
+			afterLogin,
+			tenants,
+		)
+
+		options := func(w *httptest.ResponseRecorder) []byte {
+			var opts struct{ Challenge string }
+			testhelpers.NoError(t, json.NewDecoder(w.Body).Decode(&opts))
+
+			challenge, err := base64.RawURLEncoding.DecodeString(opts.Challenge)
+			testhelpers.NoError(t, err)
+
+			return challenge
+		}
+
+		post(auth, "acme", "/email", url.Values{"email": {"a@b.com"}})
+		w := post(auth, "acme", "/code", url.Values{"email": {"a@b.com"}, "code": {code()}})
+		ceremony := cookie(w, "maildoor_webauthn")
+
+		a := webauthntest.New("http://example.com", "example.com")
+		clientData, attestation := a.Create(options(post(auth, "acme", "/webauthn/register/options", nil, ceremony)))
+		post(auth, "acme", "/webauthn/register", url.Values{
+			"id":                {b64(a.CredentialID)},
+			"clientDataJSON":    {b64(clientData)},
+			"attestationObject": {b64(attestation)},
+		}, ceremony)
+
+		testhelpers.Equals(t, []string{"acme"}, logins)
+
+		cred, err := store.Find(context.Background(), a.CredentialID)
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, "acme:a@b.com", cred.Email)
+
+		login := func(tenant string) *httptest.ResponseRecorder {
+			w := post(auth, tenant, "/webauthn/login/options", nil)
+			clientData, authData, sig := a.Get(options(w))
+
+			return post(auth, tenant, "/webauthn/login", url.Values{
+				"id":                {b64(a.CredentialID)},
+				"clientDataJSON":    {b64(clientData)},
+				"authenticatorData": {b64(authData)},
+				"signature":         {b64(sig)},
+			}, cookie(w, "maildoor_webauthn"))
+		}
+
+		w = login("globex")
+		testhelpers.Equals(t, http.StatusUnauthorized, w.Code)
+		testhelpers.Equals(t, 1, len(logins))
+
+		login("acme")
+		testhelpers.Equals(t, []string{"acme", "acme"}, logins)
+	})
+
+	t.Run("step-up markers", func(t *testing.T) {
+		auth := maildoor.New(
+			maildoor.StepUp(secret, 0),
+			maildoor.ResendCooldown(0),
+			sender,
+			tenants,
+		)
+
+		post(auth, "acme", "/email", url.Values{"email": {"a@b.com"}})
+		w := post(auth, "acme", "/code", url.Values{"email": {"a@b.com"}, "code": {code()}})
+
+		marker := cookie(w, "maildoor_verified")
+		testhelpers.Equals(t, "/", marker.Path)
+
+		h := maildoor.RequireRecentLogin(auth, func(r *http.Request) string {
+			return "a@b.com"
+		})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		w = serve(h, "acme", httptest.NewRequest("GET", "/settings", nil), marker)
+		testhelpers.Equals(t, http.StatusNoContent, w.Code)
+
+		w = serve(h, "globex", httptest.NewRequest("GET", "/settings", nil), marker)
+		testhelpers.Equals(t, http.StatusSeeOther, w.Code)
+	})
+
+	t.Run("OpenID Connect", func(t *testing.T) {
+		logins = nil
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		auth := maildoor.New(
+			maildoor.BaseURL("http://example.com"),
+			maildoor.JWT(nil, maildoor.ES256Key("k1", key)),
+			maildoor.OIDC(maildoor.NewInMemoryClientRegistry(
+				maildoor.Client{ID: "web", Tenant: "acme", RedirectURIs: []string{"https://app.example.com/cb"}},
+			)),
+			maildoor.ResendCooldown(0),
+			sender,
+			afterLogin,
+			tenants,
+		)
+
+		verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		sum := sha256.Sum256([]byte(verifier))
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {"web"},
+			"redirect_uri":          {"https://app.example.com/cb"},
+			"scope":                 {"openid"},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+			"code_challenge_method": {"S256"},
+		}
+
+		// The client is not found with other tenants.
+		w := serve(auth, "globex", httptest.NewRequest("GET", "/authorize?"+q.Encode(), nil))
+		testhelpers.Equals(t, http.StatusBadRequest, w.Code)
+
+		w = serve(auth, "acme", httptest.NewRequest("GET", "/authorize?"+q.Encode(), nil))
+		pending := cookie(w, "maildoor_oidc")
+
+		login := func(tenant string) *httptest.ResponseRecorder {
+			post(auth, tenant, "/email", url.Values{"email": {"a@b.com"}}, pending)
+			return post(auth, tenant, "/code", url.Values{"email": {"a@b.com"}, "code": {code()}}, pending)
+		}
+
+		// Logging in to other tenants doesn't complete the authorization.
+		login("globex")
+		testhelpers.Equals(t, []string{"globex"}, logins)
+
+		u, err := url.Parse(login("acme").Header().Get("Location"))
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, "app.example.com", u.Host)
+
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {"web"},
+			"code":          {u.Query().Get("code")},
+			"redirect_uri":  {"https://app.example.com/cb"},
+			"code_verifier": {verifier},
+		}
+
+		w = post(auth, "globex", "/token", form)
+		testhelpers.Equals(t, http.StatusUnauthorized, w.Code)
+
+		w = post(auth, "acme", "/token", form)
+		testhelpers.Equals(t, http.StatusOK, w.Code)
+
+		var res struct {
+			AccessToken string `json:"access_token"`
+		}
+
+		testhelpers.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+
+		userinfo := func(tenant string) int {
+			req := httptest.NewRequest("GET", "/userinfo", nil)
+			req.Header.Set("Authorization", "Bearer "+res.AccessToken)
+
+			return serve(auth, tenant, req).Code
+		}
+
+		testhelpers.Equals(t, http.StatusUnauthorized, userinfo("globex"))
+		testhelpers.Equals(t, http.StatusOK, userinfo("acme"))
+	})
+
+	t.Run("access tokens", func(t *testing.T) {
+		key := maildoor.HS256Key("hs", bytes.Repeat([]byte("k"), 32))
+		auth := maildoor.New(maildoor.BaseURL("http://example.com"), maildoor.JWT(nil, key), maildoor.ResendCooldown(0), sender, tenants)
+		plain := maildoor.New(maildoor.BaseURL("http://example.com"), maildoor.JWT(nil, key), maildoor.ResendCooldown(0), sender)
+
+		token := func(h http.Handler, tenant string) string {
+			post(h, tenant, "/email", url.Values{"email": {"a@b.com"}})
+
+			req := httptest.NewRequest("POST", "/code", nil)
+			req.Header.Set("Accept", "application/json")
+			req.Form = url.Values{"email": {"a@b.com"}, "code": {code()}}
+
+			var pair maildoor.TokenPair
+			testhelpers.NoError(t, json.NewDecoder(serve(h, tenant, req).Body).Decode(&pair))
+
+			return pair.AccessToken
+		}
+
+		// Tokens without a tenant are not accepted by the tenants.
+		_, err := maildoor.VerifyAccessToken(auth, token(plain, ""))
+		testhelpers.Equals(t, maildoor.ErrInvalidToken, err)
+
+		acme := token(auth, "acme")
+		claims, err := maildoor.VerifyAccessToken(auth, acme)
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, "acme", claims["tid"])
+
+		_, err = maildoor.VerifyAccessToken(plain, acme)
+		testhelpers.Equals(t, maildoor.ErrInvalidToken, err)
+	})
+
+	t.Run("failed attempts", func(t *testing.T) {
+		logins = nil
+		auth := maildoor.New(maildoor.MaxCodeAttempts(2), maildoor.ResendCooldown(0), sender, afterLogin, tenants)
+
+		post(auth, "acme", "/email", url.Values{"email": {"a@b.com"}})
+		acme := code()
+
+		post(auth, "globex", "/email", url.Values{"email": {"a@b.com"}})
+		for range 2 {
+			post(auth, "globex", "/code", url.Values{"email": {"a@b.com"}, "code": {"abcdef"}})
+		}
+
+		post(auth, "acme", "/code", url.Values{"email": {"a@b.com"}, "code": {acme}})
+		testhelpers.Equals(t, []string{"acme"}, logins)
+	})
+
+	t.Run("resend cooldown", func(t *testing.T) {
+		auth := maildoor.New(sender, tenants)
+
+		sent := len(msgs)
+		post(auth, "acme", "/email", url.Values{"email": {"c@d.com"}})
+		post(auth, "globex", "/email", url.Values{"email": {"c@d.com"}})
+		testhelpers.Equals(t, sent+2, len(msgs))
+
+		w := post(auth, "acme", "/email", url.Values{"email": {"c@d.com"}})
+		testhelpers.Contains(t, w.Body.String(), "wait")
+		testhelpers.Equals(t, sent+2, len(msgs))
+	})
+
+	t.Run("pending signups", func(t *testing.T) {
+		logins = nil
+		store := maildoor.NewInMemoryUserStore()
+		auth := maildoor.New(
+			maildoor.Signup(store, maildoor.SignupField{Name: "name", Label: "signup.name", Required: true}),
+			maildoor.ResendCooldown(0),
+			sender,
+			afterLogin,
+			tenants,
+		)
+
+		w := post(auth, "acme", "/signup", url.Values{"email": {"a@b.com"}, "name": {"Mallory"}})
+		signup := cookie(w, "maildoor_signup")
+
+		post(auth, "globex", "/signup", url.Values{"email": {"a@b.com"}, "name": {"Ana"}})
+		post(auth, "globex", "/code", url.Values{"email": {"a@b.com"}, "code": {code()}}, signup)
+		testhelpers.Equals(t, 0, len(logins))
+
+		_, err := store.Find(context.Background(), "a@b.com")
+		testhelpers.Equals(t, maildoor.ErrUserNotFound, err)
+	})
+
+	t.Run("approvals", func(t *testing.T) {
+		logins = nil
+		auth := maildoor.New(maildoor.BaseURL("http://example.com"), maildoor.CrossDeviceApproval(), sender, afterLogin, tenants)
+
+		w := post(auth, "acme", "/email", url.Values{"email": {"a@b.com"}})
+		waiting := cookie(w, "maildoor_login")
+		approve := url.Values{"token": {link().Query().Get("token")}}
+
+		w = post(auth, "globex", "/approve", approve)
+		testhelpers.Contains(t, w.Body.String(), "This link expired or was already used")
+
+		w = serve(auth, "globex", httptest.NewRequest("GET", "/status", nil), waiting)
+		testhelpers.Equals(t, `{"status":"expired"}`+"\n", w.Body.String())
+
+		post(auth, "acme", "/approve", approve)
+		w = post(auth, "globex", "/complete", nil, waiting)
+		testhelpers.Equals(t, http.StatusConflict, w.Code)
+
+		post(auth, "acme", "/complete", nil, waiting)
+		testhelpers.Equals(t, []string{"acme"}, logins)
+	})
+}
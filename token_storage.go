@@ -87,6 +87,16 @@ func (s *InMemoryTokenStorage) Get(email string) (string, bool) {
 	return entry.token, true
 }
 
+// Expired returns true when there is a token for the email
+// but it is older than the TTL.
+func (s *InMemoryTokenStorage) Expired(email string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, exists := s.tokens[email]
+	return exists && s.ttl > 0 && time.Since(entry.createdAt) > s.ttl
+}
+
 // Delete implements ITokenStorage.Delete
 func (s *InMemoryTokenStorage) Delete(email string) bool {
 	s.mu.Lock()
@@ -132,3 +142,9 @@ func (s *InMemoryTokenStorage) cleanupLoop() {
 		s.Cleanup()
 	}
 }
+
+// TTL returns the duration tokens are valid for, 0 means they
+// never expire.
+func (s *InMemoryTokenStorage) TTL() time.Duration {
+	return s.ttl
+}
@@ -0,0 +1,433 @@
+package maildoor
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wawandco/maildoor/internal/jwt"
+)
+
+const (
+	// tokensKey is the context key of the tokens issued at login.
+	tokensKey contextKey = "tokens"
+
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrRefreshTokenNotFound is returned by RefreshTokenStore.Find
+	// when there is no refresh token with the id.
+	ErrRefreshTokenNotFound = errors.New("maildoor: refresh token not found")
+
+	// ErrInvalidToken is returned by VerifyAccessToken for tokens that
+	// are malformed, expired or not signed by the configured keys.
+	ErrInvalidToken = errors.New("maildoor: invalid token")
+
+	errInvalidGrant   = errors.New("invalid_grant")
+	errTokensDisabled = errors.New("maildoor: tokens are not enabled, see JWT")
+)
+
+// SigningKey signs the access tokens, see JWT.
+type SigningKey struct {
+	key jwt.Key
+	err error
+}
+
+// HS256Key is a key that signs with HMAC-SHA256, the secret needs to
+// be at least 32 random bytes. HMAC keys are not published in the JWKS
+// so the tokens can only be verified with VerifyAccessToken.
+func HS256Key(kid string, secret []byte) SigningKey {
+	k, err := jwt.NewHS256(kid, secret)
+	return SigningKey{key: k, err: err}
+}
+
+// ES256Key is a key that signs with ECDSA P-256.
+func ES256Key(kid string, key *ecdsa.PrivateKey) SigningKey {
+	k, err := jwt.NewES256(kid, key)
+	return SigningKey{key: k, err: err}
+}
+
+// EdDSAKey is a key that signs with Ed25519.
+func EdDSAKey(kid string, key ed25519.PrivateKey) SigningKey {
+	k, err := jwt.NewEdDSA(kid, key)
+	return SigningKey{key: k, err: err}
+}
+
+// TokenPair is the response of the login and refresh endpoints for API
+// clients, it follows the OAuth 2.0 token response.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken is a refresh token as kept in the RefreshTokenStore,
+// only the hash of the token is stored.
+type RefreshToken struct {
+	// ID is the SHA-256 hash of the token.
+	ID string
+
+	// Family groups the tokens rotated from the same login, it is
+	// revoked when one of them is reused.
+	Family string
+
+	Email     string
+	ExpiresAt time.Time
+
+	// Tenant is the ID of the tenant the token was issued for, it can
+	// only be exchanged with the same tenant, see Tenants.
+	Tenant string
+
+	// ClientID is the OpenID Connect client the token was issued to,
+	// only that client can exchange it. It is empty for the tokens of
+	// the login, exchanged at /token/refresh.
+	ClientID string
+
+	// Used is true once the token was exchanged for a new one.
+	Used bool
+
+	// Revoked is true when its family was revoked.
+	Revoked bool
+}
+
+// RefreshTokenStore keeps the refresh tokens, it allows to keep them
+// in a database or any other backend.
+type RefreshTokenStore interface {
+	// Save adds a new refresh token.
+	Save(ctx context.Context, t RefreshToken) error
+
+	// Find returns the refresh token with the id or
+	// ErrRefreshTokenNotFound.
+	Find(ctx context.Context, id string) (RefreshToken, error)
+
+	// Use marks the token as used, it returns false when it was used
+	// already. It needs to be atomic so a token can't be exchanged
+	// twice by concurrent requests.
+	Use(ctx context.Context, id string) (bool, error)
+
+	// RevokeFamily revokes all the tokens of the family.
+	RevokeFamily(ctx context.Context, family string) error
+}
+
+// InMemoryRefreshTokenStore keeps the refresh tokens in memory, it is
+// meant for development and tests.
+type InMemoryRefreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]RefreshToken
+}
+
+// NewInMemoryRefreshTokenStore creates an empty in-memory refresh
+// token store.
+func NewInMemoryRefreshTokenStore() *InMemoryRefreshTokenStore {
+	return &InMemoryRefreshTokenStore{tokens: map[string]RefreshToken{}}
+}
+
+// Save implements RefreshTokenStore.Save
+func (s *InMemoryRefreshTokenStore) Save(ctx context.Context, t RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, t := range s.tokens {
+		if now.After(t.ExpiresAt) {
+			delete(s.tokens, id)
+		}
+	}
+
+	s.tokens[t.ID] = t
+	return nil
+}
+
+// Find implements RefreshTokenStore.Find
+func (s *InMemoryRefreshTokenStore) Find(ctx context.Context, id string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+
+	return t, nil
+}
+
+// Use implements RefreshTokenStore.Use
+func (s *InMemoryRefreshTokenStore) Use(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok {
+		return false, ErrRefreshTokenNotFound
+	}
+
+	if t.Used {
+		return false, nil
+	}
+
+	t.Used = true
+	s.tokens[id] = t
+
+	return true, nil
+}
+
+// RevokeFamily implements RefreshTokenStore.RevokeFamily
+func (s *InMemoryRefreshTokenStore) RevokeFamily(ctx context.Context, family string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, t := range s.tokens {
+		if t.Family == family {
+			t.Revoked = true
+			s.tokens[id] = t
+		}
+	}
+
+	return nil
+}
+
+// tokens mints the access and refresh tokens.
+type tokens struct {
+	keys       []jwt.Key
+	store      RefreshTokenStore
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	claims     func(ctx context.Context, email string) (map[string]any, error)
+}
+
+func newTokens(keys []SigningKey, store RefreshTokenStore, accessTTL, refreshTTL time.Duration) (*tokens, error) {
+	t := &tokens{store: store, accessTTL: accessTTL, refreshTTL: refreshTTL}
+	for _, k := range keys {
+		if k.err != nil {
+			return nil, k.err
+		}
+
+		t.keys = append(t.keys, k.key)
+	}
+
+	if t.store == nil {
+		t.store = NewInMemoryRefreshTokenStore()
+	}
+
+	if t.accessTTL <= 0 {
+		t.accessTTL = defaultAccessTTL
+	}
+
+	if t.refreshTTL <= 0 {
+		t.refreshTTL = defaultRefreshTTL
+	}
+
+	return t, nil
+}
+
+// issueTokens signs an access token for the email and saves a new
+// refresh token in the family, a new family when empty. The client ID
+// is set for the tokens of an OpenID Connect client.
+func (m *maildoor) issueTokens(r *http.Request, email, family, clientID string) (TokenPair, error) {
+	t := m.tokens
+	ctx := r.Context()
+
+	claims := map[string]any{}
+	if t.claims != nil {
+		extra, err := t.claims(ctx, email)
+		if err != nil {
+			return TokenPair{}, err
+		}
+
+		maps.Copy(claims, extra)
+	}
+
+	now := time.Now()
+	claims["iss"] = m.issuer(r)
+	claims["aud"] = m.issuer(r)
+	claims["sub"] = email
+	claims["email"] = email
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(t.accessTTL).Unix()
+	claims["jti"] = randomToken()
+
+	// The tokens of a client are meant for it, VerifyAccessToken
+	// rejects them so they can't be replayed against the application.
+	if clientID != "" {
+		claims["aud"] = clientID
+		claims["client_id"] = clientID
+	}
+
+	delete(claims, "tid")
+	if id := m.tenant(r).ID; id != "" {
+		claims["tid"] = id
+	}
+
+	access, err := jwt.Sign(t.keys[0], jwt.TypeAccess, claims)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return TokenPair{}, err
+	}
+
+	if family == "" {
+		family = randomToken()
+	}
+
+	refresh := base64.RawURLEncoding.EncodeToString(raw)
+	err = t.store.Save(ctx, RefreshToken{
+		ID:        refreshTokenID(refresh),
+		Family:    family,
+		Email:     email,
+		Tenant:    m.tenant(r).ID,
+		ClientID:  clientID,
+		ExpiresAt: now.Add(t.refreshTTL),
+	})
+
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(t.accessTTL.Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// refresh exchanges the refresh token of the client for new tokens of
+// the same family. Reusing a token that was already exchanged revokes
+// its family, since either the client or an attacker has a stolen copy.
+func (m *maildoor) refresh(r *http.Request, refresh, clientID string) (TokenPair, error) {
+	ctx := r.Context()
+	t, err := m.tokens.store.Find(ctx, refreshTokenID(refresh))
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return TokenPair{}, errInvalidGrant
+	}
+
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	if t.Revoked || time.Now().After(t.ExpiresAt) || t.Tenant != m.tenant(r).ID || t.ClientID != clientID {
+		return TokenPair{}, errInvalidGrant
+	}
+
+	ok, err := m.tokens.store.Use(ctx, t.ID)
+	// The token may be removed since it was found.
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return TokenPair{}, errInvalidGrant
+	}
+
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	if !ok {
+		m.emit(r, EventRefreshReused, t.Email, nil)
+		if err := m.tokens.store.RevokeFamily(ctx, t.Family); err != nil {
+			return TokenPair{}, err
+		}
+
+		return TokenPair{}, errInvalidGrant
+	}
+
+	pair, err := m.issueTokens(r, t.Email, t.Family, t.ClientID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	m.emit(r, EventTokenRefreshed, t.Email, nil)
+	return pair, nil
+}
+
+// refreshTokenID is the hash the refresh token is stored by.
+func refreshTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// acceptsJSON returns true when the client asked for a JSON response,
+// e.g. API clients logging in with the code.
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// TokensFrom returns the tokens issued at login, they are available in
+// the AfterLogin hook when JWT is enabled.
+func TokensFrom(r *http.Request) (TokenPair, bool) {
+	pair, ok := r.Context().Value(tokensKey).(TokenPair)
+	return pair, ok
+}
+
+// VerifyAccessToken checks the signature, type, expiry, issuer and
+// audience of an access token issued by the auth handler and returns
+// its claims. ID tokens and the access tokens of OpenID Connect clients
+// are not accepted.
+// Tokens signed by any of the keys passed to JWT are accepted, so they
+// keep working while the keys are rotated.
+func VerifyAccessToken(auth http.Handler, token string) (map[string]any, error) {
+	m, ok := auth.(*maildoor)
+	if !ok || m.tokens == nil {
+		return nil, errTokensDisabled
+	}
+
+	claims, err := jwt.Verify(token, jwt.TypeAccess, m.tokens.keys, time.Now())
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// Any of the tenants may have issued it.
+	_, client := claims["client_id"]
+	for _, t := range m.allTenants() {
+		if m.issuedBy(claims, t) && claims["aud"] == m.issuerOf(t) && !client {
+			return claims, nil
+		}
+	}
+
+	return nil, ErrInvalidToken
+}
+
+// verifyAccessToken checks an access token was issued by the tenant of
+// the request, for the application or one of the OpenID Connect
+// clients, and returns its claims.
+func (m *maildoor) verifyAccessToken(r *http.Request, token string) (map[string]any, error) {
+	claims, err := jwt.Verify(token, jwt.TypeAccess, m.tokens.keys, time.Now())
+	if err != nil || !m.issuedBy(claims, m.tenant(r)) {
+		return nil, ErrInvalidToken
+	}
+
+	client, ok := claims["client_id"]
+	if aud := claims["aud"]; aud != m.issuer(r) && (!ok || aud != client) {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// issuedBy returns true when the iss of the claims is the issuer of the
+// tenant and the tid is its ID, tokens of the default tenant don't have
+// a tid.
+func (m *maildoor) issuedBy(claims map[string]any, t *tenant) bool {
+	tid, _ := claims["tid"].(string)
+	return claims["iss"] == m.issuerOf(t) && tid == t.ID
+}
+
+// writeTokens writes the token response, it must not be cached.
+func writeTokens(w http.ResponseWriter, v any) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	writeJSON(w, v)
+}
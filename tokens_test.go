@@ -0,0 +1,199 @@
+package maildoor_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+func TestJWT(t *testing.T) {
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, ed, _ := ed25519.GenerateKey(rand.Reader)
+
+	var code string
+	store := maildoor.NewInMemoryRefreshTokenStore()
+	newAuth := func(keys ...maildoor.SigningKey) http.Handler {
+		return maildoor.New(
+			maildoor.BaseURL("http://example.com"),
+			maildoor.JWT(store, keys...),
+			maildoor.TokenClaims(func(ctx context.Context, email string) (map[string]any, error) {
+				return map[string]any{"role": "admin", "sub": "ignored"}, nil
+			}),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				code = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+				return nil
+			}),
+		)
+	}
+
+	auth := newAuth(maildoor.ES256Key("k1", ec), maildoor.EdDSAKey("k0", ed))
+
+	post := func(h http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Form = form
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		return w
+	}
+
+	decode := func(w *httptest.ResponseRecorder) maildoor.TokenPair {
+		var pair maildoor.TokenPair
+		testhelpers.NoError(t, json.NewDecoder(w.Body).Decode(&pair))
+
+		return pair
+	}
+
+	post(auth, "/email", url.Values{"email": {"a@b.com"}})
+	w := post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {code}})
+	testhelpers.Equals(t, "application/json", w.Header().Get("Content-Type"))
+	testhelpers.Equals(t, "no-store", w.Header().Get("Cache-Control"))
+
+	pair := decode(w)
+	testhelpers.Equals(t, "Bearer", pair.TokenType)
+	testhelpers.Equals(t, 900, pair.ExpiresIn)
+	testhelpers.NotEquals(t, "", pair.RefreshToken)
+
+	claims, err := maildoor.VerifyAccessToken(auth, pair.AccessToken)
+	testhelpers.NoError(t, err)
+	testhelpers.Equals(t, "a@b.com", claims["sub"])
+	testhelpers.Equals(t, "admin", claims["role"])
+	testhelpers.Equals(t, "http://example.com", claims["iss"])
+
+	t.Run("publishes the keys", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/jwks.json", nil))
+
+		var set struct {
+			Keys []struct{ Kid, Kty, Alg string }
+		}
+
+		testhelpers.NoError(t, json.NewDecoder(w.Body).Decode(&set))
+		testhelpers.Equals(t, 2, len(set.Keys))
+		testhelpers.Equals(t, "k1", set.Keys[0].Kid)
+		testhelpers.Equals(t, "ES256", set.Keys[0].Alg)
+		testhelpers.Equals(t, "OKP", set.Keys[1].Kty)
+	})
+
+	w = post(auth, "/token/refresh", url.Values{"refresh_token": {pair.RefreshToken}})
+	testhelpers.Equals(t, "no-store", w.Header().Get("Cache-Control"))
+
+	refreshed := decode(w)
+	testhelpers.NotEquals(t, pair.RefreshToken, refreshed.RefreshToken)
+
+	_, err = maildoor.VerifyAccessToken(auth, refreshed.AccessToken)
+	testhelpers.NoError(t, err)
+
+	t.Run("reuse revokes the family", func(t *testing.T) {
+		w := post(auth, "/token/refresh", url.Values{"refresh_token": {pair.RefreshToken}})
+		testhelpers.Equals(t, http.StatusBadRequest, w.Code)
+		testhelpers.Contains(t, w.Body.String(), `"error":"invalid_grant"`)
+
+		w = post(auth, "/token/refresh", url.Values{"refresh_token": {refreshed.RefreshToken}})
+		testhelpers.Equals(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("checks the issuer", func(t *testing.T) {
+		other := maildoor.New(
+			maildoor.BaseURL("http://other.example.com"),
+			maildoor.JWT(nil, maildoor.ES256Key("k1", ec)),
+		)
+
+		_, err := maildoor.VerifyAccessToken(other, pair.AccessToken)
+		testhelpers.Equals(t, maildoor.ErrInvalidToken, err)
+	})
+
+	t.Run("tokens removed while refreshing", func(t *testing.T) {
+		store := &removedStore{InMemoryRefreshTokenStore: maildoor.NewInMemoryRefreshTokenStore()}
+		auth := maildoor.New(
+			maildoor.BaseURL("http://example.com"),
+			maildoor.JWT(store, maildoor.ES256Key("k1", ec)),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				code = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+				return nil
+			}),
+		)
+
+		post(auth, "/email", url.Values{"email": {"a@b.com"}})
+		pair := decode(post(auth, "/code", url.Values{"email": {"a@b.com"}, "code": {code}}))
+
+		w := post(auth, "/token/refresh", url.Values{"refresh_token": {pair.RefreshToken}})
+		testhelpers.Equals(t, http.StatusBadRequest, w.Code)
+		testhelpers.Contains(t, w.Body.String(), `"error":"invalid_grant"`)
+	})
+
+	t.Run("rotates the keys", func(t *testing.T) {
+		ec2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		rotated := newAuth(maildoor.ES256Key("k2", ec2), maildoor.ES256Key("k1", ec))
+
+		_, err := maildoor.VerifyAccessToken(rotated, pair.AccessToken)
+		testhelpers.NoError(t, err)
+
+		retired := newAuth(maildoor.ES256Key("k2", ec2))
+		_, err = maildoor.VerifyAccessToken(retired, pair.AccessToken)
+		testhelpers.Equals(t, maildoor.ErrInvalidToken, err)
+	})
+
+	t.Run("calls AfterLogin with the tokens", func(t *testing.T) {
+		var got maildoor.TokenPair
+		auth := maildoor.New(
+			maildoor.BaseURL("http://example.com"),
+			maildoor.JWT(nil, maildoor.HS256Key("hs", bytes.Repeat([]byte("s"), 32))),
+			maildoor.MessageSender(func(msg maildoor.Message) error {
+				code = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Text)
+				return nil
+			}),
+			maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = maildoor.TokensFrom(r)
+			}),
+		)
+
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {"a@b.com"}}
+		auth.ServeHTTP(httptest.NewRecorder(), req)
+
+		req = httptest.NewRequest("POST", "/code", nil)
+		req.Form = url.Values{"email": {"a@b.com"}, "code": {code}}
+		auth.ServeHTTP(httptest.NewRecorder(), req)
+
+		claims, err := maildoor.VerifyAccessToken(auth, got.AccessToken)
+		testhelpers.NoError(t, err)
+		testhelpers.Equals(t, "a@b.com", claims["email"])
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, httptest.NewRequest("GET", "/jwks.json", nil))
+		testhelpers.Contains(t, w.Body.String(), `"keys":[]`)
+	})
+
+	t.Run("panics with invalid keys", func(t *testing.T) {
+		defer func() {
+			testhelpers.NotNil(t, recover())
+		}()
+
+		maildoor.New(maildoor.BaseURL("http://example.com"), maildoor.JWT(nil, maildoor.HS256Key("hs", []byte("short"))))
+	})
+}
+
+// removedStore loses the refresh tokens between Find and Use, like a
+// store where they were removed by another request.
+type removedStore struct {
+	*maildoor.InMemoryRefreshTokenStore
+}
+
+func (s *removedStore) Use(ctx context.Context, id string) (bool, error) {
+	return false, maildoor.ErrRefreshTokenNotFound
+}
@@ -0,0 +1,98 @@
+package maildoor
+
+import (
+	"context"
+	"net/http"
+)
+
+// Tracer starts spans around the stages of the maildoor handlers
+// (token storage, rendering, email sending). It is shaped after the
+// OpenTelemetry API so an adapter only needs to translate the calls.
+type Tracer interface {
+	// Start creates a span that is a child of the span in ctx, if any,
+	// and returns a context that contains it.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a unit of work started by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute is a key value pair attached to a span.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Attr returns an Attribute with the passed key and value.
+func Attr(key string, value any) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// noopTracer is the default tracer, it does nothing.
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...Attribute) {}
+func (noopSpan) RecordError(err error)            {}
+func (noopSpan) End()                             {}
+
+// startSpan starts a span for the request, spans for a request
+// carry the hashed email when passed.
+func (m *maildoor) startSpan(r *http.Request, name, email string) (context.Context, Span) {
+	if email == "" {
+		return m.tracer.Start(r.Context(), name)
+	}
+
+	return m.tracer.Start(r.Context(), name, Attr("maildoor.email_hash", m.emailKey.hash(email)))
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	span.End()
+}
+
+// renderLogin renders the login page inside a span.
+func (m *maildoor) renderLogin(r *http.Request, data Attempt) (string, error) {
+	_, span := m.startSpan(r, "maildoor.render", "")
+	span.SetAttributes(Attr("maildoor.page", "login"))
+
+	html, err := m.loginRenderer(data)
+	endSpan(span, err)
+
+	return html, err
+}
+
+// renderCode renders the code page inside a span.
+func (m *maildoor) renderCode(r *http.Request, data Attempt) (string, error) {
+	_, span := m.startSpan(r, "maildoor.render", "")
+	span.SetAttributes(Attr("maildoor.page", "code"))
+
+	html, err := m.codeRenderer(data)
+	endSpan(span, err)
+
+	return html, err
+}
+
+// renderSignup renders the signup page inside a span.
+func (m *maildoor) renderSignup(r *http.Request, data Attempt) (string, error) {
+	_, span := m.startSpan(r, "maildoor.render", "")
+	span.SetAttributes(Attr("maildoor.page", "signup"))
+
+	html, err := m.signupRenderer(data)
+	endSpan(span, err)
+
+	return html, err
+}
@@ -0,0 +1,126 @@
+package maildoor_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+)
+
+type spanKey struct{}
+
+// tracer records the spans it starts along with their parent.
+type tracer struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+type span struct {
+	name   string
+	parent string
+	attrs  map[string]any
+	err    error
+	ended  bool
+}
+
+func (t *tracer) Start(ctx context.Context, name string, attrs ...maildoor.Attribute) (context.Context, maildoor.Span) {
+	s := &span{name: name, attrs: map[string]any{}}
+	if p, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.parent = p.name
+	}
+
+	s.SetAttributes(attrs...)
+
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *tracer) find(name string) *span {
+	for _, s := range t.spans {
+		if s.name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func (s *span) SetAttributes(attrs ...maildoor.Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *span) RecordError(err error) { s.err = err }
+func (s *span) End()                  { s.ended = true }
+
+func TestTracing(t *testing.T) {
+	t.Run("email flow", func(t *testing.T) {
+		tr := &tracer{}
+		auth := maildoor.New(
+			maildoor.WithTracer(tr),
+			maildoor.EmailSender(func(to, html, txt string) error {
+				return errors.New("smtp down")
+			}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email", nil)
+		req.Form = url.Values{"email": {"a@b.com"}}
+		auth.ServeHTTP(w, req)
+
+		names := []string{}
+		for _, s := range tr.spans {
+			names = append(names, s.name)
+			testhelpers.Equals(t, true, s.ended)
+			if s.name != "maildoor.request" {
+				testhelpers.Equals(t, "maildoor.request", s.parent)
+			}
+		}
+
+		testhelpers.Equals(t, []string{
+			"maildoor.request",
+			"maildoor.validate_email",
+			"maildoor.storage.store",
+			"maildoor.render_email",
+			"maildoor.send_email",
+			"maildoor.render",
+		}, names)
+
+		root := tr.find("maildoor.request")
+		testhelpers.Equals(t, "POST /email", root.attrs["http.route"])
+		testhelpers.Equals(t, http.StatusInternalServerError, root.attrs["http.status_code"])
+
+		send := tr.find("maildoor.send_email")
+		testhelpers.Equals(t, "smtp down", send.err.Error())
+		testhelpers.Equals(t, maildoor.HashEmail(auth, "a@b.com"), send.attrs["maildoor.email_hash"])
+		testhelpers.Equals(t, "login", tr.find("maildoor.render").attrs["maildoor.page"])
+	})
+
+	t.Run("code flow", func(t *testing.T) {
+		tr := &tracer{}
+		auth := maildoor.New(
+			maildoor.WithTracer(tr),
+			maildoor.WithTokenStorage(storageWith("a@b.com", "123456")),
+			maildoor.AfterLogin(func(w http.ResponseWriter, r *http.Request) {}),
+		)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/code", nil)
+		req.Form = url.Values{"email": {"a@b.com"}, "code": {"123456"}}
+		auth.ServeHTTP(w, req)
+
+		testhelpers.Equals(t, true, tr.find("maildoor.storage.get").attrs["maildoor.found"])
+		testhelpers.Equals(t, true, tr.find("maildoor.storage.delete").attrs["maildoor.found"])
+		testhelpers.Equals(t, "maildoor.request", tr.find("maildoor.after_login").parent)
+	})
+}
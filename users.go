@@ -0,0 +1,302 @@
+package maildoor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	userKey      contextKey = "user"
+	newSignupKey contextKey = "new_signup"
+
+	// signupCookie binds the pending signup to the browser that
+	// posted the signup form.
+	signupCookie = "maildoor_signup"
+)
+
+var (
+	// ErrUserNotFound is returned by UserStore.Find when there is
+	// no user for the email.
+	ErrUserNotFound = errors.New("maildoor: user not found")
+
+	// ErrPendingSignupNotFound is returned by PendingSignupStore.Take
+	// when there is no signup with the id.
+	ErrPendingSignupNotFound = errors.New("maildoor: pending signup not found")
+)
+
+// User is an account created by the signup flow.
+type User struct {
+	Email string
+
+	// Fields are the values the user entered in the signup
+	// form, keyed by the SignupField name.
+	Fields map[string]string
+}
+
+// UserStore finds and creates the users of the signup flow, it
+// allows to keep them in a database or any other backend.
+type UserStore interface {
+	// Find returns the user for the email or ErrUserNotFound.
+	Find(ctx context.Context, email string) (User, error)
+
+	// Create saves a new user, it is called once the email
+	// was verified with the login code.
+	Create(ctx context.Context, u User) error
+}
+
+// SignupField is a field of the signup form.
+type SignupField struct {
+	// Name of the form input and the key in User.Fields.
+	Name string
+
+	// Label is a message id (e.g. signup.name) or the text shown
+	// above the input.
+	Label string
+
+	// Type of the input, text by default.
+	Type string
+
+	Required bool
+
+	// Value entered by the user, set when rendering the form.
+	Value string
+}
+
+// maxFieldLength is the maximum length of the signup field values.
+const maxFieldLength = 256
+
+// pendingSignupTTL is the time the signup values are kept waiting
+// for the email to be verified.
+const pendingSignupTTL = time.Hour
+
+// PendingSignup holds the values of a signup until its email is verified.
+type PendingSignup struct {
+	Email     string
+	Fields    map[string]string
+	ExpiresAt time.Time
+}
+
+// PendingSignupStore keeps the signups waiting for their email to be
+// verified. Services with several instances should share it, e.g. with
+// Redis.
+type PendingSignupStore interface {
+	// Save keeps the signup with the id until it expires.
+	Save(ctx context.Context, id string, s PendingSignup) error
+
+	// Take returns and removes the signup with the id or
+	// ErrPendingSignupNotFound.
+	Take(ctx context.Context, id string) (PendingSignup, error)
+}
+
+// InMemoryPendingSignupStore keeps the pending signups in memory until
+// they expire.
+type InMemoryPendingSignupStore struct {
+	mu      sync.Mutex
+	signups map[string]PendingSignup
+}
+
+// NewInMemoryPendingSignupStore creates an empty in-memory pending
+// signup store.
+func NewInMemoryPendingSignupStore() *InMemoryPendingSignupStore {
+	return &InMemoryPendingSignupStore{signups: map[string]PendingSignup{}}
+}
+
+// Save implements PendingSignupStore.Save
+func (s *InMemoryPendingSignupStore) Save(ctx context.Context, id string, p PendingSignup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range s.signups {
+		if now.After(v.ExpiresAt) {
+			delete(s.signups, k)
+		}
+	}
+
+	s.signups[id] = p
+	return nil
+}
+
+// Take implements PendingSignupStore.Take
+func (s *InMemoryPendingSignupStore) Take(ctx context.Context, id string) (PendingSignup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.signups[id]
+	delete(s.signups, id)
+	if !ok || time.Now().After(p.ExpiresAt) {
+		return PendingSignup{}, ErrPendingSignupNotFound
+	}
+
+	return p, nil
+}
+
+// InMemoryUserStore keeps the users in memory, it is meant for
+// development and tests.
+type InMemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// NewInMemoryUserStore creates an empty in-memory user store.
+func NewInMemoryUserStore() *InMemoryUserStore {
+	return &InMemoryUserStore{users: map[string]User{}}
+}
+
+// Find implements UserStore.Find
+func (s *InMemoryUserStore) Find(ctx context.Context, email string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[email]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	return u, nil
+}
+
+// Create implements UserStore.Create
+func (s *InMemoryUserStore) Create(ctx context.Context, u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[u.Email] = u
+	return nil
+}
+
+// formFields returns the signup fields with the values in the form
+// and the error message for the first invalid one, if any.
+func (m *maildoor) formFields(r *http.Request, data Attempt) ([]SignupField, map[string]string, string) {
+	var problem string
+	fields := make([]SignupField, len(m.signupFields))
+	values := map[string]string{}
+
+	for i, f := range m.signupFields {
+		f.Value = strings.TrimSpace(r.FormValue(f.Name))
+		switch {
+		case problem != "":
+		case f.Required && f.Value == "":
+			problem = data.T("error.required_field", data.T(f.Label))
+		case len(f.Value) > maxFieldLength:
+			problem = data.T("error.field_too_long", data.T(f.Label))
+		}
+
+		fields[i] = f
+		values[f.Name] = f.Value
+	}
+
+	return fields, values, problem
+}
+
+// storePendingSignup keeps the signup values until the email is
+// verified, bound to the browser with a cookie so only the one that
+// posted the form can complete the signup in the same tenant.
+func (m *maildoor) storePendingSignup(w http.ResponseWriter, r *http.Request, email string, values map[string]string) error {
+	id := randomToken()
+	err := m.pendingSignups.Save(r.Context(), m.storageKey(r, id), PendingSignup{
+		Email:     email,
+		Fields:    values,
+		ExpiresAt: time.Now().Add(pendingSignupTTL),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     signupCookie,
+		Value:    id,
+		Path:     m.tenant(r).prefix,
+		MaxAge:   int(pendingSignupTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   m.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// takePendingSignup returns and removes the signup of the browser, it
+// only applies to the email that posted the signup form.
+func (m *maildoor) takePendingSignup(w http.ResponseWriter, r *http.Request, email string) (map[string]string, bool) {
+	c, err := r.Cookie(signupCookie)
+	if err != nil {
+		return nil, false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     signupCookie,
+		Path:     m.tenant(r).prefix,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   m.secureCookies(),
+	})
+
+	p, err := m.pendingSignups.Take(r.Context(), m.storageKey(r, c.Value))
+	if err != nil || p.Email != email {
+		return nil, false
+	}
+
+	return p.Fields, true
+}
+
+// verifiedUser finds the user for the verified email, creating it when
+// the browser has a pending signup for it. It returns true when the user
+// was created and ErrUserNotFound when there is neither a user nor a
+// signup.
+func (m *maildoor) verifiedUser(w http.ResponseWriter, r *http.Request, email string) (User, bool, error) {
+	ctx, span := m.startSpan(r, "maildoor.users.find", email)
+	u, err := m.userStore.Find(ctx, email)
+	span.SetAttributes(Attr("maildoor.found", err == nil))
+	if !errors.Is(err, ErrUserNotFound) {
+		endSpan(span, err)
+		return u, false, err
+	}
+
+	span.End()
+
+	values, ok := m.takePendingSignup(w, r, email)
+	if !ok {
+		return User{}, false, ErrUserNotFound
+	}
+
+	u = User{Email: email, Fields: values}
+	ctx, span = m.startSpan(r, "maildoor.users.create", email)
+	err = m.userStore.Create(ctx, u)
+	endSpan(span, err)
+	if err != nil {
+		return User{}, false, err
+	}
+
+	m.emit(r, EventSignup, email, nil)
+	return u, true, nil
+}
+
+// UserFrom returns the user that logged in, it is available in the
+// AfterLogin hook when the signup flow is enabled.
+func UserFrom(r *http.Request) (User, bool) {
+	u, ok := r.Context().Value(userKey).(User)
+	return u, ok
+}
+
+// IsNewSignup returns true inside the AfterLogin hook when the user
+// was just created by the signup flow.
+func IsNewSignup(r *http.Request) bool {
+	created, _ := r.Context().Value(newSignupKey).(bool)
+	return created
+}
+
+// randomToken returns a random hex value to identify a browser.
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,108 @@
+package validators
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"strings"
+	"sync"
+)
+
+//go:embed disposable.txt
+var disposable string
+
+// Disposable is the list of disposable email domains used by
+// NotDisposable, it is loaded from the bundled list and can be
+// updated with Add or Load.
+var Disposable = func() *DomainList {
+	l := NewDomainList()
+	if err := l.Load(strings.NewReader(disposable)); err != nil {
+		panic(err)
+	}
+
+	return l
+}()
+
+// DomainList is a set of domains safe for concurrent use. A domain
+// in the list matches its subdomains as well.
+type DomainList struct {
+	mu      sync.RWMutex
+	domains map[string]struct{}
+}
+
+// NewDomainList returns a list with the passed domains.
+func NewDomainList(domains ...string) *DomainList {
+	l := &DomainList{domains: map[string]struct{}{}}
+	l.Add(domains...)
+
+	return l
+}
+
+// Add adds the domains to the list.
+func (l *DomainList) Add(domains ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "" {
+			l.domains[d] = struct{}{}
+		}
+	}
+}
+
+// Load replaces the list with the domains in r, one per line. Empty
+// lines and lines starting with # are ignored.
+func (l *DomainList) Load(r io.Reader) error {
+	domains := map[string]struct{}{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		d := strings.ToLower(strings.TrimSpace(s.Text()))
+		if d == "" || strings.HasPrefix(d, "#") {
+			continue
+		}
+
+		domains[d] = struct{}{}
+	}
+
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.domains = domains
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Contains returns true when the domain or one of its parent
+// domains is in the list.
+func (l *DomainList) Contains(domain string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for domain != "" {
+		if _, ok := l.domains[domain]; ok {
+			return true
+		}
+
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			break
+		}
+
+		domain = domain[dot+1:]
+	}
+
+	return false
+}
+
+// Len returns the number of domains in the list.
+func (l *DomainList) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return len(l.domains)
+}
@@ -0,0 +1,275 @@
+package validators
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrUndeliverable is returned when the email domain has neither MX
+// nor A/AAAA records. When the domain looks like a typo the returned
+// error is a *TypoError that wraps it.
+var ErrUndeliverable = errors.New("email domain can't receive emails")
+
+// TypoError is returned for undeliverable domains that look like a
+// typo of a common email domain, its message suggests the correction.
+type TypoError struct {
+	Domain     string
+	Suggestion string
+}
+
+func (e *TypoError) Error() string {
+	return fmt.Sprintf("email domain %s can't receive emails. Did you mean %s?", e.Domain, e.Suggestion)
+}
+
+func (e *TypoError) Unwrap() error {
+	return ErrUndeliverable
+}
+
+// Resolver looks up the DNS records of a domain, *net.Resolver
+// implements it. Tests can use a fake one.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// MXOptions configures the MX validator.
+type MXOptions struct {
+	// Resolver used for the lookups, net.DefaultResolver by default.
+	Resolver Resolver
+
+	// Timeout for the lookups of a domain, 3 seconds by default.
+	Timeout time.Duration
+
+	// CacheTTL is the time the result for a domain is kept, 10
+	// minutes by default.
+	CacheTTL time.Duration
+
+	// CacheSize is the number of domains kept in the cache, the least
+	// recently used ones are dropped past it. 10000 by default.
+	CacheSize int
+}
+
+type mxResult struct {
+	domain      string
+	deliverable bool
+	expires     time.Time
+}
+
+// mxCache keeps the lookup results of the most recently used domains.
+type mxCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newMXCache(size int) *mxCache {
+	return &mxCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// get returns the result for the domain when it has not expired.
+func (c *mxCache) get(domain string) (mxResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[domain]
+	if !ok {
+		return mxResult{}, false
+	}
+
+	res := e.Value.(mxResult)
+	if time.Now().After(res.expires) {
+		c.order.Remove(e)
+		delete(c.entries, domain)
+		return mxResult{}, false
+	}
+
+	c.order.MoveToFront(e)
+	return res, true
+}
+
+// put stores the result, dropping the least recently used domain when
+// the cache is full.
+func (c *mxCache) put(res mxResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[res.domain]; ok {
+		e.Value = res
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[res.domain] = c.order.PushFront(res)
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(mxResult).domain)
+	}
+}
+
+// MX checks the email domain has MX records, or A/AAAA records which
+// are used when there are no MX ones. Lookup failures other than the
+// domain not existing (e.g. timeouts) accept the email so a DNS outage
+// does not block logins.
+func MX(opts MXOptions) Validator {
+	if opts.Resolver == nil {
+		opts.Resolver = net.DefaultResolver
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * time.Second
+	}
+
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = 10 * time.Minute
+	}
+
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = 10000
+	}
+
+	cache := newMXCache(opts.CacheSize)
+
+	return func(email string) error {
+		domain := Domain(email)
+		if domain == "" {
+			return ErrInvalidSyntax
+		}
+
+		res, ok := cache.get(domain)
+		if !ok {
+			deliverable, err := lookupDomain(opts, domain)
+			if err != nil {
+				return nil
+			}
+
+			res = mxResult{domain: domain, deliverable: deliverable, expires: time.Now().Add(opts.CacheTTL)}
+			cache.put(res)
+		}
+
+		if res.deliverable {
+			return nil
+		}
+
+		if s := Suggest(domain); s != "" {
+			return &TypoError{Domain: domain, Suggestion: s}
+		}
+
+		return ErrUndeliverable
+	}
+}
+
+// lookupDomain returns whether the domain can receive emails, the
+// error is only returned when it could not be determined.
+func lookupDomain(opts MXOptions, domain string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	mxs, err := opts.Resolver.LookupMX(ctx, domain)
+	if err != nil && !notFound(err) {
+		return false, err
+	}
+
+	// A null MX (RFC 7505) says the domain does not accept emails.
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return false, nil
+	}
+
+	if len(mxs) > 0 {
+		return true, nil
+	}
+
+	hosts, err := opts.Resolver.LookupHost(ctx, domain)
+	if err != nil && !notFound(err) {
+		return false, err
+	}
+
+	return len(hosts) > 0, nil
+}
+
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// commonDomains are the email domains typos are checked against.
+var commonDomains = []string{
+	"aol.com",
+	"gmail.com",
+	"googlemail.com",
+	"gmx.com",
+	"hotmail.co.uk",
+	"hotmail.com",
+	"icloud.com",
+	"live.com",
+	"mail.com",
+	"me.com",
+	"msn.com",
+	"outlook.com",
+	"proton.me",
+	"protonmail.com",
+	"yahoo.co.uk",
+	"yahoo.com",
+	"yandex.com",
+}
+
+// Suggest returns the common email domain the passed one looks like
+// a typo of (e.g. gmail.com for gmial.com), or an empty string.
+func Suggest(domain string) string {
+	best, bestDist := "", 3
+	for _, c := range commonDomains {
+		if c == domain {
+			return ""
+		}
+
+		// Short domains need a closer match to avoid false positives.
+		limit := 2
+		if len(c) < 8 {
+			limit = 1
+		}
+
+		d := distance(domain, c)
+		if d <= limit && d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+
+	return best
+}
+
+// distance returns the optimal string alignment distance between a
+// and b, the edits are insertions, deletions, substitutions and
+// transpositions of adjacent characters.
+func distance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return d[len(a)][len(b)]
+}
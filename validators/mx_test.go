@@ -0,0 +1,105 @@
+package validators_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wawandco/maildoor/internal/testhelpers"
+	"github.com/wawandco/maildoor/validators"
+)
+
+// resolver is a fake DNS resolver with the records for a few domains.
+type resolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	delay time.Duration
+	calls int
+}
+
+func (r *resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.calls++
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if h, ok := r.hosts[host]; ok {
+		return h, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestMX(t *testing.T) {
+	res := &resolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com.", Pref: 10}},
+			"nomail.com":  {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"a-only.com": {"192.0.2.1"}},
+	}
+
+	v := validators.MX(validators.MXOptions{Resolver: res})
+
+	testhelpers.NoError(t, v("a@example.com"))
+	testhelpers.NoError(t, v("a@a-only.com"))
+	testhelpers.True(t, errors.Is(v("a@nomail.com"), validators.ErrUndeliverable))
+	testhelpers.Equals(t, validators.ErrUndeliverable, v("a@nowhere.dev"))
+
+	err := v("a@gmial.com")
+	testhelpers.True(t, errors.Is(err, validators.ErrUndeliverable))
+	testhelpers.Equals(t, "email domain gmial.com can't receive emails. Did you mean gmail.com?", err.Error())
+
+	t.Run("caches the lookups", func(t *testing.T) {
+		calls := res.calls
+		v("b@example.com")
+		v("c@EXAMPLE.com")
+		testhelpers.Equals(t, calls, res.calls)
+	})
+
+	t.Run("drops the least recently used domains", func(t *testing.T) {
+		res := &resolver{mx: map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}}}
+		v := validators.MX(validators.MXOptions{Resolver: res, CacheSize: 2})
+
+		v("a@example.com")
+		v("a@one.dev")
+		v("a@example.com")
+		v("a@two.dev")
+		testhelpers.Equals(t, 3, res.calls)
+
+		v("a@example.com")
+		testhelpers.Equals(t, 3, res.calls)
+
+		v("a@one.dev")
+		testhelpers.Equals(t, 4, res.calls)
+	})
+
+	t.Run("accepts the email on timeouts", func(t *testing.T) {
+		slow := &resolver{delay: time.Second}
+		v := validators.MX(validators.MXOptions{Resolver: slow, Timeout: 10 * time.Millisecond})
+
+		testhelpers.NoError(t, v("a@nowhere.dev"))
+	})
+}
+
+func TestSuggest(t *testing.T) {
+	testhelpers.Equals(t, "gmail.com", validators.Suggest("gmial.com"))
+	testhelpers.Equals(t, "gmail.com", validators.Suggest("gmail.con"))
+	testhelpers.Equals(t, "hotmail.com", validators.Suggest("hotmal.com"))
+	testhelpers.Equals(t, "yahoo.com", validators.Suggest("yaho.com"))
+	testhelpers.Equals(t, "", validators.Suggest("gmail.com"))
+	testhelpers.Equals(t, "", validators.Suggest("example.com"))
+	testhelpers.Equals(t, "", validators.Suggest("aol.co.jp"))
+}
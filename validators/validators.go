@@ -0,0 +1,149 @@
+// Package validators contains email validators that can be combined
+// and passed to maildoor.EmailValidator:
+//
+//	maildoor.EmailValidator(validators.All(
+//		validators.Syntax(),
+//		validators.NotDisposable(),
+//		validators.AllowDomains("example.com"),
+//	))
+package validators
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+var (
+	// ErrInvalidSyntax is returned when the email is not a valid address.
+	ErrInvalidSyntax = errors.New("invalid email address")
+
+	// ErrDomainNotAllowed is returned when the email domain is not
+	// in the allowed domains.
+	ErrDomainNotAllowed = errors.New("email domain is not allowed")
+
+	// ErrDomainBlocked is returned when the email domain is blocked.
+	ErrDomainBlocked = errors.New("email domain is blocked")
+
+	// ErrDisposable is returned for disposable email addresses.
+	ErrDisposable = errors.New("disposable email addresses are not allowed")
+)
+
+// Validator checks an email and returns an error when it is not
+// accepted, the error message is shown to the user.
+type Validator func(email string) error
+
+// Normalize trims the spaces around the email and lowercases its domain.
+func Normalize(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	return email[:at+1] + strings.ToLower(email[at+1:])
+}
+
+// Normalized runs the validator with the normalized email.
+func Normalized(v Validator) Validator {
+	return func(email string) error {
+		return v(Normalize(email))
+	}
+}
+
+// Domain returns the lowercased domain of the email.
+func Domain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(email[at+1:]))
+}
+
+// Syntax checks the email is a bare RFC 5322 address, names and
+// angle brackets (e.g. "Ana <ana@example.com>") are rejected.
+func Syntax() Validator {
+	return func(email string) error {
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Name != "" || addr.Address != email {
+			return ErrInvalidSyntax
+		}
+
+		if !strings.Contains(Domain(email), ".") {
+			return ErrInvalidSyntax
+		}
+
+		return nil
+	}
+}
+
+// AllowDomains accepts emails in the passed domains or their
+// subdomains only, e.g. for internal tools.
+func AllowDomains(domains ...string) Validator {
+	list := NewDomainList(domains...)
+	return func(email string) error {
+		if !list.Contains(Domain(email)) {
+			return ErrDomainNotAllowed
+		}
+
+		return nil
+	}
+}
+
+// BlockDomains rejects emails in the passed domains or their subdomains.
+func BlockDomains(domains ...string) Validator {
+	list := NewDomainList(domains...)
+	return func(email string) error {
+		if list.Contains(Domain(email)) {
+			return ErrDomainBlocked
+		}
+
+		return nil
+	}
+}
+
+// NotDisposable rejects emails in the Disposable domain list.
+func NotDisposable() Validator {
+	return func(email string) error {
+		if Disposable.Contains(Domain(email)) {
+			return ErrDisposable
+		}
+
+		return nil
+	}
+}
+
+// All accepts the email when all the validators accept it, it returns
+// the error of the first one that rejects it.
+func All(validators ...Validator) Validator {
+	return func(email string) error {
+		for _, v := range validators {
+			if err := v(email); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// Any accepts the email when one of the validators accepts it, when
+// all reject it the error of the first one is returned.
+func Any(validators ...Validator) Validator {
+	return func(email string) error {
+		var first error
+		for _, v := range validators {
+			err := v(email)
+			if err == nil {
+				return nil
+			}
+
+			if first == nil {
+				first = err
+			}
+		}
+
+		return first
+	}
+}
@@ -0,0 +1,79 @@
+package validators_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wawandco/maildoor"
+	"github.com/wawandco/maildoor/internal/testhelpers"
+	"github.com/wawandco/maildoor/validators"
+)
+
+func TestSyntax(t *testing.T) {
+	v := validators.Syntax()
+
+	for _, email := range []string{"a@b.com", "first.last+tag@sub.example.co"} {
+		testhelpers.NoError(t, v(email))
+	}
+
+	for _, email := range []string{"", "a", "a@", "@b.com", "a@b", "Ana <a@b.com>", "a b@c.com", " a@b.com"} {
+		testhelpers.Equals(t, validators.ErrInvalidSyntax, v(email))
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	testhelpers.Equals(t, "Ana@example.com", validators.Normalize("  Ana@EXAMPLE.com "))
+	testhelpers.Equals(t, "example.com", validators.Domain("ana@Example.COM"))
+
+	v := validators.Normalized(validators.Syntax())
+	testhelpers.NoError(t, v(" a@b.com "))
+}
+
+func TestDomains(t *testing.T) {
+	allow := validators.AllowDomains("Example.com")
+	testhelpers.NoError(t, allow("a@example.com"))
+	testhelpers.NoError(t, allow("a@eng.example.com"))
+	testhelpers.Equals(t, validators.ErrDomainNotAllowed, allow("a@notexample.com"))
+	testhelpers.Equals(t, validators.ErrDomainNotAllowed, allow("a@example.com.evil.io"))
+
+	block := validators.BlockDomains("spam.io")
+	testhelpers.NoError(t, block("a@example.com"))
+	testhelpers.Equals(t, validators.ErrDomainBlocked, block("a@SPAM.io"))
+}
+
+func TestDisposable(t *testing.T) {
+	v := validators.NotDisposable()
+	testhelpers.Equals(t, validators.ErrDisposable, v("a@mailinator.com"))
+	testhelpers.Equals(t, validators.ErrDisposable, v("a@x.yopmail.com"))
+	testhelpers.NoError(t, v("a@gmail.com"))
+
+	l := validators.NewDomainList()
+	err := l.Load(strings.NewReader("# comment\n\nTemp.io\nburner.dev\n"))
+	testhelpers.NoError(t, err)
+	testhelpers.Equals(t, 2, l.Len())
+	testhelpers.True(t, l.Contains("temp.io"))
+	testhelpers.False(t, l.Contains("io"))
+}
+
+func TestCombinators(t *testing.T) {
+	v := validators.All(
+		validators.Syntax(),
+		validators.Any(
+			validators.AllowDomains("example.com"),
+			validators.AllowDomains("partner.io"),
+		),
+	)
+
+	testhelpers.NoError(t, v("a@example.com"))
+	testhelpers.NoError(t, v("a@partner.io"))
+	testhelpers.Equals(t, validators.ErrDomainNotAllowed, v("a@gmail.com"))
+	testhelpers.Equals(t, validators.ErrInvalidSyntax, v("a@partner"))
+}
+
+func TestEmailValidatorOption(t *testing.T) {
+	// Validators plug into the option as they are.
+	maildoor.New(maildoor.EmailValidator(validators.All(
+		validators.Syntax(),
+		validators.NotDisposable(),
+	)))
+}